@@ -0,0 +1,183 @@
+package bam
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DefaultAliases is given to every AlignmentMap as it is loaded, so that
+// UCSC and Ensembl style names of the human and mouse assemblies both
+// resolve. Set it to nil to only match names exactly.
+var DefaultAliases = HumanAliases().Merge(MouseAliases())
+
+// Aliases groups the names that a reference sequence is known by, such as
+// "chr1" and "1", or "chrM" and "MT". Each name is recorded under the
+// naming convention it belongs to ("ucsc", "ensembl", "genbank", ...).
+type Aliases struct {
+	sets map[string]*aliasSet
+}
+
+type aliasSet struct {
+	names map[string]string // convention -> name
+	all   []string
+}
+
+// NewAliases creates an empty alias table.
+func NewAliases() *Aliases {
+	return &Aliases{sets: make(map[string]*aliasSet)}
+}
+
+// Add declares the names as aliases of each other. The map key is the
+// naming convention of each name. Names already known join their sets.
+func (a *Aliases) Add(names map[string]string) {
+	s := &aliasSet{names: make(map[string]string)}
+	var merge []*aliasSet
+	for _, name := range names {
+		if old, ok := a.sets[name]; ok {
+			merge = append(merge, old)
+		}
+	}
+	for _, old := range merge {
+		for conv, name := range old.names {
+			s.names[conv] = name
+		}
+		for _, name := range old.all {
+			s.add(name)
+		}
+	}
+	for conv, name := range names {
+		if name == "" {
+			continue
+		}
+		s.names[conv] = name
+		s.add(name)
+	}
+	for _, name := range s.all {
+		a.sets[name] = s
+	}
+}
+
+func (s *aliasSet) add(name string) {
+	for _, n := range s.all {
+		if n == name {
+			return
+		}
+	}
+	s.all = append(s.all, name)
+}
+
+// Merge adds all of the aliases in other to a, and returns a.
+func (a *Aliases) Merge(other *Aliases) *Aliases {
+	seen := make(map[*aliasSet]bool)
+	for _, s := range other.sets {
+		if !seen[s] {
+			seen[s] = true
+			a.Add(s.names)
+		}
+	}
+	return a
+}
+
+// Names returns all of the names equivalent to name, including itself.
+func (a *Aliases) Names(name string) []string {
+	s, ok := a.sets[name]
+	if !ok {
+		return []string{name}
+	}
+	res := append([]string(nil), s.all...)
+	sort.Strings(res)
+	return res
+}
+
+// Convert returns the name used for name's sequence by the given naming
+// convention, and false if it isn't known.
+func (a *Aliases) Convert(name, convention string) (string, bool) {
+	s, ok := a.sets[name]
+	if !ok {
+		return "", false
+	}
+	n, ok := s.names[convention]
+	return n, ok
+}
+
+// LoadAliases reads a UCSC chromAlias file, see ReadAliases.
+func LoadAliases(filename string) (*Aliases, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadAliases(f)
+}
+
+// ReadAliases reads a UCSC chromAlias file. Two layouts are understood:
+// the current one, with a "# ucsc	ensembl	genbank ..." header naming the
+// convention of each column, and the older one without a header, with
+// "alias	ucscName	source" on each line.
+func ReadAliases(r io.Reader) (*Aliases, error) {
+	a := NewAliases()
+	var columns []string
+
+	s := bufio.NewScanner(r)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := s.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if line[0] == '#' {
+			if columns == nil {
+				columns = strings.Split(strings.TrimSpace(line[1:]), "\t")
+			}
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		names := make(map[string]string)
+		if columns != nil {
+			for i, f := range fields {
+				if i < len(columns) && f != "" {
+					names[columns[i]] = f
+				}
+			}
+		} else {
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("bam: chromAlias line %d: expected at least 2 columns", lineno)
+			}
+			source := "alias"
+			if len(fields) > 2 {
+				source = fields[2]
+			}
+			names[source] = fields[0]
+			names["ucsc"] = fields[1]
+		}
+		a.Add(names)
+	}
+	return a, s.Err()
+}
+
+// HumanAliases returns the UCSC and Ensembl names of the primary human
+// chromosomes (as used by hg19/GRCh37 and hg38/GRCh38).
+func HumanAliases() *Aliases {
+	return primaryAliases(22)
+}
+
+// MouseAliases returns the UCSC and Ensembl names of the primary mouse
+// chromosomes (as used by mm10/GRCm38 and mm39/GRCm39).
+func MouseAliases() *Aliases {
+	return primaryAliases(19)
+}
+
+func primaryAliases(autosomes int) *Aliases {
+	a := NewAliases()
+	for i := 1; i <= autosomes; i++ {
+		n := fmt.Sprint(i)
+		a.Add(map[string]string{"ucsc": "chr" + n, "ensembl": n})
+	}
+	a.Add(map[string]string{"ucsc": "chrX", "ensembl": "X"})
+	a.Add(map[string]string{"ucsc": "chrY", "ensembl": "Y"})
+	a.Add(map[string]string{"ucsc": "chrM", "ensembl": "MT"})
+	return a
+}
@@ -0,0 +1,50 @@
+package bam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadAliases(t *testing.T) {
+	text := "# ucsc\tensembl\tgenbank\nchr1\t1\tCM000663.2\nchrM\tMT\tJ01415.2\n"
+	a, err := ReadAliases(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := a.Names("MT"), []string{"J01415.2", "MT", "chrM"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Names(MT) = %v, want %v", got, want)
+	}
+	if n, ok := a.Convert("CM000663.2", "ucsc"); !ok || n != "chr1" {
+		t.Errorf("Convert(CM000663.2, ucsc) = %q, %v", n, ok)
+	}
+	if _, ok := a.Convert("chr2", "ensembl"); ok {
+		t.Error("converted an unknown name")
+	}
+
+	// the older layout without a header
+	a, err = ReadAliases(strings.NewReader("1\tchr1\tensembl\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, ok := a.Convert("chr1", "ensembl"); !ok || n != "1" {
+		t.Errorf("old layout Convert(chr1, ensembl) = %q, %v", n, ok)
+	}
+}
+
+func TestRefIDAliases(t *testing.T) {
+	b := &AlignmentMap{References: testRefs, Aliases: DefaultAliases}
+	for name, want := range map[string]int32{"chr1": 0, "1": 0, "2": 1} {
+		if id, ok := b.RefID(name); !ok || id != want {
+			t.Errorf("RefID(%q) = %d, %v, want %d", name, id, ok, want)
+		}
+	}
+	if _, ok := b.RefID("X"); ok {
+		t.Error("RefID found a reference that isn't in the file")
+	}
+
+	b.Aliases = nil
+	if _, ok := b.RefID("1"); ok {
+		t.Error("RefID used aliases after they were removed")
+	}
+}
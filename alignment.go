@@ -0,0 +1,146 @@
+package bam
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RefID returns the reference sequence ID, or -1 for unplaced reads.
+func (a *Alignment) RefID() int32 { return a.refID }
+
+// Pos returns the 0-based leftmost mapping position.
+func (a *Alignment) Pos() int32 { return a.pos }
+
+// End returns the 0-based, exclusive rightmost reference position covered
+// by the alignment, computed from the CIGAR. Alignments without a CIGAR
+// are treated as covering a single base.
+func (a *Alignment) End() int32 {
+	n := int32(0)
+	for _, op := range a.cigarPacked {
+		if CigarOp(op).ConsumesReference() {
+			n += int32(CigarOp(op).Len())
+		}
+	}
+	if n == 0 {
+		n = 1
+	}
+	return a.pos + n
+}
+
+// MapQ returns the mapping quality.
+func (a *Alignment) MapQ() uint8 { return a.mapq }
+
+// Flag returns the bitwise FLAG field.
+func (a *Alignment) Flag() uint16 { return a.flag }
+
+// NextRefID returns the reference sequence ID of the next segment.
+func (a *Alignment) NextRefID() int32 { return a.nextRefID }
+
+// NextPos returns the 0-based leftmost position of the next segment.
+func (a *Alignment) NextPos() int32 { return a.nextPos }
+
+// TLen returns the observed template length.
+func (a *Alignment) TLen() int32 { return a.tlen }
+
+// Sequence returns the read sequence text.
+func (a *Alignment) Sequence() string {
+	const packmap = "=ACMGRSVTWYHKDBN"
+	r := make([]byte, a.seqLen)
+	for i := range r {
+		p := a.seqPacked[i/2]
+		if i%2 == 0 {
+			p >>= 4
+		}
+		r[i] = packmap[p&0x0F]
+	}
+	return string(r)
+}
+
+// Qual returns the raw (not +33 offset) phred base qualities.
+func (a *Alignment) Qual() []byte { return []byte(a.qual) }
+
+// Flag bits of an Alignment.
+const (
+	FlagPaired        uint16 = 0x1   // template has multiple segments
+	FlagProperPair    uint16 = 0x2   // each segment properly aligned
+	FlagUnmapped      uint16 = 0x4   // segment unmapped
+	FlagMateUnmapped  uint16 = 0x8   // next segment unmapped
+	FlagReverse       uint16 = 0x10  // sequence is reverse complemented
+	FlagMateReverse   uint16 = 0x20  // next segment is reverse complemented
+	FlagRead1         uint16 = 0x40  // first segment in the template
+	FlagRead2         uint16 = 0x80  // last segment in the template
+	FlagSecondary     uint16 = 0x100 // secondary alignment
+	FlagQCFail        uint16 = 0x200 // not passing quality controls
+	FlagDuplicate     uint16 = 0x400 // PCR or optical duplicate
+	FlagSupplementary uint16 = 0x800 // supplementary alignment
+)
+
+// A CigarOp is a single CIGAR operation, packed as in the BAM format.
+type CigarOp uint32
+
+// CIGAR operation types.
+const (
+	CigarMatch       = 0 // M
+	CigarInsertion   = 1 // I
+	CigarDeletion    = 2 // D
+	CigarSkipped     = 3 // N
+	CigarSoftClipped = 4 // S
+	CigarHardClipped = 5 // H
+	CigarPadded      = 6 // P
+	CigarEqual       = 7 // =
+	CigarMismatch    = 8 // X
+)
+
+const cigarChars = "MIDNSHP=X"
+
+// Type returns the operation type, such as CigarMatch.
+func (op CigarOp) Type() int { return int(op & 0xF) }
+
+// Len returns the length of the operation.
+func (op CigarOp) Len() int { return int(op >> 4) }
+
+// ConsumesQuery reports whether the operation moves along the read.
+func (op CigarOp) ConsumesQuery() bool {
+	switch op.Type() {
+	case CigarMatch, CigarInsertion, CigarSoftClipped, CigarEqual, CigarMismatch:
+		return true
+	}
+	return false
+}
+
+// ConsumesReference reports whether the operation moves along the reference.
+func (op CigarOp) ConsumesReference() bool {
+	switch op.Type() {
+	case CigarMatch, CigarDeletion, CigarSkipped, CigarEqual, CigarMismatch:
+		return true
+	}
+	return false
+}
+
+func (op CigarOp) String() string {
+	if op.Type() >= len(cigarChars) {
+		return fmt.Sprintf("%d?", op.Len())
+	}
+	return fmt.Sprintf("%d%c", op.Len(), cigarChars[op.Type()])
+}
+
+// Cigar returns the CIGAR operations of the alignment.
+func (a *Alignment) Cigar() []CigarOp {
+	res := make([]CigarOp, len(a.cigarPacked))
+	for i, op := range a.cigarPacked {
+		res[i] = CigarOp(op)
+	}
+	return res
+}
+
+// CigarString returns the CIGAR in SAM text form, or "*" if there is none.
+func (a *Alignment) CigarString() string {
+	if len(a.cigarPacked) == 0 {
+		return "*"
+	}
+	var sb strings.Builder
+	for _, op := range a.cigarPacked {
+		sb.WriteString(CigarOp(op).String())
+	}
+	return sb.String()
+}
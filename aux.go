@@ -0,0 +1,189 @@
+package bam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// SetAux sets an aux tag of the alignment, replacing any existing value,
+// in both AuxData and the encoding written by a Writer. The Go type of
+// the value picks the BAM type: string is Z, []byte is H, int8/uint8 are
+// c/C, int16/uint16 are s/S, int32/uint32 (and int) are i/I, float32 and
+// float64 are f, and slices of the other numeric types are B arrays.
+func (a *Alignment) SetAux(tag string, value interface{}) error {
+	if len(tag) != 2 {
+		return fmt.Errorf("bam: invalid aux tag %q", tag)
+	}
+	enc, err := appendAux([]byte(tag), value)
+	if err != nil {
+		return err
+	}
+	// build a new slice, as the old one may be shared by a copy
+	a.aux = append(removeAux(a.aux, tag), enc...)
+	if a.AuxData == nil {
+		a.AuxData = make(map[string]interface{})
+	}
+	if v, ok := value.(int); ok {
+		value = int32(v)
+	} else if v, ok := value.(float64); ok {
+		value = float32(v)
+	}
+	a.AuxData[tag] = value
+	return nil
+}
+
+// DeleteAux removes an aux tag from the alignment.
+func (a *Alignment) DeleteAux(tag string) {
+	if _, ok := a.AuxData[tag]; !ok {
+		return
+	}
+	a.aux = removeAux(a.aux, tag)
+	delete(a.AuxData, tag)
+}
+
+// clone returns a copy of the alignment that can have its fields and aux
+// data changed without affecting a.
+func (a *Alignment) clone() *Alignment {
+	c := *a
+	c.AuxData = make(map[string]interface{}, len(a.AuxData))
+	for k, v := range a.AuxData {
+		c.AuxData[k] = v
+	}
+	return &c
+}
+
+// removeAux returns a new copy of the encoded aux data without tag.
+func removeAux(aux []byte, tag string) []byte {
+	res := make([]byte, 0, len(aux)+16)
+	for len(aux) >= 3 {
+		n := auxEntryLen(aux)
+		if n > len(aux) {
+			n = len(aux)
+		}
+		if string(aux[:2]) != tag {
+			res = append(res, aux[:n]...)
+		}
+		aux = aux[n:]
+	}
+	return res
+}
+
+// auxEntryLen returns the encoded size of the aux entry at the start of p.
+func auxEntryLen(p []byte) int {
+	switch p[2] {
+	case 'A', 'c', 'C':
+		return 4
+	case 's', 'S':
+		return 5
+	case 'i', 'I', 'f':
+		return 7
+	case 'Z', 'H':
+		for i := 3; i < len(p); i++ {
+			if p[i] == 0 {
+				return i + 1
+			}
+		}
+		return len(p)
+	case 'B':
+		if len(p) < 8 {
+			return len(p)
+		}
+		n := int(binary.LittleEndian.Uint32(p[4:]))
+		switch p[3] {
+		case 's', 'S':
+			n *= 2
+		case 'i', 'I', 'f':
+			n *= 4
+		}
+		return 8 + n
+	}
+	return len(p)
+}
+
+// appendAux appends the type and encoded value to dst, which holds the tag.
+func appendAux(dst []byte, value interface{}) ([]byte, error) {
+	le := binary.LittleEndian
+	switch v := value.(type) {
+	case string:
+		dst = append(dst, 'Z')
+		dst = append(dst, v...)
+		return append(dst, 0), nil
+	case []byte:
+		dst = append(dst, 'H')
+		dst = append(dst, fmt.Sprintf("%X", v)...)
+		return append(dst, 0), nil
+	case int8:
+		return append(dst, 'c', byte(v)), nil
+	case uint8:
+		return append(dst, 'C', v), nil
+	case int16:
+		return le.AppendUint16(append(dst, 's'), uint16(v)), nil
+	case uint16:
+		return le.AppendUint16(append(dst, 'S'), v), nil
+	case int32:
+		return le.AppendUint32(append(dst, 'i'), uint32(v)), nil
+	case int:
+		if v < math.MinInt32 || v > math.MaxInt32 {
+			return nil, fmt.Errorf("bam: aux value %d out of range", v)
+		}
+		return le.AppendUint32(append(dst, 'i'), uint32(v)), nil
+	case uint32:
+		return le.AppendUint32(append(dst, 'I'), v), nil
+	case float32:
+		return le.AppendUint32(append(dst, 'f'), math.Float32bits(v)), nil
+	case float64:
+		return le.AppendUint32(append(dst, 'f'), math.Float32bits(float32(v))), nil
+	case []int8:
+		dst = le.AppendUint32(append(dst, 'B', 'c'), uint32(len(v)))
+		for _, x := range v {
+			dst = append(dst, byte(x))
+		}
+		return dst, nil
+	case []int16:
+		dst = le.AppendUint32(append(dst, 'B', 's'), uint32(len(v)))
+		for _, x := range v {
+			dst = le.AppendUint16(dst, uint16(x))
+		}
+		return dst, nil
+	case []uint16:
+		dst = le.AppendUint32(append(dst, 'B', 'S'), uint32(len(v)))
+		for _, x := range v {
+			dst = le.AppendUint16(dst, x)
+		}
+		return dst, nil
+	case []int32:
+		dst = le.AppendUint32(append(dst, 'B', 'i'), uint32(len(v)))
+		for _, x := range v {
+			dst = le.AppendUint32(dst, uint32(x))
+		}
+		return dst, nil
+	case []uint32:
+		dst = le.AppendUint32(append(dst, 'B', 'I'), uint32(len(v)))
+		for _, x := range v {
+			dst = le.AppendUint32(dst, x)
+		}
+		return dst, nil
+	case []float32:
+		dst = le.AppendUint32(append(dst, 'B', 'f'), uint32(len(v)))
+		for _, x := range v {
+			dst = le.AppendUint32(dst, math.Float32bits(x))
+		}
+		return dst, nil
+	}
+	return nil, fmt.Errorf("bam: unsupported aux value type %T", value)
+}
+
+// auxType returns the BAM type character of an aux tag, or 0 if the
+// alignment doesn't have it.
+func (a *Alignment) auxType(tag string) byte {
+	for p := a.aux; len(p) >= 3; p = p[auxEntryLen(p):] {
+		if string(p[:2]) == tag {
+			return p[2]
+		}
+		if auxEntryLen(p) > len(p) {
+			break
+		}
+	}
+	return 0
+}
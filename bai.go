@@ -1,17 +1,33 @@
 package bam
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
 )
 
 // An Index contains information to allow fast lookup
 // of sequences aligning to a region of reference sequence.
 type Index struct {
 	Refs []IndexReference
+
+	// MinShift and Depth describe the binning scheme. A BAI index always
+	// uses 16kb bins (MinShift 14) and 6 levels (Depth 5), a CSI index
+	// records its own.
+	MinShift int
+	Depth    int
+
+	// Unplaced is the number of unmapped reads without a reference
+	// (n_no_coor). HasUnplaced is false if the index doesn't record it,
+	// and Unplaced is then 0.
+	Unplaced    uint64
+	HasUnplaced bool
 }
 
 // A IndexReference contains alignment info for the reference sequence.
@@ -20,8 +36,13 @@ type IndexReference struct {
 	Bins map[uint32]Bin
 
 	// Intervals have the linear index of aligned sequences.
+	// CSI indexes have no linear index, see BinOffsets instead.
 	Intervals []Offset
 
+	// BinOffsets have the smallest offset of the alignments in each bin,
+	// only set for CSI indexes.
+	BinOffsets map[uint32]Offset
+
 	// Unmapped reads are placed into a single Chunk.
 	Unmapped Chunk
 
@@ -30,6 +51,9 @@ type IndexReference struct {
 
 	// TotalUnmapped read-segments for this reference.
 	TotalUnmapped uint64
+
+	minShift uint
+	depth    uint
 }
 
 // A Bin contains a list of Chunks.
@@ -54,49 +78,113 @@ func (o Offset) Uncompressed() uint16 {
 /////////
 
 // LoadIndex for a BAM file. You probably don't need this, it will automatically be loaded
-// via the Load("file.bam") method as long as "file.bam.bai" exists.
+// via the Load("file.bam") method as long as "file.bam.bai" (or "file.bam.csi") exists.
 func LoadIndex(filename string) (*Index, error) {
-	le := binary.LittleEndian
-
 	ff, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	f := &Index{}
+	defer ff.Close()
+	return ReadIndex(bufio.NewReader(ff))
+}
+
+// ReadIndex reads a BAI or CSI index from r.
+func ReadIndex(rd io.Reader) (*Index, error) {
+	le := binary.LittleEndian
+
+	ff := bufio.NewReader(rd)
+	if magic, err := ff.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		// CSI indexes are BGZF compressed
+		z, err := gzip.NewReader(ff)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		ff = bufio.NewReader(z)
+	}
+
+	f := &Index{MinShift: 14, Depth: 5}
 	tmp := make([]byte, 8)
-	_, err = io.ReadFull(ff, tmp)
+	_, err := io.ReadFull(ff, tmp[:4])
 	if err != nil {
 		return nil, err
 	}
-	if bytes.Equal(tmp, []byte{'B', 'A', 'M', 1}) {
-		return nil, fmt.Errorf("bam: invalid index file '%v'", tmp)
+	csi := bytes.Equal(tmp[:4], []byte{'C', 'S', 'I', 1})
+	if !csi && !bytes.Equal(tmp[:4], []byte{'B', 'A', 'I', 1}) {
+		return nil, fmt.Errorf("bam: invalid index file '%v'", tmp[:4])
+	}
+	if csi {
+		_, err = io.ReadFull(ff, tmp)
+		if err != nil {
+			return nil, err
+		}
+		f.MinShift = int(int32(le.Uint32(tmp)))
+		f.Depth = int(int32(le.Uint32(tmp[4:])))
+		_, err = io.ReadFull(ff, tmp[:4])
+		if err != nil {
+			return nil, err
+		}
+		// skip the auxiliary data
+		_, err = io.CopyN(ioutil.Discard, ff, int64(le.Uint32(tmp[:4])))
+		if err != nil {
+			return nil, err
+		}
+	}
+	pseudoBin := uint32(((1<<uint(3*(f.Depth+1)))-1)/7 + 1)
+
+	_, err = io.ReadFull(ff, tmp[:4])
+	if err != nil {
+		return nil, err
 	}
-	n := int32(le.Uint32(tmp[4:]))
+	n := int32(le.Uint32(tmp[:4]))
 	f.Refs = make([]IndexReference, n)
 	for i, r := range f.Refs {
+		r.minShift = uint(f.MinShift)
+		r.depth = uint(f.Depth)
 		_, err = io.ReadFull(ff, tmp[:4])
 		if err != nil {
 			return nil, err
 		}
 		nb := int32(le.Uint32(tmp[:4]))
 		r.Bins = make(map[uint32]Bin, nb)
+		if csi {
+			r.BinOffsets = make(map[uint32]Offset, nb)
+		}
 
 		BAMProgressFunc(float64(i*100) / float64(n))
 
 		for j := int32(0); j < nb; j++ {
-			_, err = io.ReadFull(ff, tmp)
+			_, err = io.ReadFull(ff, tmp[:4])
 			if err != nil {
 				return nil, err
 			}
 			bid := le.Uint32(tmp[:4])
-			nc := int32(le.Uint32(tmp[4:]))
+			if csi {
+				_, err = io.ReadFull(ff, tmp)
+				if err != nil {
+					return nil, err
+				}
+				r.BinOffsets[bid] = Offset(le.Uint64(tmp))
+			}
+			_, err = io.ReadFull(ff, tmp[:4])
+			if err != nil {
+				return nil, err
+			}
+			nc := int32(le.Uint32(tmp[:4]))
+			if bid == pseudoBin && nc != 2 {
+				return nil, fmt.Errorf("bam: invalid pseudo-bin with %d chunks in index", nc)
+			}
+			if nc < 0 {
+				return nil, fmt.Errorf("bam: invalid bin %d with %d chunks in index", bid, nc)
+			}
 			b := make([]Chunk, nc)
 			err = binary.Read(ff, le, &b)
 			if err != nil {
 				return nil, err
 			}
-			if bid == 37450 {
+			if bid == pseudoBin {
 				// Unmapped reads are held/recorded separately
+				delete(r.BinOffsets, bid)
 				r.Unmapped = b[0]
 				r.TotalMapped = uint64(b[1].Begin)
 				r.TotalUnmapped = uint64(b[1].End)
@@ -105,64 +193,158 @@ func LoadIndex(filename string) (*Index, error) {
 			r.Bins[bid] = b
 		}
 
-		_, err = io.ReadFull(ff, tmp[:4])
-		if err != nil {
-			return nil, err
-		}
-		ni := int32(le.Uint32(tmp[:4]))
-		r.Intervals = make([]Offset, ni)
-		err = binary.Read(ff, le, &r.Intervals)
-		if err != nil {
-			return nil, err
+		if !csi {
+			_, err = io.ReadFull(ff, tmp[:4])
+			if err != nil {
+				return nil, err
+			}
+			ni := int32(le.Uint32(tmp[:4]))
+			r.Intervals = make([]Offset, ni)
+			err = binary.Read(ff, le, &r.Intervals)
+			if err != nil {
+				return nil, err
+			}
 		}
 		f.Refs[i] = r
 	}
 	BAMProgressFunc(-1.0)
-	return f, err
-}
-
-func (r *IndexReference) getBin(beginPos, endPos uint64) uint32 {
-	endPos = (endPos - 1) >> 14
-	beginPos >>= 14
 
-	if beginPos == endPos {
-		return ((1<<15)-1)/7 + uint32(beginPos)
+	// the n_no_coor count is optional
+	_, err = io.ReadFull(ff, tmp)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return f, nil
 	}
-	if (beginPos >> 3) == (endPos >> 3) {
-		return ((1<<12)-1)/7 + uint32(beginPos>>3)
+	if err != nil {
+		return nil, err
 	}
-	if (beginPos >> 6) == (endPos >> 6) {
-		return ((1<<9)-1)/7 + uint32(beginPos>>6)
+	f.Unplaced = le.Uint64(tmp)
+	f.HasUnplaced = true
+	return f, nil
+}
+
+// lastOffset returns the largest virtual offset recorded by the index, at
+// or after which the unplaced reads start. It returns min if the index
+// records nothing past it.
+func (f *Index) lastOffset(min Offset) Offset {
+	last := min
+	for _, r := range f.Refs {
+		if n := len(r.Intervals); n > 0 && r.Intervals[n-1] > last {
+			last = r.Intervals[n-1]
+		}
+		if r.Unmapped.End > last {
+			last = r.Unmapped.End
+		}
+		for _, b := range r.Bins {
+			for _, c := range b {
+				if c.End > last {
+					last = c.End
+				}
+			}
+		}
 	}
-	if (beginPos >> 9) == (endPos >> 9) {
-		return ((1<<6)-1)/7 + uint32(beginPos>>9)
+	return last
+}
+
+// getBins lists the bins that may hold alignments overlapping the region.
+func (r *IndexReference) getBins(beginPos, endPos uint64) []uint32 {
+	minShift, depth := r.minShift, r.depth
+	if minShift == 0 {
+		minShift, depth = 14, 5
 	}
-	if (beginPos >> 12) == (endPos >> 12) {
-		return ((1<<3)-1)/7 + uint32(beginPos>>12)
+	endPos--
+
+	var res []uint32
+	shift := minShift + 3*depth
+	first := uint64(0) // first bin number on the current level
+	for level := uint(0); level <= depth; level++ {
+		for k := first + beginPos>>shift; k <= first+endPos>>shift; k++ {
+			res = append(res, uint32(k))
+		}
+		first += 1 << (3 * level)
+		shift -= 3
 	}
-	return 0
+	return res
 }
 
-func (r *IndexReference) getBins(beginPos, endPos uint64) []uint32 {
-	res := make([]uint32, 1, ((1<<18)-1)/7)
+// getBin returns the smallest bin that holds the whole region.
+func (r *IndexReference) getBin(beginPos, endPos uint64) uint32 {
+	minShift, depth := r.minShift, r.depth
+	if minShift == 0 {
+		minShift, depth = 14, 5
+	}
+	endPos--
 
-	endPos = (endPos - 1) >> 14
-	beginPos >>= 14
+	var bin uint32
+	shift := minShift + 3*depth
+	first := uint64(0)
+	for level := uint(0); level <= depth; level++ {
+		if beginPos>>shift == endPos>>shift {
+			bin = uint32(first + beginPos>>shift)
+		}
+		first += 1 << (3 * level)
+		shift -= 3
+	}
+	return bin
+}
 
-	for k := 1 + beginPos>>12; k <= 1+(endPos>>12); k++ {
-		res = append(res, uint32(k))
+// minOffset returns the virtual offset before which no alignment can
+// overlap a region starting at beginPos.
+func (r *IndexReference) minOffset(beginPos uint64) Offset {
+	if len(r.Intervals) > 0 {
+		if i := int(beginPos >> 14); i < len(r.Intervals) {
+			return r.Intervals[i]
+		}
+		return r.Intervals[len(r.Intervals)-1]
 	}
-	for k := 9 + beginPos>>9; k <= 1+(endPos>>9); k++ {
-		res = append(res, uint32(k))
+	if len(r.BinOffsets) == 0 {
+		return 0
 	}
-	for k := 73 + beginPos>>6; k <= 73+(endPos>>6); k++ {
-		res = append(res, uint32(k))
+
+	// start from the smallest bin holding beginPos and walk up the tree
+	bins := r.getBins(beginPos, beginPos+1)
+	for i := len(bins) - 1; i >= 0; i-- {
+		if o, ok := r.BinOffsets[bins[i]]; ok {
+			return o
+		}
 	}
-	for k := 585 + beginPos>>3; k <= 585+(endPos>>3); k++ {
-		res = append(res, uint32(k))
+	return 0
+}
+
+// chunks returns the sorted, merged list of chunks that may contain
+// alignments overlapping the region.
+func (r *IndexReference) chunks(beginPos, endPos uint64) []Chunk {
+	if endPos <= beginPos {
+		return nil
 	}
-	for k := 4681 + beginPos; k <= 4681+endPos; k++ {
-		res = append(res, uint32(k))
+
+	// nothing before the linear index offset can overlap the region
+	minOffset := r.minOffset(beginPos)
+
+	var res []Chunk
+	for _, bid := range r.getBins(beginPos, endPos) {
+		for _, c := range r.Bins[bid] {
+			if c.End > minOffset {
+				res = append(res, c)
+			}
+		}
 	}
-	return res
+	return mergeChunks(res)
+}
+
+// mergeChunks sorts the chunks and joins those that overlap or touch,
+// so that no part of the file is read twice.
+func mergeChunks(res []Chunk) []Chunk {
+	sort.Slice(res, func(i, j int) bool { return res[i].Begin < res[j].Begin })
+
+	merged := res[:0]
+	for _, c := range res {
+		if n := len(merged); n > 0 && c.Begin <= merged[n-1].End {
+			if c.End > merged[n-1].End {
+				merged[n-1].End = c.End
+			}
+			continue
+		}
+		merged = append(merged, c)
+	}
+	return merged
 }
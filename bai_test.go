@@ -0,0 +1,99 @@
+package bam
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// encodeCSI writes the bins of a BAI index as a CSI index, using the
+// smallest chunk start of each bin as its loffset.
+func encodeCSI(t *testing.T, idx *Index) []byte {
+	le := binary.LittleEndian
+	out := []byte{'C', 'S', 'I', 1}
+	out = le.AppendUint32(out, 14)
+	out = le.AppendUint32(out, 5)
+	out = le.AppendUint32(out, 0)
+	out = le.AppendUint32(out, uint32(len(idx.Refs)))
+	for _, r := range idx.Refs {
+		out = le.AppendUint32(out, uint32(len(r.Bins)))
+		for bid, chunks := range r.Bins {
+			out = le.AppendUint32(out, bid)
+			out = le.AppendUint64(out, uint64(chunks[0].Begin))
+			out = le.AppendUint32(out, uint32(len(chunks)))
+			for _, c := range chunks {
+				out = le.AppendUint64(out, uint64(c.Begin))
+				out = le.AppendUint64(out, uint64(c.End))
+			}
+		}
+	}
+	out = le.AppendUint64(out, idx.Unplaced)
+
+	var buf bytes.Buffer
+	z := gzip.NewWriter(&buf)
+	z.Write(out)
+	if err := z.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadIndex(t *testing.T) {
+	recs := manyTestRecords(4000)
+	recs = append(recs, newTestRecord("unplaced", -1, -1, FlagUnmapped, "*", "ACGT"))
+	filename := writeTestFiles(t, "index", recs, true)
+
+	bai, err := LoadIndex(filename + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bai.Refs) != 2 || bai.MinShift != 14 || bai.Depth != 5 {
+		t.Fatalf("BAI has %d refs, min_shift %d, depth %d", len(bai.Refs), bai.MinShift, bai.Depth)
+	}
+	if got := bai.Refs[0].TotalMapped + bai.Refs[1].TotalMapped; got != 4000 {
+		t.Errorf("BAI counts %d mapped reads, want 4000", got)
+	}
+	if bai.Unplaced != 1 {
+		t.Errorf("BAI counts %d unplaced reads, want 1", bai.Unplaced)
+	}
+
+	// serve the same queries from a CSI index, which has no linear index
+	csi := encodeCSI(t, bai)
+	if err = os.Remove(filename + ".bai"); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filename+".csi", csi, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b := loadTestFile(t, filename, &Options{IndexOnly: true})
+	if b.Index.Refs[0].Intervals != nil || len(b.Index.Refs[0].BinOffsets) == 0 {
+		t.Error("CSI index wasn't read with bin offsets")
+	}
+	for _, r := range fetchRegions {
+		got := names(collect(t, b.Fetch(r.refID, r.begin, r.end)))
+		if want := overlapping(recs, r.refID, r.begin, r.end); !reflect.DeepEqual(got, want) {
+			t.Errorf("CSI Fetch(%d, %d, %d) = %d reads, want %d", r.refID, r.begin, r.end, len(got), len(want))
+		}
+	}
+}
+
+func TestReadIndexInvalidPseudoBin(t *testing.T) {
+	le := binary.LittleEndian
+	idx := []byte{'B', 'A', 'I', 1}
+	idx = le.AppendUint32(idx, 1)     // n_ref
+	idx = le.AppendUint32(idx, 1)     // n_bin
+	idx = le.AppendUint32(idx, 37450) // the pseudo-bin
+	idx = le.AppendUint32(idx, 1)     // with one chunk instead of two
+	idx = le.AppendUint64(idx, 0)
+	idx = le.AppendUint64(idx, 0)
+	idx = le.AppendUint32(idx, 0) // n_intv
+
+	_, err := ReadIndex(bytes.NewReader(idx))
+	if err == nil || !strings.Contains(err.Error(), "invalid pseudo-bin") {
+		t.Errorf("ReadIndex gave %v, want an invalid pseudo-bin error", err)
+	}
+}
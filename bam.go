@@ -1,17 +1,15 @@
 package bam
 
 import (
-	"bufio"
 	"bytes"
-	"compress/gzip"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 )
 
 var (
@@ -21,6 +19,9 @@ var (
 
 	// MaxBAMCachedBlocks is (approximately) how many block to keep in memory.
 	// With default 500MB limit, this value is 8000.
+	//
+	// Deprecated: block caches are limited by MaxBAMMemory bytes. This value
+	// is no longer used or updated.
 	MaxBAMCachedBlocks = MaxBAMMemory / 65536
 
 	// BAMProgressFunc is the default ProgressFunc for the bam package.
@@ -52,96 +53,222 @@ var bgzfEOF = []byte{
 }
 
 // An AlignmentMap represents a sequence alignment/map.
+//
+// Once loaded, an AlignmentMap may be queried from many goroutines at once.
 type AlignmentMap struct {
 	filename string
-	f        *os.File
-	z        *gzip.Reader
+	r        io.ReaderAt
+	closer   io.Closer
+	size     int64
 	partial  bool
 
-	blocks       blockCache
+	blocks    BlockCache
+	allCached bool         // every block is in the cache, so the file isn't needed
+	shared    *SharedCache // blocks is a view of it, released by Close
+
+	advMu        sync.RWMutex
 	blockAdvance map[int64]uint16 // how much to move forward in the compressed file to get the start of the next block
 
+	headerLen   int    // uncompressed size of the header and references
+	firstOffset Offset // virtual offset of the first alignment
+
 	Index *Index
 
 	Header     string
 	References []Reference
 
-	Alignments []*bamAlignment
+	// Aliases are tried by RefID when a name doesn't match exactly.
+	Aliases *Aliases
+
+	refMu  sync.Mutex
+	refIDs map[string]int32 // built on first use by RefID
+
+	Alignments []*Alignment
+}
+
+// Options control how a BAM dataset is loaded.
+type Options struct {
+	// Cache holds uncompressed blocks for queries. If nil, the
+	// SharedBlockCache is used when set (and the file's blocks are
+	// released from it by Close), otherwise a cache limited to
+	// MaxBAMMemory bytes is created for the file.
+	Cache BlockCache
+
+	// IndexOnly reads just the header and the index, never scanning the
+	// alignments, so that even huge files open quickly. All queries are
+	// then served through the index, which must exist.
+	IndexOnly bool
 }
 
 // Load a BAM dataset from the file.
 func Load(filename string) (*AlignmentMap, error) {
+	return LoadWithOptions(filename, nil)
+}
+
+// LoadWithOptions loads a BAM dataset from the file using the given options.
+// A nil opts is the same as calling Load.
+func LoadWithOptions(filename string, opts *Options) (*AlignmentMap, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
 	ff, err := os.Open(filename)
 	if err != nil {
 		return nil, err
 	}
-	f := &AlignmentMap{
-		filename: filename,
-		f:        ff,
-	}
-
-	// recalc just in case mem limit changed
-	MaxBAMCachedBlocks = MaxBAMMemory / 65536
-
-	/////////
-	// check for proper End-of-file marker
-	sz, err := ff.Seek(-int64(len(bgzfEOF)), io.SeekEnd)
+	fi, err := ff.Stat()
 	if err != nil {
+		ff.Close()
 		return nil, err
 	}
-	tmp := make([]byte, len(bgzfEOF))
-	_, err = io.ReadFull(ff, tmp)
+	var shared *SharedCache
+	if o.Cache == nil && SharedBlockCache != nil {
+		id, err := fileIdentity(ff)
+		if err != nil {
+			ff.Close()
+			return nil, err
+		}
+		shared = SharedBlockCache
+		o.Cache = shared.ForFile(id)
+	}
+
+	f, err := open(ff, fi.Size(), &o, o.IndexOnly)
 	if err != nil {
+		ff.Close()
+		if shared != nil {
+			shared.ReleaseFile(o.Cache)
+		}
 		return nil, err
 	}
-	if !bytes.Equal(tmp, bgzfEOF) {
-		return nil, fmt.Errorf("invalid end-of-file marker (possibly truncated?)")
+	f.filename = filename
+	f.shared = shared
+	if f.allCached {
+		ff.Close()
+		f.r = nil
+	} else {
+		f.closer = ff
 	}
-	_, err = ff.Seek(0, io.SeekStart)
+
+	f.Index, err = findIndex(filename)
+	if os.IsNotExist(err) {
+		if o.IndexOnly {
+			f.Close()
+			return nil, fmt.Errorf("bam: no index available for %s", filename)
+		}
+		log.Println("warning: no index available for", filename)
+		err = nil
+	}
+	return f, err
+}
+
+// findIndex loads the first of the usual index file names that exists.
+func findIndex(filename string) (*Index, error) {
+	names := []string{filename + ".bai", filename + ".csi"}
+	if strings.HasSuffix(filename, ".bam") {
+		base := strings.TrimSuffix(filename, ".bam")
+		names = append(names, base+".bai", base+".csi")
+	}
+
+	var err error
+	for _, name := range names {
+		var idx *Index
+		idx, err = LoadIndex(name)
+		if !os.IsNotExist(err) {
+			return idx, err
+		}
+	}
+	return nil, err
+}
+
+// OpenReaderAt opens a BAM dataset of the given size from r, using the
+// given options as with LoadWithOptions. A nil opts uses the defaults.
+//
+// When an index is given, only the header is read up front and queries
+// read just the blocks they need, which suits remote files (see
+// NewHTTPReaderAt). Without an index the whole file is loaded as with Load.
+func OpenReaderAt(r io.ReaderAt, size int64, index io.Reader, opts *Options) (*AlignmentMap, error) {
+	o := Options{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.IndexOnly && index == nil {
+		return nil, fmt.Errorf("bam: no index given for an index-only open")
+	}
+	var shared *SharedCache
+	if o.Cache == nil && SharedBlockCache != nil {
+		shared = SharedBlockCache
+		o.Cache = shared.ForFile(readerIdentity(r, size))
+	}
+
+	f, err := open(r, size, &o, index != nil)
 	if err != nil {
-		ff.Close()
+		if shared != nil {
+			shared.ReleaseFile(o.Cache)
+		}
 		return nil, err
 	}
+	f.shared = shared
+	if f.allCached {
+		f.r = nil
+	}
+	if index != nil {
+		f.Index, err = ReadIndex(index)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// open checks the file and parses the header from r, followed by the
+// alignments unless headerOnly is set or the file is too large.
+func open(r io.ReaderAt, size int64, opts *Options, headerOnly bool) (*AlignmentMap, error) {
+	f := &AlignmentMap{
+		r:       r,
+		size:    size,
+		Aliases: DefaultAliases,
+	}
+
 	/////////
-	bff := bufio.NewReader(ff)
-	f.z, err = gzip.NewReader(bff)
+	// check for proper End-of-file marker
+	sz := size - int64(len(bgzfEOF))
+	if sz < 0 {
+		return nil, fmt.Errorf("invalid end-of-file marker (possibly truncated?)")
+	}
+	tmp := make([]byte, len(bgzfEOF))
+	_, err := r.ReadAt(tmp, sz)
 	if err != nil {
-		ff.Close()
 		return nil, err
 	}
+	if !bytes.Equal(tmp, bgzfEOF) {
+		return nil, fmt.Errorf("invalid end-of-file marker (possibly truncated?)")
+	}
+	/////////
 
 	szpct := float64(sz) / 100.0
 	numBlocks := sz / 65535
-	if numBlocks > MaxBAMCachedBlocks {
-		f.blocks = newLRUCache(int(MaxBAMCachedBlocks))
-		f.partial = true
-	} else {
+	f.partial = headerOnly || numBlocks*65536 > MaxBAMMemory
+	switch {
+	case opts.Cache != nil:
+		f.blocks = opts.Cache
+	case f.partial:
+		f.blocks = newLRUCache(MaxBAMMemory)
+	default:
+		// small enough to keep every block, so the file can be closed
 		f.blocks = newMapCache(int(numBlocks))
+		f.allCached = true
 	}
 	f.blockAdvance = make(map[int64]uint16, numBlocks)
 
 	var remainder []byte
 	completeHeader := false
-	truepos := int64(0)
-	for {
-		f.z.Multistream(false)
-		h := f.z.Header
-		if h.Extra[0] != 'B' || h.Extra[1] != 'C' {
-			panic("not a BAM file (invalid subfield id)")
-		}
-		if 2 != binary.LittleEndian.Uint16(h.Extra[2:]) {
-			panic("not a BAM file (invalid subfield length)")
-		}
-		bsize := binary.LittleEndian.Uint16(h.Extra[4:]) + 1
-		f.blockAdvance[truepos] = bsize
-
-		/// read the data here
-		data, err := ioutil.ReadAll(f.z)
+	for truepos := int64(0); truepos < f.size; {
+		data, bsize, err := readBlock(r, truepos)
 		if err != nil {
-			f.z.Close()
-			ff.Close()
 			return nil, err
 		}
+		f.blockAdvance[truepos] = bsize
 
 		if !f.partial {
 			f.blocks.Set(truepos, data)
@@ -158,8 +285,17 @@ func Load(filename string) (*AlignmentMap, error) {
 
 		if !completeHeader {
 			// parse the header + initial block
+			blockLen := len(data) - len(remainder)
 			remainder, completeHeader = f.parseHead(data[:])
 
+			if completeHeader {
+				// the header always starts at the beginning of data
+				if f.headerLen < len(data) {
+					f.firstOffset = Offset(truepos<<16 | int64(f.headerLen-(len(data)-blockLen)))
+				} else {
+					f.firstOffset = Offset((truepos + int64(bsize)) << 16)
+				}
+			}
 			if f.partial && completeHeader {
 				break
 			}
@@ -167,31 +303,33 @@ func Load(filename string) (*AlignmentMap, error) {
 			remainder = f.parseNext(data)
 		}
 
-		// workaround for go bug #30230
-		truepos += int64(bsize)
-		ff.Seek(truepos, io.SeekStart)
-		bff.Reset(ff)
-
 		// move to the next chunk
-		err = f.z.Reset(bff)
-		if err == io.EOF {
-			break
-		}
+		truepos += int64(bsize)
 	}
 
-	if !f.partial {
-		f.z.Close()
-		ff.Close()
-		f.f = nil
-		f.z = nil
-	}
 	BAMProgressFunc(-1.0)
-	f.Index, err = LoadIndex(filename + ".bai")
-	if os.IsNotExist(err) {
-		log.Println("warning: no index available for", filename)
-		err = nil
+	return f, nil
+}
+
+// Close releases the file opened by Load, and the file's blocks in the
+// SharedBlockCache. It does not close an io.ReaderAt given to OpenReaderAt.
+func (b *AlignmentMap) Close() error {
+	if b.shared != nil {
+		b.shared.ReleaseFile(b.blocks)
+		b.shared = nil
 	}
-	return f, err
+	if b.closer == nil {
+		return nil
+	}
+	err := b.closer.Close()
+	b.closer = nil
+	b.r = nil
+	return err
+}
+
+// CacheStats returns the usage counters of the block cache.
+func (b *AlignmentMap) CacheStats() CacheStats {
+	return b.blocks.Stats()
 }
 
 // Reference sequence name and length.
@@ -236,6 +374,7 @@ func (b *AlignmentMap) parseHead(r []byte) ([]byte, bool) {
 		offs += 8 + nameLength
 	}
 
+	b.headerLen = offs
 	return b.parseNext(r[offs:]), true
 }
 
@@ -256,7 +395,8 @@ func (b *AlignmentMap) parseNext(r []byte) []byte {
 	return r
 }
 
-type bamAlignment struct {
+// An Alignment is a single aligned read record.
+type Alignment struct {
 	refID        int32
 	pos          int32
 	mapq         uint8
@@ -272,12 +412,13 @@ type bamAlignment struct {
 	cigarPacked []uint32
 	seqPacked   []uint8
 	qual        string
+	aux         []byte // raw encoding of AuxData
 
 	AuxData map[string]interface{}
 }
 
-func parseAlignment(r []byte) *bamAlignment {
-	b := &bamAlignment{}
+func parseAlignment(r []byte) *Alignment {
+	b := &Alignment{}
 	le := binary.LittleEndian
 
 	b.refID = int32(le.Uint32(r[0:]))
@@ -298,7 +439,8 @@ func parseAlignment(r []byte) *bamAlignment {
 	bb := bytes.NewBuffer(r[offs:])
 	binary.Read(bb, le, &b.cigarPacked)
 	offs += 4 * int(b.cigarOpCount)
-	b.seqPacked = r[offs : offs+(int(1+b.seqLen)/2)]
+	// copy so that the record doesn't alias (and modify) cached block data
+	b.seqPacked = append([]byte(nil), r[offs:offs+(int(1+b.seqLen)/2)]...)
 	if (b.seqLen % 2) == 1 {
 		// ensure sequence past end is set to 0
 		b.seqPacked[len(b.seqPacked)-1] &= 0xF0
@@ -306,6 +448,7 @@ func parseAlignment(r []byte) *bamAlignment {
 	offs += (int(1+b.seqLen) / 2)
 	b.qual = string(r[offs : offs+int(b.seqLen)])
 	offs += int(b.seqLen)
+	b.aux = append([]byte(nil), r[offs:]...)
 
 	b.AuxData = make(map[string]interface{})
 	for offs < len(r) {
@@ -360,10 +503,10 @@ func parseAlignment(r []byte) *bamAlignment {
 			b.AuxData[tag] = x
 			offs = o + 1
 		case 'B':
-			vtype = r[offs+1]
-			count := le.Uint32(r[offs+2:])
+			vtype = r[offs]
+			count := le.Uint32(r[offs+1:])
 
-			offs += 6
+			offs += 5
 			bb = bytes.NewBuffer(r[offs:])
 
 			var arr interface{}
@@ -390,7 +533,7 @@ func parseAlignment(r []byte) *bamAlignment {
 				arr = make([]float32, count)
 				offs += int(count * 4)
 			}
-			binary.Read(bb, le, &arr)
+			binary.Read(bb, le, arr)
 			b.AuxData[tag] = arr
 
 		default:
@@ -401,165 +544,92 @@ func parseAlignment(r []byte) *bamAlignment {
 	return b
 }
 
-func (b *AlignmentMap) loadBlock(bid int64, atoffset uint16) []byte {
-	_, err := b.f.Seek(bid, io.SeekStart)
-	if err != nil {
-		panic(err)
+// block returns the uncompressed data and compressed size of the block
+// starting at compressed offset bid, loading it into the cache as needed.
+func (b *AlignmentMap) block(bid int64) ([]byte, uint16, error) {
+	if data, ok := b.blocks.Get(bid); ok {
+		b.advMu.RLock()
+		bsize, ok := b.blockAdvance[bid]
+		b.advMu.RUnlock()
+		if ok {
+			return data, bsize, nil
+		}
+	}
+	if bid >= b.size {
+		return nil, 0, io.EOF
+	}
+	if b.r == nil {
+		return nil, 0, fmt.Errorf("bam: block %d is not cached and the file is closed", bid)
 	}
 
-	err = b.z.Reset(b.f)
+	data, bsize, err := readBlock(b.r, bid)
 	if err != nil {
-		panic(err)
+		return nil, 0, err
 	}
-	b.z.Multistream(false)
-	bsize := binary.LittleEndian.Uint16(b.z.Header.Extra[4:]) + 1
+	b.advMu.Lock()
 	b.blockAdvance[bid] = bsize
+	b.advMu.Unlock()
+	b.blocks.Set(bid, data)
+	return data, bsize, nil
+}
 
-	data, err := ioutil.ReadAll(b.z)
-	if err != nil {
-		panic(err)
+// padAlignment places the alignment's sequence within the region, padding
+// with spaces so that every row has the same length.
+func padAlignment(ba *Alignment, beginPos, endPos uint64) string {
+	seq := UnpackSequence(ba.seqPacked)
+	px := int(ba.pos) - int(beginPos)
+	pad := ""
+	if px > 0 {
+		pad = strings.Repeat(" ", px)
+	} else {
+		px = -px
+		if px >= len(seq) {
+			seq = ""
+		} else {
+			seq = seq[px:]
+		}
 	}
-
-	if !b.partial {
-		b.blocks.Set(bid, data)
+	seq = pad + seq
+	epad := int(endPos - beginPos)
+	if len(seq) > epad {
+		seq = seq[:epad]
+	} else {
+		seq = seq + strings.Repeat(" ", epad-len(seq))
 	}
+	return seq
+}
 
-	return data[atoffset:]
+// GetMap returns an alignment of the region.
+func (b *AlignmentMap) GetMap(refID int32, beginPos, endPos uint64) []string {
+	return b.getMap(refID, beginPos, endPos, nil)
 }
 
-func (b *AlignmentMap) noindexGetMap(refID int32, beginPos, endPos uint64) []string {
+// getMap returns the rows of GetMap for the reads accepted by keep, or for
+// every read when keep is nil.
+func (b *AlignmentMap) getMap(refID int32, beginPos, endPos uint64, keep func(*Alignment) bool) []string {
 	var result []string
 	ref := b.References[refID]
 	if beginPos > uint64(ref.Length) || endPos > uint64(ref.Length) {
 		panic("invalid range")
 	}
-	if b.partial {
+	if b.Index == nil && b.partial {
 		panic("bam file is too large - please index it")
 	}
-	///
 
-	for _, ba := range b.Alignments {
-		if ba.refID != refID {
-			continue
+	lastChunk := -1
+	it := b.mapFetch(refID, beginPos, endPos)
+	for it.Next() {
+		if it.ci != lastChunk && len(it.chunks) > 0 {
+			lastChunk = it.ci
+			BAMProgressFunc(float64(100*it.ci) / float64(len(it.chunks)))
 		}
-		// alignment is actually in range?
-		if ba.pos+ba.tlen >= int32(beginPos) &&
-			ba.pos <= int32(endPos) {
-
-			seq := UnpackSequence(ba.seqPacked)
-			px := int(ba.pos) - int(beginPos)
-			pad := ""
-			if px > 0 {
-				pad = strings.Repeat(" ", px)
-			} else {
-				px = -px
-				if px >= len(seq) {
-					seq = ""
-				} else {
-					seq = seq[px:]
-				}
-			}
-			seq = pad + seq
-			epad := int(endPos - beginPos)
-			if len(seq) > epad {
-				seq = seq[:epad]
-			} else {
-				seq = seq + strings.Repeat(" ", epad-len(seq))
-			}
-			result = append(result, seq)
+		if keep != nil && !keep(it.Record()) {
+			continue
 		}
+		result = append(result, padAlignment(it.Record(), beginPos, endPos))
 	}
-
-	return result
-}
-
-// GetMap returns an alignment of the region.
-func (b *AlignmentMap) GetMap(refID int32, beginPos, endPos uint64) []string {
-	var result []string
-	ref := b.References[refID]
-	if beginPos > uint64(ref.Length) || endPos > uint64(ref.Length) {
-		panic("invalid range")
-	}
-	if b.Index == nil {
-		return b.noindexGetMap(refID, beginPos, endPos)
-	}
-	iref := b.Index.Refs[refID]
-	bid := iref.getBin(beginPos, endPos)
-	bin := iref.Bins[bid]
-
-	bpsum := 0.0
-	bpct := 100.0 / float64(len(bin))
-	for _, chunk := range bin {
-		p1 := chunk.Begin.Compressed()
-		po := chunk.Begin.Uncompressed()
-		p2 := chunk.End.Compressed()
-		bpsum += bpct
-		BAMProgressFunc(bpsum)
-
-		done := false
-		var remainder []byte
-		for pi := p1; pi <= p2; {
-			r, ok := b.blocks.Get(pi)
-			if !ok {
-				r = b.loadBlock(pi, po)
-			} else {
-				r = r[po:]
-			}
-			pi += int64(b.blockAdvance[pi])
-			if len(remainder) > 0 {
-				newchunk := make([]byte, len(remainder), len(r)+len(remainder))
-				copy(newchunk, remainder)
-				newchunk = append(newchunk, r...)
-				r = newchunk
-			}
-			le := binary.LittleEndian
-
-			for len(r) >= 4 {
-				blocksize := int(le.Uint32(r))
-				if len(r) < (blocksize + 4) {
-					break
-				}
-				ba := parseAlignment(r[4 : 4+blocksize])
-				if ba.refID != refID {
-					done = true
-					break
-				}
-
-				// alignment is actually in range?
-				if ba.pos+ba.tlen >= int32(beginPos) &&
-					ba.pos <= int32(endPos) {
-
-					seq := UnpackSequence(ba.seqPacked)
-					px := int(ba.pos) - int(beginPos)
-					pad := ""
-					if px > 0 {
-						pad = strings.Repeat(" ", px)
-					} else {
-						px = -px
-						if px >= len(seq) {
-							seq = ""
-						} else {
-							seq = seq[px:]
-						}
-					}
-					seq = pad + seq
-					epad := int(endPos - beginPos)
-					if len(seq) > epad {
-						seq = seq[:epad]
-					} else {
-						seq = seq + strings.Repeat(" ", epad-len(seq))
-					}
-					result = append(result, seq)
-				}
-				r = r[4+blocksize:]
-			}
-			remainder = r
-			if done {
-				// done with this chunk
-				break
-			}
-			po = 0
-		}
+	if err := it.Err(); err != nil {
+		panic(err)
 	}
 	BAMProgressFunc(-1.0)
 	return result
@@ -0,0 +1,26 @@
+package bam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAuxArrays(t *testing.T) {
+	a := newTestRecord("r", 0, 0, 0, "1M", "A")
+	want := map[string]interface{}{
+		"XC": []int8{1, -2, 3},
+		"XS": []uint16{1, 65535},
+		"XI": []int32{-70000},
+		"XF": []float32{0.5, 2},
+		"XZ": "after the arrays",
+	}
+	for _, tag := range []string{"XC", "XS", "XI", "XF", "XZ"} {
+		if err := a.SetAux(tag, want[tag]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, recs := readTestBAM(t, writeTestBAM(t, testHeader(testRefs), testRefs, []*Alignment{a}))
+	if got := recs[0].AuxData; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,193 @@
+package bam
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Normalization scales the values of a coverage track.
+type Normalization int
+
+const (
+	// NormalizeNone reports raw depths or read counts.
+	NormalizeNone Normalization = iota
+
+	// NormalizeCPM reports counts per million mapped reads.
+	NormalizeCPM
+
+	// NormalizeRPKM reports reads per kilobase per million mapped reads.
+	NormalizeRPKM
+)
+
+// bedGraphWindow is the span of depth computed at once when writing
+// per-base runs, which bounds the memory used on long references.
+const bedGraphWindow = 1 << 20
+
+// BedGraphOptions control the output of WriteBedGraph.
+type BedGraphOptions struct {
+	// Filter selects the reads counted. Nil uses DefaultDepthOptions.
+	Filter *PileupOptions
+
+	// BinSize, when non-zero, reports the number of reads starting in
+	// each fixed-width window instead of runs of equal per-base depth.
+	BinSize int
+
+	// Normalize scales the reported values by the number of mapped reads.
+	Normalize Normalization
+
+	// IncludeZero also writes the intervals with no coverage.
+	IncludeZero bool
+}
+
+// WriteBedGraph writes a bedGraph coverage track of every reference to w.
+// By default each line is a run of positions with the same depth, like
+// bedtools genomecov -bg.
+func (b *AlignmentMap) WriteBedGraph(w io.Writer, opts *BedGraphOptions) error {
+	var o BedGraphOptions
+	if opts != nil {
+		o = *opts
+	}
+	filter := DefaultDepthOptions
+	if o.Filter != nil {
+		filter = *o.Filter
+	}
+
+	scale := 1.0
+	if o.Normalize != NormalizeNone {
+		n, err := b.countReads(&filter)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			scale = 1e6 / float64(n)
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	g := &bedGraph{w: bw, o: &o, scale: scale}
+	for i, ref := range b.References {
+		g.name = ref.Name
+		var err error
+		if o.BinSize > 0 {
+			err = b.writeBins(g, int32(i), &filter)
+		} else {
+			err = b.writeRuns(g, int32(i), &filter)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if g.err != nil {
+		return g.err
+	}
+	return bw.Flush()
+}
+
+// countReads counts the placed reads that pass the filter.
+func (b *AlignmentMap) countReads(filter *PileupOptions) (int, error) {
+	n := 0
+	for i, ref := range b.References {
+		it := b.Fetch(int32(i), 0, uint64(ref.Length))
+		for it.Next() {
+			if filter.Accepts(it.Record()) {
+				n++
+			}
+		}
+		if err := it.Err(); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// writeRuns writes the per-base depth of a reference as runs of equal value.
+func (b *AlignmentMap) writeRuns(g *bedGraph, refID int32, filter *PileupOptions) error {
+	length := uint64(b.References[refID].Length)
+	start, cur := uint64(0), uint32(0)
+	for begin := uint64(0); begin < length; begin += bedGraphWindow {
+		end := begin + bedGraphWindow
+		if end > length {
+			end = length
+		}
+		c, err := b.Depth(Region{RefID: refID, Begin: begin, End: end}, filter)
+		if err != nil {
+			return err
+		}
+		for i, d := range c.Depth {
+			pos := begin + uint64(i)
+			if d != cur {
+				g.line(start, pos, float64(cur), 1)
+				start, cur = pos, d
+			}
+		}
+	}
+	g.line(start, length, float64(cur), 1)
+	return nil
+}
+
+// writeBins writes the number of reads starting in each bin of a reference.
+func (b *AlignmentMap) writeBins(g *bedGraph, refID int32, filter *PileupOptions) error {
+	length := uint64(b.References[refID].Length)
+	size := uint64(g.o.BinSize)
+	counts := make([]uint32, (length+size-1)/size)
+
+	it := b.Fetch(refID, 0, length)
+	for it.Next() {
+		a := it.Record()
+		if a.pos >= 0 && uint64(a.pos) < length && filter.Accepts(a) {
+			counts[uint64(a.pos)/size]++
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+
+	for i, n := range counts {
+		begin := uint64(i) * size
+		end := begin + size
+		if end > length {
+			end = length
+		}
+		g.line(begin, end, float64(n), end-begin)
+	}
+	return nil
+}
+
+type bedGraph struct {
+	w     *bufio.Writer
+	o     *BedGraphOptions
+	name  string
+	scale float64
+	buf   []byte
+	err   error
+}
+
+// line writes one interval. Width is the span the value was counted
+// over, used by RPKM.
+func (g *bedGraph) line(begin, end uint64, value float64, width uint64) {
+	if begin >= end || (value == 0 && !g.o.IncludeZero) || g.err != nil {
+		return
+	}
+	b := append(g.buf[:0], g.name...)
+	b = append(b, '\t')
+	b = strconv.AppendUint(b, begin, 10)
+	b = append(b, '\t')
+	b = strconv.AppendUint(b, end, 10)
+	b = append(b, '\t')
+	switch g.o.Normalize {
+	case NormalizeNone:
+		b = strconv.AppendFloat(b, value, 'f', -1, 64)
+	case NormalizeCPM:
+		b = strconv.AppendFloat(b, value*g.scale, 'g', 6, 64)
+	case NormalizeRPKM:
+		b = strconv.AppendFloat(b, value*g.scale*1000/float64(width), 'g', 6, 64)
+	default:
+		g.err = fmt.Errorf("bam: unknown normalization %d", g.o.Normalize)
+		return
+	}
+	b = append(b, '\n')
+	g.buf = b
+	_, g.err = g.w.Write(b)
+}
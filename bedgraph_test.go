@@ -0,0 +1,60 @@
+package bam
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteBedGraph(t *testing.T) {
+	recs := []*Alignment{
+		newTestRecord("a", 0, 100, 0, "10M", "ACGTACGTAC"),
+		newTestRecord("b", 0, 105, 0, "5M3D5M", "ACGTACGTAC"), // no depth over the deletion
+		newTestRecord("c", 1, 2500, FlagDuplicate, "10M", "ACGTACGTAC"),
+		newTestRecord("d", 1, 2999, 0, "2M", "AC"),
+	}
+	filename := writeTestFiles(t, "bedgraph", recs, true)
+	b := loadTestFile(t, filename, nil)
+
+	tests := []struct {
+		opts BedGraphOptions
+		want string
+	}{
+		{BedGraphOptions{}, `
+chr1	100	105	1
+chr1	105	110	2
+chr1	113	118	1
+chr2	2999	3001	1
+`},
+		{BedGraphOptions{Normalize: NormalizeCPM}, `
+chr1	100	105	333333
+chr1	105	110	666667
+chr1	113	118	333333
+chr2	2999	3001	333333
+`},
+		{BedGraphOptions{BinSize: 1000}, `
+chr1	0	1000	2
+chr2	2000	3000	1
+`},
+		{BedGraphOptions{BinSize: 1000, Normalize: NormalizeRPKM}, `
+chr1	0	1000	666667
+chr2	2000	3000	333333
+`},
+		{BedGraphOptions{BinSize: 400000, IncludeZero: true}, `
+chr1	0	400000	2
+chr1	400000	800000	0
+chr1	800000	1000000	0
+chr2	0	400000	1
+chr2	400000	500000	0
+`},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := b.WriteBedGraph(&buf, &tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		if want := strings.TrimPrefix(tc.want, "\n"); buf.String() != want {
+			t.Errorf("WriteBedGraph(%+v) wrote\n%s\nwant\n%s", tc.opts, buf.String(), want)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package bam
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+// bgzfHeaderSize is the size of a BGZF block header with the
+// standard 6-byte extra field.
+const bgzfHeaderSize = 18
+
+// flateReaders pools decompressors so that concurrent queries don't
+// each allocate a new one per block.
+var flateReaders = sync.Pool{
+	New: func() interface{} {
+		return flate.NewReader(bytes.NewReader(nil))
+	},
+}
+
+// maxBlockSize is the largest BGZF block, compressed or not.
+const maxBlockSize = 1 << 16
+
+// ReadBGZFBlock inflates the BGZF block starting at compressed offset off
+// of r. It returns the uncompressed data and the compressed size of the
+// block, after checking the data against the CRC32 and ISIZE of the block.
+//
+// Only ReadAt is used, so it is safe to call from many goroutines on the
+// same io.ReaderAt.
+func ReadBGZFBlock(r io.ReaderAt, off int64) ([]byte, int, error) {
+	data, bsize, err := readBlock(r, off)
+	return data, int(bsize), err
+}
+
+// readBlock is ReadBGZFBlock with the block size as stored in the file.
+func readBlock(r io.ReaderAt, off int64) ([]byte, uint16, error) {
+	le := binary.LittleEndian
+
+	var head [bgzfHeaderSize]byte
+	n, err := r.ReadAt(head[:], off)
+	if n < len(head) {
+		if err == nil || (err == io.EOF && n > 0) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	if head[0] != 0x1f || head[1] != 0x8b || head[2] != 8 || head[3]&4 == 0 {
+		return nil, 0, fmt.Errorf("bam: invalid BGZF block header at offset %d", off)
+	}
+	xlen := int(le.Uint16(head[10:]))
+	if xlen != 6 || head[12] != 'B' || head[13] != 'C' {
+		return nil, 0, fmt.Errorf("bam: not a BAM file (invalid subfield id)")
+	}
+	if 2 != le.Uint16(head[14:]) {
+		return nil, 0, fmt.Errorf("bam: not a BAM file (invalid subfield length)")
+	}
+	bsize := le.Uint16(head[16:]) + 1
+
+	block := make([]byte, int(bsize))
+	n, err = r.ReadAt(block, off)
+	if n < len(block) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, 0, err
+	}
+	tail := block[len(block)-8:]
+	sum := le.Uint32(tail)
+	isize := le.Uint32(tail[4:])
+
+	if isize > maxBlockSize {
+		return nil, 0, fmt.Errorf("bam: invalid size %d of block at offset %d", isize, off)
+	}
+
+	data := make([]byte, int(isize))
+	fr := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(fr)
+	fr.(flate.Resetter).Reset(bytes.NewReader(block[bgzfHeaderSize:len(block)-8]), nil)
+	if _, err = io.ReadFull(fr, data); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("bam: block at offset %d is shorter than its size %d", off, isize)
+		}
+		return nil, 0, err
+	}
+	var extra [1]byte
+	if n, _ := fr.Read(extra[:]); n > 0 {
+		return nil, 0, fmt.Errorf("bam: block at offset %d is longer than its size %d", off, isize)
+	}
+	if crc32.ChecksumIEEE(data) != sum {
+		return nil, 0, fmt.Errorf("bam: checksum mismatch in block at offset %d", off)
+	}
+	return data, bsize, nil
+}
@@ -0,0 +1,55 @@
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+// testBlock compresses data into a single BGZF block.
+func testBlock(t *testing.T, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := newBlockWriter(&buf, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.write(data)
+	w.flush()
+	if w.err != nil {
+		t.Fatal(w.err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadBGZFBlock(t *testing.T) {
+	data := []byte(strings.Repeat("ACGT", 1000))
+	block := testBlock(t, data)
+
+	got, bsize, err := ReadBGZFBlock(bytes.NewReader(block), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) || bsize != len(block) {
+		t.Errorf("read %d bytes from a %d byte block, want %d from %d", len(got), bsize, len(data), len(block))
+	}
+
+	le := binary.LittleEndian
+	corrupt := map[string]func(b []byte){
+		"crc":        func(b []byte) { b[len(b)-8] ^= 0xff },
+		"short size": func(b []byte) { le.PutUint32(b[len(b)-4:], uint32(len(data)+1)) },
+		"long size":  func(b []byte) { le.PutUint32(b[len(b)-4:], uint32(len(data)-1)) },
+		"huge size":  func(b []byte) { le.PutUint32(b[len(b)-4:], 1<<30) },
+		"magic":      func(b []byte) { b[0] = 0 },
+	}
+	for name, f := range corrupt {
+		b := append([]byte(nil), block...)
+		f(b)
+		if _, _, err = ReadBGZFBlock(bytes.NewReader(b), 0); err == nil {
+			t.Errorf("block with a bad %s was accepted", name)
+		}
+	}
+	if _, _, err = ReadBGZFBlock(bytes.NewReader(block[:len(block)-3]), 0); err == nil {
+		t.Error("truncated block was accepted")
+	}
+}
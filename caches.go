@@ -1,105 +1,229 @@
 package bam
 
-import "container/list"
-
-type blockCache interface {
+import (
+	"container/list"
+	"sync"
+)
+
+// A BlockCache stores uncompressed BGZF blocks keyed by their offset in
+// the compressed file. Implementations must be safe for concurrent use.
+//
+// Keys are only unique within a single file, so an implementation that is
+// shared between files must tell them apart itself.
+type BlockCache interface {
 	Get(key int64) ([]byte, bool)
 	Set(key int64, value []byte)
+
+	// Stats returns the current usage counters of the cache.
+	Stats() CacheStats
+}
+
+// CacheStats reports the usage of a BlockCache.
+type CacheStats struct {
+	// Hits and Misses count the Get calls that did/didn't find a block.
+	Hits   uint64
+	Misses uint64
+
+	// Evictions counts the blocks dropped to stay within the byte budget.
+	Evictions uint64
+
+	// Bytes is the total size of the blocks currently held.
+	Bytes int64
 }
 
 ////
 // uses maps for storing small data sets
 
-type mapCache map[int64][]byte
+type mapCache struct {
+	mu    sync.RWMutex
+	data  map[int64][]byte
+	stats CacheStats
+}
 
-func newMapCache(n int) blockCache {
-	return mapCache(make(map[int64][]byte, n))
+func newMapCache(n int) BlockCache {
+	return &mapCache{data: make(map[int64][]byte, n)}
 }
 
-func (x mapCache) Get(key int64) ([]byte, bool) {
-	r, b := x[key]
+func (x *mapCache) Get(key int64) ([]byte, bool) {
+	x.mu.Lock()
+	r, b := x.data[key]
+	if b {
+		x.stats.Hits++
+	} else {
+		x.stats.Misses++
+	}
+	x.mu.Unlock()
 	return r, b
 }
 
-func (x mapCache) Set(key int64, value []byte) {
-	x[key] = value
+func (x *mapCache) Set(key int64, value []byte) {
+	x.mu.Lock()
+	x.stats.Bytes += int64(len(value) - len(x.data[key]))
+	x.data[key] = value
+	x.mu.Unlock()
+}
+
+func (x *mapCache) Stats() CacheStats {
+	x.mu.RLock()
+	defer x.mu.RUnlock()
+	return x.stats
 }
 
 ////
 // uses a more advanced cache for storing large data sets
 // S4-LRU described in http://www.cs.cornell.edu/~qhuang/papers/sosp_fbanalysis.pdf
 
+// blockKey identifies a block by its file and compressed offset. Caches
+// holding a single file leave file 0.
+type blockKey struct {
+	file int
+	off  int64
+}
+
 type cacheItem struct {
 	qid   int
-	key   int64
+	key   blockKey
 	value []byte
+	elem  *list.Element // within queues[qid]
 }
 
-type blockLRUCache struct {
-	cap    int
-	data   map[int64]*list.Element
-	queues []*list.List
+// s4lru holds the four queues of an S4-LRU cache. New items enter queue
+// 0 and move up a queue on each hit. A queue over its byte budget moves
+// its least recently used items down a level, and out of the cache from
+// queue 0. It isn't safe for concurrent use, its owner locks it.
+type s4lru struct {
+	cap    int64 // byte budget of each queue
+	queues [4]list.List
+	bytes  [4]int64
+
+	// evicted is called for each item dropped from the cache.
+	evicted func(item *cacheItem)
+
+	// victim, if set, picks the item to move out of a full queue instead
+	// of the least recently used one.
+	victim func(q *list.List) *list.Element
 }
 
-func newLRUCache(capacity int) blockCache {
-	return &blockLRUCache{
-		cap:    (capacity + 3) / 4,
-		data:   make(map[int64]*list.Element),
-		queues: []*list.List{list.New(), list.New(), list.New(), list.New()},
+func (s *s4lru) init(maxBytes int64, evicted func(*cacheItem)) {
+	s.cap = (maxBytes + 3) / 4
+	s.evicted = evicted
+	for i := range s.queues {
+		s.queues[i].Init()
 	}
 }
 
-func (c *blockLRUCache) Get(key int64) ([]byte, bool) {
-	v, ok := c.data[key]
-	if !ok {
-		return nil, false
-	}
-
-	item := v.Value.(*cacheItem)
+// add puts a new item in queue 0.
+func (s *s4lru) add(item *cacheItem) {
+	item.qid = 0
+	s.push(item)
+	s.rebalance(0)
+}
 
+// hit moves an item up a level, or to the front of the top queue.
+func (s *s4lru) hit(item *cacheItem) {
 	if item.qid == 3 {
 		// can't bump up a level
-		c.queues[3].MoveToFront(v)
-		return item.value, true
+		s.queues[3].MoveToFront(item.elem)
+		return
 	}
 
-	if c.queues[item.qid+1].Len() < c.cap {
-		// plenty of room to bump up
-		c.queues[item.qid].Remove(v)
-		item.qid++
-		c.data[key] = c.queues[item.qid].PushFront(item)
-		return item.value, true
+	// bump up a level, then push any overflow back down
+	s.remove(item)
+	item.qid++
+	s.push(item)
+	s.rebalance(item.qid)
+}
+
+// remove takes an item out of its queue.
+func (s *s4lru) remove(item *cacheItem) {
+	s.queues[item.qid].Remove(item.elem)
+	s.bytes[item.qid] -= int64(len(item.value))
+	item.elem = nil
+}
+
+func (s *s4lru) push(item *cacheItem) {
+	item.elem = s.queues[item.qid].PushFront(item)
+	s.bytes[item.qid] += int64(len(item.value))
+}
+
+// rebalance moves items of over-full queues down a level, starting at
+// queue qid. Items falling out of queue 0 are evicted.
+func (s *s4lru) rebalance(qid int) {
+	for q := qid; q >= 0; q-- {
+		for s.bytes[q] > s.cap {
+			e := s.queues[q].Back()
+			if s.victim != nil {
+				e = s.victim(&s.queues[q])
+			}
+			item := e.Value.(*cacheItem)
+			s.remove(item)
+
+			if q == 0 {
+				s.evicted(item)
+				continue
+			}
+			item.qid = q - 1
+			s.push(item)
+		}
 	}
+}
 
-	// full queues, swap items in place
-	w := c.queues[item.qid+1].Back()
-	other := w.Value.(*cacheItem)
+type blockLRUCache struct {
+	// mu guards everything below, Get also reorders the queues.
+	mu    sync.Mutex
+	lru   s4lru
+	data  map[int64]*cacheItem
+	stats CacheStats
+}
 
-	// keep qid on each
-	other.key, item.key = item.key, other.key
-	other.value, item.value = item.value, other.value
+// NewBlockCache creates an S4-LRU BlockCache that holds at most
+// maxBytes of uncompressed block data.
+func NewBlockCache(maxBytes int64) BlockCache {
+	return newLRUCache(maxBytes)
+}
 
-	c.data[item.key] = v
-	c.data[other.key] = w
-	c.queues[item.qid].MoveToFront(v)
-	c.queues[other.qid].MoveToFront(w)
+func newLRUCache(maxBytes int64) *blockLRUCache {
+	c := &blockLRUCache{data: make(map[int64]*cacheItem)}
+	c.lru.init(maxBytes, c.evicted)
+	return c
+}
+
+func (c *blockLRUCache) Get(key int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
-	return other.value, true
+	item, ok := c.data[key]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	c.stats.Hits++
+	c.lru.hit(item)
+	return item.value, true
 }
 
 func (c *blockLRUCache) Set(key int64, value []byte) {
-	if c.queues[0].Len() < c.cap {
-		c.data[key] = c.queues[0].PushFront(&cacheItem{0, key, value})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.data[key]; ok {
+		// another query loaded the same block first
 		return
 	}
+	item := &cacheItem{key: blockKey{off: key}, value: value}
+	c.data[key] = item
+	c.stats.Bytes += int64(len(value))
+	c.lru.add(item)
+}
 
-	// reuse the tail item
-	e := c.queues[0].Back()
-	item := e.Value.(*cacheItem)
+func (c *blockLRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
 
-	delete(c.data, item.key)
-	item.key = key
-	item.value = value
-	c.data[key] = e
-	c.queues[0].MoveToFront(e)
+func (c *blockLRUCache) evicted(item *cacheItem) {
+	delete(c.data, item.key.off)
+	c.stats.Bytes -= int64(len(item.value))
+	c.stats.Evictions++
 }
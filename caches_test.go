@@ -0,0 +1,90 @@
+package bam
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+)
+
+func TestBlockCacheConcurrent(t *testing.T) {
+	caches := map[string]BlockCache{
+		"map": newMapCache(0),
+		"lru": NewBlockCache(64 << 10),
+	}
+	for name, c := range caches {
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < 500; i++ {
+					key := int64((g*7 + i) % 64)
+					if v, ok := c.Get(key); ok {
+						if !bytes.Equal(v, bytes.Repeat([]byte{byte(key)}, 1024)) {
+							t.Errorf("%s: wrong block for key %d", name, key)
+							return
+						}
+						continue
+					}
+					c.Set(key, bytes.Repeat([]byte{byte(key)}, 1024))
+				}
+			}(g)
+		}
+		wg.Wait()
+
+		st := c.Stats()
+		if st.Hits+st.Misses != 8*500 {
+			t.Errorf("%s: %d hits + %d misses, want %d lookups", name, st.Hits, st.Misses, 8*500)
+		}
+	}
+}
+
+func TestBlockCacheBudget(t *testing.T) {
+	c := NewBlockCache(16 << 10)
+	for i := int64(0); i < 64; i++ {
+		c.Set(i, make([]byte, 1024))
+	}
+	st := c.Stats()
+	if st.Bytes > 16<<10 {
+		t.Errorf("cache holds %d bytes, over its 16KB budget", st.Bytes)
+	}
+	if st.Evictions != 64-uint64(st.Bytes/1024) {
+		t.Errorf("%d evictions with %d bytes left, want every dropped block counted", st.Evictions, st.Bytes)
+	}
+
+	// the newest block is still there, the oldest is gone
+	if _, ok := c.Get(63); !ok {
+		t.Error("most recent block was evicted")
+	}
+	if _, ok := c.Get(0); ok {
+		t.Error("oldest block was kept")
+	}
+	if st = c.Stats(); st.Hits != 1 || st.Misses != 1 {
+		t.Errorf("got %d hits and %d misses, want 1 and 1", st.Hits, st.Misses)
+	}
+
+	// a block that was hit survives a stream of new blocks longer than
+	// the first queue
+	for i := int64(100); i < 108; i++ {
+		c.Set(i, make([]byte, 1024))
+	}
+	if _, ok := c.Get(63); !ok {
+		t.Error("frequently used block was evicted by a scan")
+	}
+}
+
+func TestAlignmentMapCacheStats(t *testing.T) {
+	filename := writeTestFiles(t, "stats", manyTestRecords(2000), true)
+	b := loadTestFile(t, filename, &Options{IndexOnly: true})
+
+	collect(t, b.Fetch(0, 0, 2000))
+	first := b.CacheStats()
+	if first.Misses == 0 || first.Bytes == 0 {
+		t.Fatalf("first query loaded no blocks: %+v", first)
+	}
+	collect(t, b.Fetch(0, 0, 2000))
+	second := b.CacheStats()
+	if second.Misses != first.Misses || second.Hits <= first.Hits {
+		t.Errorf("repeated query wasn't served from the cache: %+v then %+v", first, second)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joiningdata/bam"
+)
+
+func bedgraphCmd(args []string) {
+	filter := bam.DefaultDepthOptions
+	opts := bam.BedGraphOptions{Filter: &filter}
+	fs := flag.NewFlagSet("bedgraph", flag.ExitOnError)
+	fs.IntVar(&opts.BinSize, "bin", 0, "count reads in windows of this many bases (default: per-base depth runs)")
+	fs.BoolVar(&opts.IncludeZero, "zero", false, "also output intervals with no coverage")
+	norm := fs.String("norm", "none", "normalization: none, cpm or rpkm")
+	setFilters := filterFlags(fs, &filter)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow bedgraph [options] in.bam > out.bedGraph")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch strings.ToLower(*norm) {
+	case "none":
+		opts.Normalize = bam.NormalizeNone
+	case "cpm":
+		opts.Normalize = bam.NormalizeCPM
+	case "rpkm":
+		opts.Normalize = bam.NormalizeRPKM
+	default:
+		fatal(fmt.Errorf("unknown normalization %q", *norm))
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	setFilters(b)
+	if err = b.WriteBedGraph(os.Stdout, &opts); err != nil {
+		fatal(err)
+	}
+}
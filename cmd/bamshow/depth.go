@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joiningdata/bam"
+)
+
+func depthCmd(args []string) {
+	opts := bam.DefaultDepthOptions
+	fs := flag.NewFlagSet("depth", flag.ExitOnError)
+	region := fs.String("r", "", "region to report, e.g. chr1:100-200 (default: all references)")
+	all := fs.Bool("a", false, "output all positions, including those with zero depth")
+	setFilters := filterFlags(fs, &opts)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow depth [options] in.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	setFilters(b)
+	regions, err := cmdRegions(b, *region)
+	if err != nil {
+		fatal(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, reg := range regions {
+		c, err := b.Depth(reg, &opts)
+		if err != nil {
+			fatal(err)
+		}
+		name := b.References[reg.RefID].Name
+		for i, d := range c.Depth {
+			if d > 0 || *all {
+				fmt.Fprintf(out, "%s\t%d\t%d\n", name, reg.Begin+uint64(i)+1, d)
+			}
+		}
+	}
+}
+
+func coverageCmd(args []string) {
+	opts := bam.DefaultDepthOptions
+	fs := flag.NewFlagSet("coverage", flag.ExitOnError)
+	region := fs.String("r", "", "region to report, e.g. chr1:100-200 (default: all references)")
+	thresholds := fs.String("t", "", "comma-separated depths to also report the percent of bases at or above, e.g. 1,10,30")
+	setFilters := filterFlags(fs, &opts)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow coverage [options] in.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var minDepths []uint32
+	if *thresholds != "" {
+		for _, t := range strings.Split(*thresholds, ",") {
+			n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimSpace(t), "x"), 10, 32)
+			if err != nil {
+				fatal(fmt.Errorf("invalid depth threshold %q", t))
+			}
+			minDepths = append(minDepths, uint32(n))
+		}
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	setFilters(b)
+	regions, err := cmdRegions(b, *region)
+	if err != nil {
+		fatal(err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	fmt.Fprint(out, "#rname\tstartpos\tendpos\tnumreads\tcovbases\tcoverage\tmeandepth\tmeanbaseq\tmeanmapq")
+	if minDepths != nil {
+		fmt.Fprint(out, "\tmediandepth")
+	}
+	for _, n := range minDepths {
+		fmt.Fprintf(out, "\tpct_%dx", n)
+	}
+	fmt.Fprintln(out)
+
+	for _, reg := range regions {
+		c, err := b.Depth(reg, &opts)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Fprintf(out, "%s\t%d\t%d\t%d\t%d\t%.6g\t%.6g\t%.3g\t%.3g",
+			b.References[reg.RefID].Name, reg.Begin+1, reg.End, c.Reads,
+			c.Covered(1), 100*c.Breadth(), c.Mean(), c.MeanBaseQ(), c.MeanMapQ())
+		if minDepths != nil {
+			fmt.Fprintf(out, "\t%g", c.Median())
+		}
+		for _, n := range minDepths {
+			fmt.Fprintf(out, "\t%.4g", 100*c.FractionAtLeast(n))
+		}
+		fmt.Fprintln(out)
+	}
+}
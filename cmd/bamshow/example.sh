@@ -1,3 +1,3 @@
 curl -O http://hgdownload.cse.ucsc.edu/goldenPath/hg19/encodeDCC/wgEncodeUwRepliSeq/wgEncodeUwRepliSeqBg02esG1bAlnRep1.bam
 curl -O http://hgdownload.cse.ucsc.edu/goldenPath/hg19/encodeDCC/wgEncodeUwRepliSeq/wgEncodeUwRepliSeqBg02esG1bAlnRep1.bam.bai
-./bamshow -r chr1 -s 1112420 -e 1112478 wgEncodeUwRepliSeqBg02esG1bAlnRep1.bam
+./bamshow -r chr1:1,112,421-1,112,478 wgEncodeUwRepliSeqBg02esG1bAlnRep1.bam
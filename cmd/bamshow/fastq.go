@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/joiningdata/bam"
+)
+
+func fastqCmd(args []string) {
+	var opts bam.FASTQOptions
+	fs := flag.NewFlagSet("fastq", flag.ExitOnError)
+	r1 := fs.String("1", "", "write the first reads of pairs to this file")
+	r2 := fs.String("2", "", "write the second reads of pairs to this file")
+	single := fs.String("s", "", "write reads whose mate is missing to this file")
+	unpaired := fs.String("0", "", "write unpaired reads to this file")
+	fs.BoolVar(&opts.Gzip, "z", false, "gzip the output")
+	fs.BoolVar(&opts.OriginalQualities, "oq", false, "use the original qualities of the OQ tag when present")
+	fs.BoolVar(&opts.ReadNumbers, "N", false, "add /1 and /2 to the names of paired reads")
+	tags := fs.String("T", "", "comma separated tags to copy into the header lines, e.g. RG,BC")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow fastq [options] in.bam")
+		fmt.Fprintln(os.Stderr, "Without any output files, all reads are written to stdout, interleaved.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *tags != "" {
+		opts.Tags = strings.Split(*tags, ",")
+	}
+
+	var files []*os.File
+	create := func(name string) io.Writer {
+		if name == "" {
+			return nil
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			fatal(err)
+		}
+		files = append(files, f)
+		return f
+	}
+	opts.R1, opts.R2 = create(*r1), create(*r2)
+	opts.Singleton, opts.Unpaired = create(*single), create(*unpaired)
+	if len(files) == 0 {
+		opts.R1, opts.R2, opts.Singleton, opts.Unpaired = os.Stdout, os.Stdout, os.Stdout, os.Stdout
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	n, err := b.ToFASTQ(&opts)
+	if err != nil {
+		fatal(err)
+	}
+	for _, f := range files {
+		if err = f.Close(); err != nil {
+			fatal(err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s pairs, %s singletons, %s unpaired reads\n",
+		commas(n.Pairs), commas(n.Singleton), commas(n.Unpaired))
+}
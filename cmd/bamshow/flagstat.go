@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joiningdata/bam"
+)
+
+func flagstatCmd(args []string) {
+	fs := flag.NewFlagSet("flagstat", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "output JSON instead of text")
+	expr := exprFlag(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow flagstat [-json] in.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	s := &bam.FlagStat{}
+	filter := compileExpr(*expr, b)
+	it := b.All()
+	for it.Next() {
+		if filter == nil || filter.Match(it.Record()) {
+			s.Add(it.Record())
+		}
+	}
+	if err = it.Err(); err != nil {
+		fatal(err)
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err = enc.Encode(s); err != nil {
+			fatal(err)
+		}
+		return
+	}
+	fmt.Print(s)
+}
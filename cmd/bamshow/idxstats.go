@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+)
+
+func idxstatsCmd(args []string) {
+	fs := flag.NewFlagSet("idxstats", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow idxstats in.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := openBAM(fs.Arg(0), true)
+	if err != nil {
+		fatal(err)
+	}
+	stats, err := b.IdxStats()
+	if err != nil {
+		fatal(err)
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, s := range stats {
+		fmt.Fprintf(out, "%s\t%d\t%d\t%d\n", s.Name, s.Length, s.Mapped, s.Unmapped)
+	}
+}
@@ -5,10 +5,10 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"strconv"
 	"strings"
 
 	"github.com/joiningdata/bam"
+	"github.com/joiningdata/bam/fasta"
 )
 
 type Alphabet struct {
@@ -57,13 +57,20 @@ func GetConsensus(alignment []string, alphabet *Alphabet) string {
 	return string(cons)
 }
 
+// GetDiff compares an aligned row with the reference, showing '=' where
+// they match. Where the reference is shorter than the row, such as at the
+// end of a contig, it is compared as 'N'.
 func GetDiff(ref, aligned string) string {
-	diff := make([]byte, len(ref))
-	for i, c := range []byte(ref) {
+	diff := make([]byte, len(aligned))
+	for i := range diff {
 		if aligned[i] == ' ' {
 			diff[i] = ' '
 			continue
 		}
+		c := byte('N')
+		if i < len(ref) {
+			c = ref[i]
+		}
 		if c == aligned[i] {
 			diff[i] = '='
 		} else {
@@ -73,6 +80,49 @@ func GetDiff(ref, aligned string) string {
 	return string(diff)
 }
 
+// iupacCodes are indexed by a bitmask of A=1, C=2, G=4, T=8.
+const iupacCodes = " ACMGRSVTWYHKDBN"
+
+// GetIUPACConsensus returns a consensus that uses IUPAC ambiguity codes
+// wherever more than one base is seen in at least minFrac of the rows
+// covering a column.
+func GetIUPACConsensus(alignment []string, minFrac float64) string {
+	bits := map[byte]int{'A': 1, 'C': 2, 'G': 4, 'T': 8}
+	cons := make([]byte, len(alignment[0]))
+	counts := make([]int, 16)
+	for i := range cons {
+		for j := range counts {
+			counts[j] = 0
+		}
+		depth := 0
+		for _, row := range alignment {
+			if b, ok := bits[row[i]]; ok {
+				counts[b]++
+				depth++
+			}
+		}
+		mask := 0
+		for _, b := range bits {
+			if depth > 0 && float64(counts[b]) >= minFrac*float64(depth) {
+				mask |= b
+			}
+		}
+		cons[i] = iupacCodes[mask]
+	}
+	return string(cons)
+}
+
+// CountMismatches counts the differing bases in a row from GetDiff.
+func CountMismatches(diff string) int {
+	n := 0
+	for _, c := range []byte(diff) {
+		if c != ' ' && c != '=' {
+			n++
+		}
+	}
+	return n
+}
+
 func commas(n int) string {
 	s := fmt.Sprint(n)
 	r := len(s) % 3
@@ -86,62 +136,82 @@ func commas(n int) string {
 	return strings.Join(cs, ",")
 }
 
+// commands are run instead of the default alignment view when named
+// as the first argument.
+var commands = map[string]func(args []string){
+	"bedgraph": bedgraphCmd,
+	"coverage": coverageCmd,
+	"depth":    depthCmd,
+	"fastq":    fastqCmd,
+	"flagstat": flagstatCmd,
+	"idxstats": idxstatsCmd,
+	"markdup":  markdupCmd,
+	"merge":    mergeCmd,
+	"pileup":   pileupCmd,
+	"reheader": reheaderCmd,
+	"sample":   sampleCmd,
+	"repliseq": repliseqCmd,
+	"sort":     sortCmd,
+	"split":    splitCmd,
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, err.Error())
+	os.Exit(1)
+}
+
+// openBAM loads a local file or opens a remote http(s) URL.
+func openBAM(name string, lazy bool) (*bam.AlignmentMap, error) {
+	if strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://") {
+		return bam.OpenURL(name, nil)
+	}
+	return bam.LoadWithOptions(name, &bam.Options{IndexOnly: lazy})
+}
+
 func main() {
+	bam.BAMProgressFunc = bam.StderrProgressFunc
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
 	maxmem := flag.String("m", "500M", "maximum memory size to use")
 	listRefs := flag.Bool("l", false, "list reference sequence info")
 	listBins := flag.Bool("lb", false, "list bin details for each reference sequence")
-	refName := flag.String("r", "", "query named reference only")
-	startPos := flag.Int64("s", 0, "start position for alignment map (0-based)")
-	endPos := flag.Int64("e", -1, "end position for alignment map (0-based)")
+	lazy := flag.Bool("lazy", false, "only read the header and index (for huge files)")
+	refFile := flag.String("f", "", "reference FASTA file to diff against (instead of the consensus)")
+	iupacFrac := flag.Float64("iupac", 0.2, "minimum fraction of reads for a base to be part of the IUPAC consensus")
+	region := flag.String("r", "", "query region only, e.g. chr1 or chr1:1,112,421-1,112,478")
+	startPos := flag.Int64("s", -1, "start position for alignment map (0-based, overrides -r)")
+	endPos := flag.Int64("end", -1, "end position for alignment map (0-based, overrides -r)")
+	expr := flag.String("e", "", "only show reads matching this filter expression,\ne.g. 'mapq >= 30 && !flag.duplicate && [NM] <= 3'")
 	flag.Parse()
 
-	*maxmem = strings.ToUpper(*maxmem)
-	*maxmem = strings.TrimSuffix(*maxmem, "B")
-	if *maxmem != "500M" {
-		lc := (*maxmem)[len(*maxmem)-1]
-		var mult int64
-		switch lc {
-		case 'K':
-			mult = 1024
-		case 'M':
-			mult = 1024 * 1024
-		case 'G':
-			mult = 1024 * 1024 * 1024
-		case 'T':
-			mult = 1024 * 1024 * 1024 * 1024
-		default:
-			mult = 1
-		}
-		if mult > 1 {
-			*maxmem = (*maxmem)[:len(*maxmem)-1]
-		}
-		num, err := strconv.ParseInt(*maxmem, 10, 64)
-		if err != nil {
-			log.Println(err)
-		} else {
-			bam.MaxBAMMemory = num * mult
-		}
+	var err error
+	if bam.MaxBAMMemory, err = parseSize(*maxmem); err != nil {
+		fatal(err)
 	}
 
-	bam.BAMProgressFunc = bam.StderrProgressFunc
-	b, err := bam.Load(flag.Arg(0))
+	b, err := openBAM(flag.Arg(0), *lazy)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err.Error())
-		os.Exit(1)
+		fatal(err)
 	}
 
 	refID := -1
-	if *refName != "" {
-		for i, r := range b.References {
-			if *refName == r.Name {
-				refID = i
-
-				if *endPos < 0 {
-					*endPos = int64(r.Length)
-				}
-
-				break
-			}
+	var reg bam.Region
+	if *region != "" {
+		reg, err = b.ParseRegion(*region)
+		if err != nil {
+			fatal(err)
+		}
+		refID = int(reg.RefID)
+		if *startPos >= 0 {
+			reg.Begin = uint64(*startPos)
+		}
+		if *endPos >= 0 {
+			reg.End = uint64(*endPos)
 		}
 	}
 
@@ -173,14 +243,42 @@ func main() {
 	}
 
 	fmt.Fprintf(os.Stderr, "Getting alignment...\n")
-	data := b.GetMap(int32(refID), uint64(*startPos), uint64(*endPos))
+	data := b.GetFilteredMap(reg.RefID, reg.Begin, reg.End, compileExpr(*expr, b))
+	if len(data) == 0 {
+		fmt.Fprintf(os.Stderr, "No alignments in region\n")
+		os.Exit(0)
+	}
 
-	fmt.Fprintf(os.Stderr, "Determining consensus...\n")
-	constr := GetConsensus(data, DNA)
-	fmt.Fprintf(os.Stderr, " Done\n")
+	var refstr string
+	if *refFile != "" {
+		fa, err := fasta.Open(*refFile)
+		if err != nil {
+			fatal(err)
+		}
+		if err = fa.CheckReferences(b.References); err != nil {
+			log.Println("warning:", err)
+		}
+		refstr, err = fa.Fetch(b.References[reg.RefID].Name, int64(reg.Begin), int64(reg.End))
+		if err != nil {
+			fatal(err)
+		}
+		refstr = strings.ToUpper(refstr)
+		if n := len(data[0]); len(refstr) < n {
+			// past the end of the FASTA sequence
+			refstr += strings.Repeat("N", n-len(refstr))
+		}
+		fa.Close()
+	} else {
+		fmt.Fprintf(os.Stderr, "Determining consensus...\n")
+		refstr = GetConsensus(data, DNA)
+		fmt.Fprintf(os.Stderr, " Done\n")
+	}
+	iupac := GetIUPACConsensus(data, *iupacFrac)
 
-	fmt.Println(len(constr), constr)
+	fmt.Println(len(refstr), refstr)
+	fmt.Println("IUPAC", len(iupac), iupac)
 	for _, row := range data {
-		fmt.Println(len(row), GetDiff(constr, row))
+		diff := GetDiff(refstr, row)
+		fmt.Println(len(row), diff, CountMismatches(diff))
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import "testing"
+
+func TestGetDiff(t *testing.T) {
+	tests := []struct{ ref, row, want string }{
+		{"ACGTACGT", "  GTTCG ", "  ==T== "},
+		{"ACG", "ACGTA", "===TA"}, // reference ends before the row
+		{"ACGTA", "AC", "=="},
+	}
+	for _, tc := range tests {
+		got := GetDiff(tc.ref, tc.row)
+		if got != tc.want {
+			t.Errorf("GetDiff(%q, %q) = %q, want %q", tc.ref, tc.row, got, tc.want)
+		}
+	}
+	if n := CountMismatches("  ==T==A"); n != 2 {
+		t.Errorf("CountMismatches = %d, want 2", n)
+	}
+}
+
+func TestGetIUPACConsensus(t *testing.T) {
+	rows := []string{
+		"AAAC ",
+		"AAGC ",
+		"AAGT ",
+		"A  TT",
+		"ACG T",
+	}
+	if got, want := GetIUPACConsensus(rows, 0.3), "AAGYT"; got != want {
+		t.Errorf("GetIUPACConsensus = %q, want %q", got, want)
+	}
+	if got, want := GetConsensus(rows, DNA), "AAGCT"; got != want {
+		t.Errorf("GetConsensus = %q, want %q", got, want)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{
+		"500M": 500 << 20,
+		"2gb":  2 << 30,
+		"64k":  64 << 10,
+		"1000": 1000,
+	}
+	for size, want := range tests {
+		if got, err := parseSize(size); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", size, got, err, want)
+		}
+	}
+	for _, size := range []string{"", "M", "lots", "-1G", "0"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("parseSize(%q) succeeded", size)
+		}
+	}
+}
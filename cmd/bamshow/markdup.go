@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/joiningdata/bam"
+)
+
+func markdupCmd(args []string) {
+	var opts bam.MarkDupOptions
+	fs := flag.NewFlagSet("markdup", flag.ExitOnError)
+	fs.BoolVar(&opts.Remove, "r", false, "remove duplicates instead of flagging them")
+	fs.IntVar(&opts.OpticalDistance, "d", 100, "maximum pixel distance for optical duplicates (0 to not detect them)")
+	metricsFile := fs.String("M", "", "write the duplication metrics to this file instead of stderr")
+	asJSON := fs.Bool("json", false, "write the metrics as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow markdup [options] in.bam out.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+	metrics, err := b.MarkDuplicates(out, &opts)
+	if err != nil {
+		out.Close()
+		os.Remove(fs.Arg(1))
+		fatal(err)
+	}
+	if err = out.Close(); err != nil {
+		fatal(err)
+	}
+
+	var mw io.Writer = os.Stderr
+	if *metricsFile != "" {
+		f, err := os.Create(*metricsFile)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		mw = f
+	}
+	if *asJSON {
+		enc := json.NewEncoder(mw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(metrics)
+	} else {
+		err = bam.WriteDuplicationMetrics(mw, metrics)
+	}
+	if err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joiningdata/bam"
+)
+
+func mergeCmd(args []string) {
+	var opts bam.MergeOptions
+	fs := flag.NewFlagSet("merge", flag.ExitOnError)
+	byName := fs.Bool("n", false, "inputs are sorted by read name instead of coordinate")
+	fs.BoolVar(&opts.TagFromFile, "r", false, "tag each read with an RG named after its input file")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow merge [options] out.bam in1.bam in2.bam ...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *byName {
+		opts.Order = bam.SortQueryName
+	}
+
+	var inputs []*bam.AlignmentMap
+	for _, name := range fs.Args()[1:] {
+		b, err := openBAM(name, false)
+		if err != nil {
+			fatal(err)
+		}
+		defer b.Close()
+		inputs = append(inputs, b)
+	}
+
+	out, err := os.Create(fs.Arg(0))
+	if err != nil {
+		fatal(err)
+	}
+	if err = bam.Merge(inputs, out, &opts); err != nil {
+		out.Close()
+		os.Remove(fs.Arg(0))
+		fatal(err)
+	}
+	if err = out.Close(); err != nil {
+		fatal(err)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joiningdata/bam"
+	"github.com/joiningdata/bam/fasta"
+)
+
+// refWindow is the extra reference fetched past a region, so that the
+// bases of deletions starting near its end can be printed.
+const refWindow = 1000
+
+func pileupCmd(args []string) {
+	opts := bam.DefaultPileupOptions
+	fs := flag.NewFlagSet("pileup", flag.ExitOnError)
+	region := fs.String("r", "", "region to pile up, e.g. chr1:100-200 (default: all references)")
+	refFile := fs.String("f", "", "reference FASTA file")
+	setFilters := filterFlags(fs, &opts)
+	maxDepth := fs.Int("d", opts.MaxDepth, "maximum reads per position (0 for no limit)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow pileup [options] in.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts.MaxDepth = *maxDepth
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	setFilters(b)
+	regions, err := cmdRegions(b, *region)
+	if err != nil {
+		fatal(err)
+	}
+
+	var fa *fasta.Reader
+	if *refFile != "" {
+		fa, err = fasta.Open(*refFile)
+		if err != nil {
+			fatal(err)
+		}
+		defer fa.Close()
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, reg := range regions {
+		name := b.References[reg.RefID].Name
+		ref := ""
+		if fa != nil {
+			ref, err = fa.Fetch(name, int64(reg.Begin), int64(reg.End)+refWindow)
+			if err != nil {
+				fatal(err)
+			}
+			ref = strings.ToUpper(ref)
+		}
+		refBase := func(pos int64) byte {
+			i := pos - int64(reg.Begin)
+			if i < 0 || i >= int64(len(ref)) {
+				return 'N'
+			}
+			return ref[i]
+		}
+
+		pl := b.Pileup(reg, &opts)
+		for pl.Next() {
+			col := pl.Column()
+			rb := refBase(col.Pos)
+			var bases, quals []byte
+			for i := range col.Reads {
+				r := &col.Reads[i]
+				bases = appendMpileupBase(bases, r, rb, col.Pos, refBase)
+				q := r.Qual
+				if r.IsDel || r.IsRefSkip {
+					if qual := r.Alignment.Qual(); r.QPos < len(qual) {
+						q = qual[r.QPos]
+					}
+				}
+				quals = append(quals, q+33)
+			}
+			fmt.Fprintf(out, "%s\t%d\t%c\t%d\t%s\t%s\n", name, col.Pos+1, rb, len(col.Reads), bases, quals)
+		}
+		if err = pl.Err(); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+// appendMpileupBase appends the samtools mpileup encoding of a read at a
+// position to dst.
+func appendMpileupBase(dst []byte, r *bam.PileupRead, rb byte, pos int64, refBase func(int64) byte) []byte {
+	strand := func(c byte) byte {
+		if r.Reverse {
+			return c | 0x20 // lower case
+		}
+		return c &^ 0x20 // upper case
+	}
+
+	if r.IsHead {
+		mapq := r.Alignment.MapQ()
+		if mapq > 93 {
+			mapq = 93
+		}
+		dst = append(dst, '^', mapq+33)
+	}
+	switch {
+	case r.IsDel:
+		// samtools only uses '#' for the reverse strand with --reverse-del
+		dst = append(dst, '*')
+	case r.IsRefSkip:
+		if r.Reverse {
+			dst = append(dst, '<')
+		} else {
+			dst = append(dst, '>')
+		}
+	case rb != 'N' && r.Base == rb:
+		if r.Reverse {
+			dst = append(dst, ',')
+		} else {
+			dst = append(dst, '.')
+		}
+	default:
+		dst = append(dst, strand(r.Base))
+	}
+
+	if r.Indel > 0 {
+		dst = append(dst, '+')
+		dst = append(dst, fmt.Sprint(r.Indel)...)
+		for _, c := range []byte(r.InsertedSequence()) {
+			dst = append(dst, strand(c))
+		}
+	} else if r.Indel < 0 {
+		dst = append(dst, '-')
+		dst = append(dst, fmt.Sprint(-r.Indel)...)
+		for i := 1; i <= -r.Indel; i++ {
+			dst = append(dst, strand(refBase(pos+int64(i))))
+		}
+	}
+	if r.IsTail {
+		dst = append(dst, '$')
+	}
+	return dst
+}
+
+// filterFlags adds the read and base filter flags to fs, defaulting to
+// opts. The returned function copies the parsed values into opts,
+// compiling any filter expression for the file.
+func filterFlags(fs *flag.FlagSet, opts *bam.PileupOptions) func(b *bam.AlignmentMap) {
+	minMapQ := fs.Uint("q", uint(opts.MinMapQ), "skip reads with mapping quality below this")
+	minBaseQ := fs.Uint("Q", uint(opts.MinBaseQ), "skip bases with base quality below this")
+	requireFlags := fs.Uint("rf", uint(opts.RequireFlags), "required flags")
+	excludeFlags := fs.Uint("ff", uint(opts.ExcludeFlags), "filter flags")
+	expr := exprFlag(fs)
+	return func(b *bam.AlignmentMap) {
+		opts.MinMapQ = uint8(*minMapQ)
+		opts.MinBaseQ = uint8(*minBaseQ)
+		opts.RequireFlags = uint16(*requireFlags)
+		opts.ExcludeFlags = uint16(*excludeFlags)
+		opts.Filter = compileExpr(*expr, b)
+	}
+}
+
+// exprFlag adds the -e filter expression flag to fs.
+func exprFlag(fs *flag.FlagSet) *string {
+	return fs.String("e", "", "only use reads matching this filter expression,\ne.g. 'mapq >= 30 && !flag.duplicate && [NM] <= 3'")
+}
+
+// compileExpr compiles a filter expression for the file, or returns nil
+// if it is empty.
+func compileExpr(expr string, b *bam.AlignmentMap) *bam.Filter {
+	if expr == "" {
+		return nil
+	}
+	f, err := bam.CompileFilter(expr, b.References)
+	if err != nil {
+		fatal(err)
+	}
+	return f
+}
+
+// cmdRegions parses a region flag, or returns every reference when empty.
+func cmdRegions(b *bam.AlignmentMap, region string) ([]bam.Region, error) {
+	if region != "" {
+		reg, err := b.ParseRegion(region)
+		if err != nil {
+			return nil, err
+		}
+		return []bam.Region{reg}, nil
+	}
+	var res []bam.Region
+	for i, r := range b.References {
+		res = append(res, bam.Region{RefID: int32(i), Begin: 0, End: uint64(r.Length)})
+	}
+	return res, nil
+}
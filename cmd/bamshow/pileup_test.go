@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/joiningdata/bam"
+)
+
+func TestAppendMpileupBase(t *testing.T) {
+	ref := "ACGTACGT"
+	refBase := func(pos int64) byte { return ref[pos] }
+	tests := []struct {
+		r    bam.PileupRead
+		want string
+	}{
+		{bam.PileupRead{Base: 'C'}, "."},
+		{bam.PileupRead{Base: 'C', Reverse: true}, ","},
+		{bam.PileupRead{Base: 'T'}, "T"},
+		{bam.PileupRead{Base: 'T', Reverse: true}, "t"},
+		{bam.PileupRead{IsDel: true}, "*"},
+		{bam.PileupRead{IsDel: true, Reverse: true}, "*"},
+		{bam.PileupRead{IsRefSkip: true}, ">"},
+		{bam.PileupRead{IsRefSkip: true, Reverse: true}, "<"},
+		{bam.PileupRead{Base: 'C', Indel: -2}, ".-2GT"},
+		{bam.PileupRead{Base: 'C', Indel: -2, Reverse: true, IsTail: true}, ",-2gt$"},
+	}
+	for _, tc := range tests {
+		got := string(appendMpileupBase(nil, &tc.r, 'C', 1, refBase))
+		if got != tc.want {
+			t.Errorf("appendMpileupBase(%+v) = %q, want %q", tc.r, got, tc.want)
+		}
+	}
+}
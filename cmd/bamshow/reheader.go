@@ -0,0 +1,51 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joiningdata/bam"
+)
+
+func reheaderCmd(args []string) {
+	fs := flag.NewFlagSet("reheader", flag.ExitOnError)
+	to := fs.String("to", "ucsc", "naming convention to rename references to (ucsc, ensembl, ...)")
+	aliasFile := fs.String("aliases", "", "chromAlias file to use instead of the built-in human/mouse names")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow reheader [options] in.bam out.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	aliases := bam.DefaultAliases
+	if *aliasFile != "" {
+		var err error
+		aliases, err = bam.LoadAliases(*aliasFile)
+		if err != nil {
+			fatal(err)
+		}
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	n := b.Reheader(aliases, *to)
+
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+	if err = b.Copy(out); err != nil {
+		fatal(err)
+	}
+	if err = out.Close(); err != nil {
+		fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "renamed %d reference sequences\n", n)
+}
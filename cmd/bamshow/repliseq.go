@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/joiningdata/bam"
+	"github.com/joiningdata/bam/repliseq"
+)
+
+func repliseqCmd(args []string) {
+	opts := repliseq.DefaultOptions
+	filter := bam.DefaultDepthOptions
+	opts.Filter = &filter
+	fs := flag.NewFlagSet("repliseq", flag.ExitOnError)
+	fs.IntVar(&opts.Window, "w", opts.Window, "window width")
+	fs.IntVar(&opts.Step, "step", opts.Step, "distance between window centers")
+	fs.IntVar(&opts.Span, "span", opts.Span, "loess smoothing span (0 for none)")
+	method := fs.String("method", "wa", "signal: wa (weighted average) or log2 (log2 early/late)")
+	weights := fs.String("weights", "", "comma-separated weight of each fraction, 1 for earliest to 0 for latest\n(default: the UW weights for 6 fractions, or 1,0 for an early/late pair)")
+	setFilters := filterFlags(fs, &filter)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow repliseq [options] fraction1.bam fraction2.bam ... > out.bedGraph")
+		fmt.Fprintln(os.Stderr, "Fractions are given from earliest to latest, e.g. G1b S1 S2 S3 S4 G2.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() < 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch *method {
+	case "wa":
+		opts.Method = repliseq.WeightedAverage
+	case "log2":
+		opts.Method = repliseq.Log2Ratio
+	default:
+		fatal(fmt.Errorf("unknown method %q", *method))
+	}
+
+	var w []float64
+	switch {
+	case *weights != "":
+		for _, s := range strings.Split(*weights, ",") {
+			v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			if err != nil {
+				fatal(fmt.Errorf("invalid weight %q", s))
+			}
+			w = append(w, v)
+		}
+	case fs.NArg() == len(repliseq.UWWeights):
+		w = repliseq.UWWeights
+	case fs.NArg() == 2:
+		w = []float64{1, 0}
+	}
+	if len(w) != fs.NArg() {
+		fatal(fmt.Errorf("need one weight for each of the %d fractions", fs.NArg()))
+	}
+
+	fractions := make([]repliseq.Fraction, fs.NArg())
+	for i, name := range fs.Args() {
+		b, err := openBAM(name, false)
+		if err != nil {
+			fatal(err)
+		}
+		fractions[i] = repliseq.Fraction{Name: filepath.Base(name), BAM: b, Weight: w[i]}
+	}
+	// repliseq.Compute compiles the filter again for each fraction
+	setFilters(fractions[0].BAM)
+
+	s, err := repliseq.Compute(fractions, &opts)
+	if err != nil {
+		fatal(err)
+	}
+	if err = s.WriteBedGraph(os.Stdout); err != nil {
+		fatal(err)
+	}
+}
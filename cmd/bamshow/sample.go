@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/joiningdata/bam"
+)
+
+func sampleCmd(args []string) {
+	var opts bam.SampleOptions
+	fs := flag.NewFlagSet("sample", flag.ExitOnError)
+	fs.Float64Var(&opts.Fraction, "f", 0, "keep this fraction of the templates")
+	fs.IntVar(&opts.Count, "n", 0, "keep exactly this many templates")
+	fs.IntVar(&opts.MaxDepth, "d", 0, "drop reads that would take the coverage above this depth")
+	fs.Int64Var(&opts.Seed, "s", 0, "seed choosing which templates are kept")
+	region := fs.String("r", "", "only sample reads in this region (chr:begin-end)")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow sample [options] in.bam out.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if opts.Fraction < 0 || opts.Fraction > 1 {
+		fatal(fmt.Errorf("-f must be between 0 and 1"))
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	var r *bam.Region
+	if *region != "" {
+		reg, err := b.ParseRegion(*region)
+		if err != nil {
+			fatal(err)
+		}
+		r = &reg
+	}
+
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+	w, err := bam.NewWriter(out, b.Header, b.References)
+	if err != nil {
+		fatal(err)
+	}
+	n := 0
+	s := b.Sample(r, &opts)
+	for s.Next() {
+		if err = w.Write(s.Record()); err != nil {
+			fatal(err)
+		}
+		n++
+	}
+	if err = s.Err(); err != nil {
+		fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		fatal(err)
+	}
+	if err = out.Close(); err != nil {
+		fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "kept %s alignments\n", commas(n))
+}
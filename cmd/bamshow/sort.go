@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/joiningdata/bam"
+)
+
+func sortCmd(args []string) {
+	var opts bam.SortOptions
+	fs := flag.NewFlagSet("sort", flag.ExitOnError)
+	byName := fs.Bool("n", false, "sort by read name instead of coordinate")
+	fs.StringVar(&opts.Tag, "t", "", "sort by the value of this tag, then by coordinate")
+	maxmem := fs.String("m", "500M", "memory to use before spilling sorted runs to disk")
+	fs.StringVar(&opts.TempDir, "T", "", "directory for temporary files")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow sort [options] in.bam out.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch {
+	case *byName && opts.Tag != "":
+		fatal(fmt.Errorf("-n and -t can't be used together"))
+	case *byName:
+		opts.Order = bam.SortQueryName
+	case opts.Tag != "":
+		opts.Order = bam.SortTag
+	}
+	var err error
+	if opts.MaxMemory, err = parseSize(*maxmem); err != nil {
+		fatal(err)
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	out, err := os.Create(fs.Arg(1))
+	if err != nil {
+		fatal(err)
+	}
+	if err = b.Sort(out, &opts); err != nil {
+		out.Close()
+		os.Remove(fs.Arg(1))
+		fatal(err)
+	}
+	if err = out.Close(); err != nil {
+		fatal(err)
+	}
+}
+
+// parseSize parses a size such as "500M" or "2G" into bytes.
+func parseSize(size string) (int64, error) {
+	s := strings.TrimSuffix(strings.ToUpper(size), "B")
+	mult := int64(1)
+	if s != "" {
+		switch s[len(s)-1] {
+		case 'K':
+			mult = 1024
+		case 'M':
+			mult = 1024 * 1024
+		case 'G':
+			mult = 1024 * 1024 * 1024
+		case 'T':
+			mult = 1024 * 1024 * 1024 * 1024
+		}
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	num, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || num <= 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return num * mult, nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/joiningdata/bam"
+)
+
+func splitCmd(args []string) {
+	var opts bam.SplitOptions
+	fs := flag.NewFlagSet("split", flag.ExitOnError)
+	fs.StringVar(&opts.Tag, "t", "", "split by the value of this tag instead of the read group")
+	byRef := fs.Bool("ref", false, "split by reference instead of the read group")
+	fs.StringVar(&opts.Path, "o", "", "output path template, with %s for the group name (default in_%s.bam)")
+	fs.StringVar(&opts.Unmatched, "u", "", "group name for reads without a group (default: leave them out)")
+	fs.IntVar(&opts.MaxOpen, "max-open", 64, "most output files to hold open at once")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: bamshow split [options] in.bam")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	switch {
+	case *byRef && opts.Tag != "":
+		fatal(fmt.Errorf("-ref and -t can't be used together"))
+	case *byRef:
+		opts.By = bam.SplitReference
+	case opts.Tag != "":
+		opts.By = bam.SplitTag
+	}
+	if opts.Path == "" {
+		opts.Path = strings.TrimSuffix(fs.Arg(0), ".bam") + "_%s.bam"
+	}
+
+	b, err := openBAM(fs.Arg(0), false)
+	if err != nil {
+		fatal(err)
+	}
+	files, err := b.Split(&opts)
+	if err != nil {
+		fatal(err)
+	}
+	for _, f := range files {
+		fmt.Printf("%s\t%s\t%d\n", f.Group, f.Path, f.Count)
+	}
+}
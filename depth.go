@@ -0,0 +1,160 @@
+package bam
+
+import (
+	"sort"
+)
+
+// DefaultDepthOptions are used by Depth when no options are given. They
+// match the defaults of samtools depth. MaxDepth is not used by Depth.
+var DefaultDepthOptions = PileupOptions{
+	ExcludeFlags: FlagUnmapped | FlagSecondary | FlagQCFail | FlagDuplicate,
+}
+
+// Coverage holds the read depth of each position in a region.
+type Coverage struct {
+	Region
+
+	// Depth is the number of aligned bases at each position from
+	// Region.Begin. Deletions and reference skips are not counted.
+	Depth []uint32
+
+	// Reads is the number of reads that passed the filters.
+	Reads int
+
+	sumMapQ  uint64
+	sumBaseQ uint64
+}
+
+// Depth computes the per-position read depth of a region, placing each
+// read base according to the CIGAR. A nil opts uses DefaultDepthOptions.
+func (b *AlignmentMap) Depth(r Region, opts *PileupOptions) (*Coverage, error) {
+	o := DefaultDepthOptions
+	if opts != nil {
+		o = *opts
+	}
+	if r.End < r.Begin {
+		r.End = r.Begin
+	}
+	c := &Coverage{Region: r, Depth: make([]uint32, r.End-r.Begin)}
+	begin, end := int64(r.Begin), int64(r.End)
+
+	it := b.Fetch(r.RefID, r.Begin, r.End)
+	for it.Next() {
+		a := it.Record()
+		if !o.Accepts(a) {
+			continue
+		}
+		c.Reads++
+		c.sumMapQ += uint64(a.mapq)
+
+		pos, qpos := int64(a.pos), 0
+		for _, op := range a.Cigar() {
+			n := int(op.Len())
+			switch op.Type() {
+			case CigarMatch, CigarEqual, CigarMismatch:
+				for i := 0; i < n; i++ {
+					p := pos + int64(i)
+					if p < begin || p >= end {
+						continue
+					}
+					q := byte(0xff)
+					if qpos+i < len(a.qual) {
+						q = a.qual[qpos+i]
+					}
+					if q < o.MinBaseQ {
+						continue
+					}
+					c.Depth[p-begin]++
+					if q != 0xff {
+						c.sumBaseQ += uint64(q)
+					}
+				}
+				pos += int64(n)
+				qpos += n
+			case CigarDeletion, CigarSkipped:
+				pos += int64(n)
+			case CigarInsertion, CigarSoftClipped:
+				qpos += n
+			}
+		}
+	}
+	return c, it.Err()
+}
+
+// Len returns the number of positions in the region.
+func (c *Coverage) Len() int {
+	return len(c.Depth)
+}
+
+// Bases returns the total number of aligned bases counted.
+func (c *Coverage) Bases() uint64 {
+	var n uint64
+	for _, d := range c.Depth {
+		n += uint64(d)
+	}
+	return n
+}
+
+// Mean returns the mean depth over all positions.
+func (c *Coverage) Mean() float64 {
+	if len(c.Depth) == 0 {
+		return 0
+	}
+	return float64(c.Bases()) / float64(len(c.Depth))
+}
+
+// Median returns the median depth over all positions.
+func (c *Coverage) Median() float64 {
+	n := len(c.Depth)
+	if n == 0 {
+		return 0
+	}
+	d := append([]uint32(nil), c.Depth...)
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	if n%2 == 1 {
+		return float64(d[n/2])
+	}
+	return (float64(d[n/2-1]) + float64(d[n/2])) / 2
+}
+
+// Covered returns the number of positions with a depth of at least n.
+func (c *Coverage) Covered(n uint32) int {
+	k := 0
+	for _, d := range c.Depth {
+		if d >= n {
+			k++
+		}
+	}
+	return k
+}
+
+// FractionAtLeast returns the fraction of positions with a depth of at
+// least n.
+func (c *Coverage) FractionAtLeast(n uint32) float64 {
+	if len(c.Depth) == 0 {
+		return 0
+	}
+	return float64(c.Covered(n)) / float64(len(c.Depth))
+}
+
+// Breadth returns the fraction of positions covered by at least one read.
+func (c *Coverage) Breadth() float64 {
+	return c.FractionAtLeast(1)
+}
+
+// MeanMapQ returns the mean mapping quality of the reads counted.
+func (c *Coverage) MeanMapQ() float64 {
+	if c.Reads == 0 {
+		return 0
+	}
+	return float64(c.sumMapQ) / float64(c.Reads)
+}
+
+// MeanBaseQ returns the mean quality of the bases counted.
+func (c *Coverage) MeanBaseQ() float64 {
+	n := c.Bases()
+	if n == 0 {
+		return 0
+	}
+	return float64(c.sumBaseQ) / float64(n)
+}
@@ -0,0 +1,62 @@
+package bam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDepth(t *testing.T) {
+	dup := newTestRecord("dup", 0, 100, FlagDuplicate, "10M", "ACGTACGTAC")
+	low := newTestRecord("low", 0, 104, 0, "4M", "ACGT")
+	low.qual = "\x1e\x05\x1e\x1e" // the second base is below MinBaseQ
+	recs := []*Alignment{
+		newTestRecord("a", 0, 100, 0, "2S4M2D2M", "TTACGTAC"),
+		newTestRecord("b", 0, 102, FlagReverse, "3M3N2M", "GTAAC"),
+		dup,
+		low,
+	}
+	filename := writeTestFiles(t, "depth", recs, true)
+	b := loadTestFile(t, filename, nil)
+
+	opts := DefaultDepthOptions
+	opts.MinBaseQ = 13
+	c, err := b.Depth(Region{RefID: 0, Begin: 98, End: 112}, &opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//               98 99 100 101 102 103 104 105 106 107 108 109 110 111
+	want := []uint32{0, 0, 1, 1, 2, 2, 2, 0, 2, 2, 1, 1, 0, 0}
+	if !reflect.DeepEqual(c.Depth, want) {
+		t.Errorf("Depth = %v, want %v", c.Depth, want)
+	}
+	if c.Reads != 3 {
+		t.Errorf("counted %d reads, want 3 (without the duplicate)", c.Reads)
+	}
+	if c.Bases() != 14 || c.Len() != 14 {
+		t.Errorf("Bases() = %d, Len() = %d, want 14 and 14", c.Bases(), c.Len())
+	}
+	if got := c.Covered(2); got != 5 {
+		t.Errorf("Covered(2) = %d, want 5", got)
+	}
+	if got, want := c.Breadth(), 9.0/14; got != want {
+		t.Errorf("Breadth() = %v, want %v", got, want)
+	}
+	if got := c.Median(); got != 1 {
+		t.Errorf("Median() = %v, want 1", got)
+	}
+	if got := c.MeanBaseQ(); got != 30 {
+		t.Errorf("MeanBaseQ() = %v, want 30", got)
+	}
+	if got := c.MeanMapQ(); got != 60 {
+		t.Errorf("MeanMapQ() = %v, want 60", got)
+	}
+
+	// the default options count the low quality base
+	c, err = b.Depth(Region{RefID: 0, Begin: 105, End: 106}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Depth[0] != 1 {
+		t.Errorf("default depth at 105 = %d, want 1", c.Depth[0])
+	}
+}
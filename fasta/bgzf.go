@@ -0,0 +1,101 @@
+package fasta
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/joiningdata/bam"
+)
+
+// isBGZF reports whether the file starts with a BGZF block header.
+func isBGZF(r io.ReaderAt) (bool, error) {
+	var head [16]byte
+	n, err := r.ReadAt(head[:], 0)
+	if n < len(head) {
+		if err == io.EOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return head[0] == 0x1f && head[1] == 0x8b && head[3]&4 != 0 &&
+		head[12] == 'B' && head[13] == 'C', nil
+}
+
+// gziEntry maps the compressed offset of a block to the uncompressed
+// offset of its first byte.
+type gziEntry struct {
+	compressed   int64
+	uncompressed int64
+}
+
+// loadGZI reads a bgzip ".gzi" index.
+func loadGZI(filename string) ([]gziEntry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	le := binary.LittleEndian
+	var n uint64
+	if err = binary.Read(f, le, &n); err != nil {
+		return nil, err
+	}
+	raw := make([]uint64, 2*n)
+	if err = binary.Read(f, le, raw); err != nil {
+		return nil, fmt.Errorf("fasta: invalid gzi index %s: %v", filename, err)
+	}
+	// the first block is implicit
+	res := []gziEntry{{0, 0}}
+	for i := uint64(0); i < n; i++ {
+		res = append(res, gziEntry{int64(raw[2*i]), int64(raw[2*i+1])})
+	}
+	return res, nil
+}
+
+// bgzfReader implements io.ReaderAt over the uncompressed contents of a
+// BGZF file, using a gzi index to find the blocks.
+type bgzfReader struct {
+	r   io.ReaderAt
+	gzi []gziEntry
+
+	mu    sync.Mutex
+	last  int // index into gzi of the cached block, or -1
+	block []byte
+}
+
+func newBGZFReader(r io.ReaderAt, gzi []gziEntry) *bgzfReader {
+	return &bgzfReader{r: r, gzi: gzi, last: -1}
+}
+
+func (z *bgzfReader) ReadAt(p []byte, off int64) (int, error) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+
+	n := 0
+	for n < len(p) {
+		i := sort.Search(len(z.gzi), func(i int) bool { return z.gzi[i].uncompressed > off }) - 1
+		if i < 0 {
+			return n, fmt.Errorf("fasta: invalid offset %d", off)
+		}
+		if i != z.last {
+			data, _, err := bam.ReadBGZFBlock(z.r, z.gzi[i].compressed)
+			if err != nil {
+				return n, err
+			}
+			z.last, z.block = i, data
+		}
+		bo := off - z.gzi[i].uncompressed
+		if bo >= int64(len(z.block)) {
+			return n, io.EOF
+		}
+		c := copy(p[n:], z.block[bo:])
+		n += c
+		off += int64(c)
+	}
+	return n, nil
+}
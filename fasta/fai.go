@@ -0,0 +1,163 @@
+// Package fasta reads indexed FASTA reference sequences.
+//
+// Both plain and bgzip-compressed files are supported. Plain files use a
+// samtools ".fai" index, which is built if it's missing. Compressed files
+// additionally need the ".gzi" index written by bgzip.
+package fasta
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// An IndexEntry describes the layout of one sequence in a FASTA file,
+// in the format of a samtools ".fai" line.
+type IndexEntry struct {
+	Name      string
+	Length    int64
+	Offset    int64 // offset of the first base in the (uncompressed) file
+	LineBases int64 // bases per line
+	LineWidth int64 // bytes per line, including the newline
+}
+
+// ReadIndex reads a ".fai" index.
+func ReadIndex(r io.Reader) ([]IndexEntry, error) {
+	var res []IndexEntry
+	s := bufio.NewScanner(r)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := s.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) < 5 {
+			return nil, fmt.Errorf("fasta: index line %d: expected 5 columns", lineno)
+		}
+		e := IndexEntry{Name: fields[0]}
+		var err error
+		for i, p := range []*int64{&e.Length, &e.Offset, &e.LineBases, &e.LineWidth} {
+			*p, err = strconv.ParseInt(fields[i+1], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("fasta: index line %d: %v", lineno, err)
+			}
+		}
+		res = append(res, e)
+	}
+	return res, s.Err()
+}
+
+// WriteIndex writes entries in ".fai" format.
+func WriteIndex(w io.Writer, entries []IndexEntry) error {
+	for _, e := range entries {
+		_, err := fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\n", e.Name, e.Length, e.Offset, e.LineBases, e.LineWidth)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BuildIndex scans uncompressed FASTA text and returns its index.
+// Every line of a sequence except the last must have the same length.
+func BuildIndex(r io.Reader) ([]IndexEntry, error) {
+	var res []IndexEntry
+	br := bufio.NewReaderSize(r, 1024*1024)
+
+	var cur *IndexEntry
+	var offset int64
+	lastLine := false // a short line was seen in the current sequence
+	for lineno := 1; ; lineno++ {
+		line, err := br.ReadBytes('\n')
+		if len(line) == 0 && err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return res, err
+		}
+		width := int64(len(line))
+		offset += width
+		line = bytes.TrimRight(line, "\r\n")
+
+		if len(line) > 0 && line[0] == '>' {
+			name := strings.Fields(string(line[1:]))
+			if len(name) == 0 {
+				return nil, fmt.Errorf("fasta: line %d: missing sequence name", lineno)
+			}
+			res = append(res, IndexEntry{Name: name[0], Offset: offset})
+			cur = &res[len(res)-1]
+			lastLine = false
+			continue
+		}
+		if cur == nil {
+			if len(line) == 0 {
+				continue
+			}
+			return nil, fmt.Errorf("fasta: line %d: sequence before the first header", lineno)
+		}
+		bases := int64(len(line))
+		if bases == 0 {
+			lastLine = true
+			continue
+		}
+		switch {
+		case cur.LineBases == 0:
+			cur.LineBases, cur.LineWidth = bases, width
+		case lastLine, bases > cur.LineBases,
+			bases == cur.LineBases && width != cur.LineWidth && err == nil:
+			return nil, fmt.Errorf("fasta: line %d: different line length in sequence %s", lineno, cur.Name)
+		}
+		if bases < cur.LineBases {
+			lastLine = true
+		}
+		cur.Length += bases
+	}
+}
+
+// LoadIndex reads the ".fai" index of the FASTA file, building it (and
+// trying to save it next to the file) if it doesn't exist.
+func LoadIndex(filename string) ([]IndexEntry, error) {
+	f, err := os.Open(filename + ".fai")
+	if err == nil {
+		defer f.Close()
+		return ReadIndex(f)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	src, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	var r io.Reader = src
+	if bz, err := isBGZF(src); err != nil {
+		return nil, err
+	} else if bz {
+		z, err := gzip.NewReader(src)
+		if err != nil {
+			return nil, err
+		}
+		defer z.Close()
+		r = z
+	}
+	entries, err := BuildIndex(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// the index is only a cache, so failing to save it isn't an error
+	if out, err := os.Create(filename + ".fai"); err == nil {
+		werr := WriteIndex(out, entries)
+		if cerr := out.Close(); werr != nil || cerr != nil {
+			os.Remove(filename + ".fai")
+		}
+	}
+	return entries, nil
+}
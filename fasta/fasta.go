@@ -0,0 +1,147 @@
+package fasta
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/joiningdata/bam"
+)
+
+// A Reader fetches subsequences from an indexed FASTA file.
+// It is safe for concurrent use.
+type Reader struct {
+	f      *os.File
+	r      io.ReaderAt
+	index  []IndexEntry
+	byName map[string]int
+
+	// Aliases are tried when a sequence name doesn't match exactly.
+	// Open sets it to bam.DefaultAliases.
+	Aliases *bam.Aliases
+}
+
+// Open opens the FASTA file, loading (or building) its ".fai" index.
+// A bgzip-compressed file also needs its ".gzi" index.
+func Open(filename string) (*Reader, error) {
+	index, err := LoadIndex(filename)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{
+		f:       f,
+		r:       f,
+		index:   index,
+		byName:  make(map[string]int, len(index)),
+		Aliases: bam.DefaultAliases,
+	}
+	for i, e := range index {
+		r.byName[e.Name] = i
+	}
+
+	if bz, err := isBGZF(f); err != nil {
+		f.Close()
+		return nil, err
+	} else if bz {
+		gzi, err := loadGZI(filename + ".gzi")
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		r.r = newBGZFReader(f, gzi)
+	}
+	return r, nil
+}
+
+// Close closes the FASTA file.
+func (r *Reader) Close() error {
+	return r.f.Close()
+}
+
+// Index returns the index entry of every sequence, in file order.
+func (r *Reader) Index() []IndexEntry {
+	return r.index
+}
+
+// lookup finds the named sequence, also trying its Aliases.
+func (r *Reader) lookup(name string) (*IndexEntry, bool) {
+	if i, ok := r.byName[name]; ok {
+		return &r.index[i], true
+	}
+	if r.Aliases != nil {
+		for _, alias := range r.Aliases.Names(name) {
+			if i, ok := r.byName[alias]; ok {
+				return &r.index[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Length returns the length of the named sequence.
+func (r *Reader) Length(name string) (int64, bool) {
+	e, ok := r.lookup(name)
+	if !ok {
+		return 0, false
+	}
+	return e.Length, true
+}
+
+// Fetch returns the bases of the named sequence in the 0-based, half-open
+// range [begin, end). The end is clipped to the length of the sequence.
+func (r *Reader) Fetch(name string, begin, end int64) (string, error) {
+	e, ok := r.lookup(name)
+	if !ok {
+		return "", fmt.Errorf("fasta: unknown sequence '%s'", name)
+	}
+	if end > e.Length {
+		end = e.Length
+	}
+	if begin < 0 || begin >= end {
+		return "", fmt.Errorf("fasta: invalid range %d-%d of %s (%d bp)", begin, end, name, e.Length)
+	}
+
+	start := e.Offset + begin/e.LineBases*e.LineWidth + begin%e.LineBases
+	stop := e.Offset + (end-1)/e.LineBases*e.LineWidth + (end-1)%e.LineBases + 1
+	raw := make([]byte, stop-start)
+	n, err := r.r.ReadAt(raw, start)
+	if n < len(raw) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+
+	seq := make([]byte, 0, end-begin)
+	for len(raw) > 0 {
+		i := bytes.IndexAny(raw, "\r\n")
+		if i < 0 {
+			seq = append(seq, raw...)
+			break
+		}
+		seq = append(seq, raw[:i]...)
+		raw = raw[i+1:]
+	}
+	return string(seq), nil
+}
+
+// CheckReferences compares the reference sequences of a BAM file with the
+// sequences of the FASTA file, and reports any that are missing or have a
+// different length.
+func (r *Reader) CheckReferences(refs []bam.Reference) error {
+	for _, ref := range refs {
+		n, ok := r.Length(ref.Name)
+		if !ok {
+			return fmt.Errorf("fasta: reference %s is missing", ref.Name)
+		}
+		if n != int64(ref.Length) {
+			return fmt.Errorf("fasta: reference %s is %d bp, but %d bp in the alignments", ref.Name, n, ref.Length)
+		}
+	}
+	return nil
+}
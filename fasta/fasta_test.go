@@ -0,0 +1,166 @@
+package fasta
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/joiningdata/bam"
+)
+
+// testSeqs are written 10 bases per line.
+var testSeqs = []struct{ name, seq string }{
+	{"chr1", strings.Repeat("ACGTACGTAC", 7) + "GGG"},
+	{"chrM", "TTTTTCCCCCAAAAAGGGGG"},
+}
+
+func testFASTA() []byte {
+	var buf bytes.Buffer
+	for _, s := range testSeqs {
+		buf.WriteString(">" + s.name + " description\n")
+		for i := 0; i < len(s.seq); i += 10 {
+			end := i + 10
+			if end > len(s.seq) {
+				end = len(s.seq)
+			}
+			buf.WriteString(s.seq[i:end] + "\n")
+		}
+	}
+	return buf.Bytes()
+}
+
+// bgzip compresses data in blocks of blockSize bytes, returning the file
+// and its gzi index.
+func bgzip(t *testing.T, data []byte, blockSize int) ([]byte, []byte) {
+	le := binary.LittleEndian
+	var out bytes.Buffer
+	var entries []uint64
+	for off := 0; off < len(data); off += blockSize {
+		end := off + blockSize
+		if end > len(data) {
+			end = len(data)
+		}
+		if off > 0 {
+			entries = append(entries, uint64(out.Len()), uint64(off))
+		}
+		var z bytes.Buffer
+		fw, _ := flate.NewWriter(&z, flate.DefaultCompression)
+		fw.Write(data[off:end])
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		block := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0}
+		block = le.AppendUint16(block, uint16(18+z.Len()+8-1))
+		block = append(block, z.Bytes()...)
+		block = le.AppendUint32(block, crc32.ChecksumIEEE(data[off:end]))
+		block = le.AppendUint32(block, uint32(end-off))
+		out.Write(block)
+	}
+	out.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0, 0x1b, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+
+	gzi := le.AppendUint64(nil, uint64(len(entries)/2))
+	for _, e := range entries {
+		gzi = le.AppendUint64(gzi, e)
+	}
+	return out.Bytes(), gzi
+}
+
+func writeFile(t *testing.T, filename string, data []byte) {
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReader(t *testing.T) {
+	dir := t.TempDir()
+	plain := filepath.Join(dir, "ref.fa")
+	writeFile(t, plain, testFASTA())
+	gz, gzi := bgzip(t, testFASTA(), 32)
+	compressed := filepath.Join(dir, "ref.fa.gz")
+	writeFile(t, compressed, gz)
+	writeFile(t, compressed+".gzi", gzi)
+
+	for _, filename := range []string{plain, compressed} {
+		r, err := Open(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Stat(filename + ".fai"); err != nil {
+			t.Errorf("%s: index wasn't saved: %v", filename, err)
+		}
+		if n, ok := r.Length("chr1"); !ok || n != 73 {
+			t.Errorf("%s: Length(chr1) = %d, %v", filename, n, ok)
+		}
+		for _, rg := range [][2]int64{{0, 73}, {5, 25}, {9, 11}, {70, 100}} {
+			got, err := r.Fetch("chr1", rg[0], rg[1])
+			end := rg[1]
+			if end > 73 {
+				end = 73
+			}
+			if want := testSeqs[0].seq[rg[0]:end]; err != nil || got != want {
+				t.Errorf("%s: Fetch(chr1, %d, %d) = %q, %v, want %q", filename, rg[0], rg[1], got, err, want)
+			}
+		}
+
+		// MT is found through the default aliases, but not without them
+		if got, err := r.Fetch("MT", 3, 7); err != nil || got != "TTCC" {
+			t.Errorf("%s: Fetch(MT, 3, 7) = %q, %v", filename, got, err)
+		}
+		r.Aliases = nil
+		if _, err = r.Fetch("MT", 3, 7); err == nil {
+			t.Errorf("%s: found MT without aliases", filename)
+		}
+		r.Aliases = bam.NewAliases()
+		r.Aliases.Add(map[string]string{"ucsc": "chr1", "other": "first"})
+		if _, ok := r.Length("first"); !ok {
+			t.Errorf("%s: custom aliases weren't used", filename)
+		}
+
+		if err = r.CheckReferences([]bam.Reference{{Name: "chr1", Length: 73}, {Name: "chrM", Length: 21}}); err == nil {
+			t.Errorf("%s: CheckReferences missed a length difference", filename)
+		}
+		r.Close()
+	}
+}
+
+func TestReaderCorruptBlock(t *testing.T) {
+	dir := t.TempDir()
+	gz, gzi := bgzip(t, testFASTA(), 32)
+	gz[len(gz)-28-8] ^= 0xff // the CRC32 of the last data block
+	filename := filepath.Join(dir, "ref.fa.gz")
+	writeFile(t, filename, gz)
+	writeFile(t, filename+".gzi", gzi)
+	writeFile(t, filename+".fai", []byte("chr1\t73\t18\t10\t11\nchrM\t20\t117\t10\t11\n"))
+
+	r, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err = r.Fetch("chrM", 0, 20); err == nil {
+		t.Error("read a block with a bad checksum")
+	}
+}
+
+func TestBuildIndex(t *testing.T) {
+	entries, err := BuildIndex(bytes.NewReader(testFASTA()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err = WriteIndex(&buf, entries); err != nil {
+		t.Fatal(err)
+	}
+	if want := "chr1\t73\t18\t10\t11\nchrM\t20\t117\t10\t11\n"; buf.String() != want {
+		t.Errorf("index is\n%s\nwant\n%s", buf.String(), want)
+	}
+
+	if _, err = BuildIndex(strings.NewReader(">a\nACGT\nAC\nACGT\n")); err == nil {
+		t.Error("BuildIndex accepted a short line in the middle of a sequence")
+	}
+}
@@ -0,0 +1,297 @@
+package bam
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// FASTQOptions control ToFASTQ. Reads are sent to the stream for their
+// kind; a nil stream drops those reads.
+type FASTQOptions struct {
+	// R1 and R2 get the first and second reads of pairs whose mates were
+	// both found, in the same order.
+	R1, R2 io.Writer
+
+	// Singleton gets paired reads whose mate is missing from the file.
+	Singleton io.Writer
+
+	// Unpaired gets reads that aren't part of a pair.
+	Unpaired io.Writer
+
+	// Gzip compresses every stream.
+	Gzip bool
+
+	// OriginalQualities uses the qualities of the OQ tag, as saved by base
+	// quality recalibration, when a read has one.
+	OriginalQualities bool
+
+	// ReadNumbers adds /1 and /2 to the names of paired reads.
+	ReadNumbers bool
+
+	// Tags are copied into the header line as SAM TAG:TYPE:VALUE fields.
+	Tags []string
+}
+
+// FASTQCounts are the number of reads written to each stream of ToFASTQ.
+// Reads dropped because their stream is nil aren't counted, and a pair
+// counts when either of its reads is written.
+type FASTQCounts struct {
+	Pairs     int
+	Singleton int
+	Unpaired  int
+}
+
+// ToFASTQ writes the primary alignments as FASTQ, restoring reads on the
+// reverse strand to their sequenced orientation. Mates are paired up as
+// they follow each other, so the file must be sorted by name or collated;
+// a coordinate sorted file is an error.
+func (b *AlignmentMap) ToFASTQ(opts *FASTQOptions) (FASTQCounts, error) {
+	var counts FASTQCounts
+	if strings.HasPrefix(b.Header, "@HD\t") {
+		hd := b.Header
+		if i := strings.IndexByte(hd, '\n'); i >= 0 {
+			hd = hd[:i]
+		}
+		if so, _ := headerField(hd, "SO"); so == "coordinate" {
+			return counts, fmt.Errorf("bam: FASTQ needs a name sorted or collated file")
+		}
+	}
+
+	f := &fastqWriter{o: opts}
+	r1, r2 := f.stream(opts.R1), f.stream(opts.R2)
+	single, unpaired := f.stream(opts.Singleton), f.stream(opts.Unpaired)
+
+	var pending *Alignment
+	flushPending := func() {
+		if pending != nil {
+			if single != nil {
+				f.write(single, pending)
+				counts.Singleton++
+			}
+			pending = nil
+		}
+	}
+
+	it := b.All()
+	for it.Next() && f.err == nil {
+		a := it.Record()
+		if a.flag&(FlagSecondary|FlagSupplementary) != 0 {
+			continue
+		}
+		if a.flag&FlagPaired == 0 {
+			flushPending()
+			if unpaired != nil {
+				f.write(unpaired, a)
+				counts.Unpaired++
+			}
+			continue
+		}
+		if pending == nil || pending.ReadName != a.ReadName ||
+			pending.flag&(FlagRead1|FlagRead2) == a.flag&(FlagRead1|FlagRead2) {
+			flushPending()
+			pending = a
+			continue
+		}
+		first, second := pending, a
+		if a.flag&FlagRead1 != 0 {
+			first, second = a, pending
+		}
+		f.write(r1, first)
+		f.write(r2, second)
+		if r1 != nil || r2 != nil {
+			counts.Pairs++
+		}
+		pending = nil
+	}
+	flushPending()
+	if err := it.Err(); f.err == nil {
+		f.err = err
+	}
+	if err := f.close(); f.err == nil {
+		f.err = err
+	}
+	return counts, f.err
+}
+
+// fastqWriter buffers (and compresses) the FASTQ streams.
+type fastqWriter struct {
+	o       *FASTQOptions
+	streams map[io.Writer]*fastqStream
+	line    []byte
+	err     error
+}
+
+type fastqStream struct {
+	bw *bufio.Writer
+	zw *gzip.Writer
+}
+
+// stream returns the buffered stream for w, sharing it when the same
+// writer is given for more than one kind of read.
+func (f *fastqWriter) stream(w io.Writer) *fastqStream {
+	if w == nil {
+		return nil
+	}
+	if f.streams == nil {
+		f.streams = make(map[io.Writer]*fastqStream)
+	}
+	if s, ok := f.streams[w]; ok {
+		return s
+	}
+	s := &fastqStream{bw: bufio.NewWriter(w)}
+	if f.o.Gzip {
+		s.zw = gzip.NewWriter(w)
+		s.bw = bufio.NewWriter(s.zw)
+	}
+	f.streams[w] = s
+	return s
+}
+
+func (f *fastqWriter) close() error {
+	var err error
+	for _, s := range f.streams {
+		e := s.bw.Flush()
+		if s.zw != nil {
+			if cerr := s.zw.Close(); e == nil {
+				e = cerr
+			}
+		}
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+func (f *fastqWriter) write(s *fastqStream, a *Alignment) {
+	if s == nil || f.err != nil {
+		return
+	}
+	line := append(f.line[:0], '@')
+	line = append(line, a.ReadName...)
+	if f.o.ReadNumbers && a.flag&FlagPaired != 0 {
+		switch {
+		case a.flag&FlagRead1 != 0:
+			line = append(line, "/1"...)
+		case a.flag&FlagRead2 != 0:
+			line = append(line, "/2"...)
+		}
+	}
+	for _, tag := range f.o.Tags {
+		if v, ok := a.samAux(tag); ok {
+			line = append(line, '\t')
+			line = append(line, v...)
+		}
+	}
+	line = append(line, '\n')
+
+	rev := a.flag&FlagReverse != 0
+	seq := a.Sequence()
+	start := len(line)
+	line = append(line, seq...)
+	if rev {
+		reverseComplement(line[start:])
+	}
+	line = append(line, "\n+\n"...)
+
+	start = len(line)
+	oq, ok := a.AuxData["OQ"].(string)
+	if f.o.OriginalQualities && ok && len(oq) == len(seq) {
+		line = append(line, oq...)
+	} else {
+		for i, q := range []byte(a.qual) {
+			if i == 0 && q == 0xff {
+				// qualities are missing, use a low default
+				line = append(line, strings.Repeat("\"", len(seq))...)
+				break
+			}
+			line = append(line, q+33)
+		}
+	}
+	if rev {
+		reverse(line[start:])
+	}
+	line = append(line, '\n')
+	f.line = line
+	_, f.err = s.bw.Write(line)
+}
+
+// samAux formats an aux field as in SAM text, TAG:TYPE:VALUE.
+func (a *Alignment) samAux(tag string) (string, bool) {
+	v, ok := a.AuxData[tag]
+	if !ok {
+		return "", false
+	}
+	p := tag + ":"
+	switch x := v.(type) {
+	case string:
+		return p + "Z:" + x, true
+	case []byte:
+		if a.auxType(tag) == 'H' {
+			return p + fmt.Sprintf("H:%X", x), true
+		}
+	case uint8:
+		if a.auxType(tag) == 'A' {
+			return p + "A:" + string(rune(x)), true
+		}
+		return p + "i:" + strconv.Itoa(int(x)), true
+	case int8, int16, uint16, int32, uint32:
+		return p + fmt.Sprintf("i:%d", x), true
+	case float32:
+		return p + "f:" + strconv.FormatFloat(float64(x), 'g', -1, 32), true
+	}
+
+	// B arrays
+	var typ byte
+	var vals string
+	switch x := v.(type) {
+	case []int8:
+		typ, vals = 'c', fmt.Sprint(x)
+	case []uint8:
+		typ, vals = 'C', fmt.Sprint(x)
+	case []int16:
+		typ, vals = 's', fmt.Sprint(x)
+	case []uint16:
+		typ, vals = 'S', fmt.Sprint(x)
+	case []int32:
+		typ, vals = 'i', fmt.Sprint(x)
+	case []uint32:
+		typ, vals = 'I', fmt.Sprint(x)
+	case []float32:
+		typ, vals = 'f', fmt.Sprint(x)
+	default:
+		return "", false
+	}
+	vals = strings.Trim(vals, "[]")
+	if vals == "" {
+		return p + "B:" + string(typ), true
+	}
+	return p + "B:" + string(typ) + "," + strings.ReplaceAll(vals, " ", ","), true
+}
+
+// complements maps IUPAC bases to their complement.
+var complements = [256]byte{
+	'A': 'T', 'C': 'G', 'G': 'C', 'T': 'A', 'U': 'A',
+	'M': 'K', 'R': 'Y', 'W': 'W', 'S': 'S', 'Y': 'R', 'K': 'M',
+	'V': 'B', 'H': 'D', 'D': 'H', 'B': 'V', 'N': 'N', '=': '=',
+}
+
+// reverseComplement reverse complements a sequence in place.
+func reverseComplement(s []byte) {
+	reverse(s)
+	for i, c := range s {
+		if r := complements[c]; r != 0 {
+			s[i] = r
+		}
+	}
+}
+
+func reverse(s []byte) {
+	for i, j := 0, len(s)-1; i < j; i, j = i+1, j-1 {
+		s[i], s[j] = s[j], s[i]
+	}
+}
@@ -0,0 +1,129 @@
+package bam
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"testing"
+)
+
+// fastqTestBAM returns a name sorted file with a pair, a read whose mate
+// is missing, an unpaired read and a secondary alignment.
+func fastqTestBAM(t *testing.T) *AlignmentMap {
+	paired := uint16(FlagPaired)
+	r1 := newTestRecord("p1", 0, 100, paired|FlagRead1|FlagMateReverse, "6M", "ACGTTT").setMate(0, 200, 106)
+	r2 := newTestRecord("p1", 0, 200, paired|FlagRead2|FlagReverse, "6M", "AACCGG").setMate(0, 100, -106)
+	r2.qual = "\x0a\x0b\x0c\x0d\x0e\x0f"
+	r2.SetAux("OQ", "ABCDEF")
+	r2.SetAux("RG", "grp")
+	secondary := newTestRecord("p1", 1, 50, paired|FlagRead1|FlagSecondary, "6M", "ACGTTT")
+	single := newTestRecord("s1", 0, 300, paired|FlagRead2, "4M", "GGGA").setMate(0, 900, 0)
+	unpaired := newTestRecord("u1", 0, 400, FlagReverse, "3M", "ACC")
+	unpaired.SetAux("NM", int32(1))
+
+	header := strings.Replace(testHeader(testRefs), "SO:coordinate", "SO:queryname", 1)
+	b, _ := readTestBAM(t, writeTestBAM(t, header, testRefs, []*Alignment{r1, secondary, r2, single, unpaired}))
+	return b
+}
+
+func TestToFASTQ(t *testing.T) {
+	b := fastqTestBAM(t)
+	var r1, r2, single bytes.Buffer
+	counts, err := b.ToFASTQ(&FASTQOptions{R1: &r1, R2: &r2, Singleton: &single})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unpaired read is dropped, and not counted
+	if want := (FASTQCounts{Pairs: 1, Singleton: 1}); counts != want {
+		t.Errorf("counts %+v, want %+v", counts, want)
+	}
+	tests := []struct {
+		name      string
+		got, want string
+	}{
+		{"R1", r1.String(), "@p1\nACGTTT\n+\n??????\n"},
+		// reverse complemented, with reversed qualities
+		{"R2", r2.String(), "@p1\nCCGGTT\n+\n0/.-,+\n"},
+		{"singleton", single.String(), "@s1\nGGGA\n+\n????\n"},
+	}
+	for _, tc := range tests {
+		if tc.got != tc.want {
+			t.Errorf("%s = %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+
+	// everything interleaved in one stream, with the OQ qualities, read
+	// numbers and tags
+	var all bytes.Buffer
+	counts, err = b.ToFASTQ(&FASTQOptions{R1: &all, R2: &all, Singleton: &all, Unpaired: &all,
+		OriginalQualities: true, ReadNumbers: true, Tags: []string{"RG", "NM"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (FASTQCounts{Pairs: 1, Singleton: 1, Unpaired: 1}); counts != want {
+		t.Errorf("counts %+v, want %+v", counts, want)
+	}
+	want := "@p1/1\nACGTTT\n+\n??????\n" +
+		"@p1/2\tRG:Z:grp\nCCGGTT\n+\nFEDCBA\n" +
+		"@s1/2\nGGGA\n+\n????\n" +
+		"@u1\tNM:i:1\nGGT\n+\n???\n"
+	if got := all.String(); got != want {
+		t.Errorf("interleaved output\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestToFASTQGzip(t *testing.T) {
+	b := fastqTestBAM(t)
+	var r1, r2 bytes.Buffer
+	counts, err := b.ToFASTQ(&FASTQOptions{R1: &r1, R2: &r2, Gzip: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (FASTQCounts{Pairs: 1}); counts != want {
+		t.Errorf("counts %+v, want %+v", counts, want)
+	}
+	z, err := gzip.NewReader(&r2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(z)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "@p1\nCCGGTT\n+\n0/.-,+\n"; got != want {
+		t.Errorf("R2 = %q, want %q", got, want)
+	}
+}
+
+func TestToFASTQCoordinateSorted(t *testing.T) {
+	b, _ := readTestBAM(t, writeTestBAM(t, testHeader(testRefs), testRefs, manyTestRecords(4)))
+	if _, err := b.ToFASTQ(&FASTQOptions{Unpaired: io.Discard}); err == nil {
+		t.Error("converted a coordinate sorted file")
+	}
+}
+
+func TestSAMAux(t *testing.T) {
+	a := newTestRecord("r", 0, 0, 0, "1M", "A")
+	a.SetAux("XA", uint8('x'))
+	a.SetAux("XH", []byte{0x1a, 0xff})
+	a.SetAux("XS", []uint16{1, 2})
+	a.SetAux("XF", float32(0.5))
+	// SetAux has no way to write a B:C array, which decodes to a []byte
+	// like an H string
+	a.aux = append(a.aux, "XBBC\x02\x00\x00\x00\x01\x02"...)
+	_, recs := readTestBAM(t, writeTestBAM(t, testHeader(testRefs), testRefs, []*Alignment{a}))
+
+	tests := map[string]string{
+		"XA": "XA:i:120",
+		"XH": "XH:H:1AFF",
+		"XS": "XS:B:S,1,2",
+		"XF": "XF:f:0.5",
+		"XB": "XB:B:C,1,2",
+	}
+	for tag, want := range tests {
+		if got, _ := recs[0].samAux(tag); got != want {
+			t.Errorf("samAux(%s) = %q, want %q", tag, got, want)
+		}
+	}
+}
@@ -0,0 +1,564 @@
+package bam
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A Filter is a compiled expression that selects alignments, in the
+// style of samtools' -e filter expressions. For example:
+//
+//	mapq >= 30 && !flag.duplicate && [NM] <= 3 && rname =~ "^chr[0-9]+$"
+//
+// Expressions combine numbers, "strings" and the values below with
+// ||, &&, !, the comparisons == != < <= > >=, regular expression
+// matches =~ and !~ (against a string literal), + - * / % and the bitwise
+// & and |. Go operator precedence applies.
+//
+// Record values: qname, flag, rname, refid, pos (1-based), endpos, mapq,
+// cigar, mrname, mrefid, mpos, tlen, qlen, rlen, seq and the flag bits
+// flag.paired, flag.proper_pair, flag.unmap, flag.munmap, flag.reverse,
+// flag.mreverse, flag.read1, flag.read2, flag.secondary, flag.qcfail,
+// flag.dup (or flag.duplicate) and flag.supplementary. An aux tag is
+// written [NM]. A missing tag is null: it is false on its own and makes
+// any comparison false.
+type Filter struct {
+	expr string
+	refs []Reference
+	eval func(*Alignment) filterValue
+}
+
+// CompileFilter parses a filter expression. The references are used to
+// look up rname and mrname.
+func CompileFilter(expr string, refs []Reference) (*Filter, error) {
+	f := &Filter{expr: expr, refs: refs}
+	p := &filterParser{f: f, src: expr}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	eval, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.tok.kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.tok.text)
+	}
+	f.eval = eval
+	return f, nil
+}
+
+// Match returns true if the expression is true for the alignment.
+func (f *Filter) Match(a *Alignment) bool {
+	return f.eval(a).truth()
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// GetFilteredMap returns an alignment of the region like GetMap, with only
+// the reads matching the filter. A nil filter keeps every read.
+func (b *AlignmentMap) GetFilteredMap(refID int32, beginPos, endPos uint64, filter *Filter) []string {
+	if filter == nil {
+		return b.getMap(refID, beginPos, endPos, nil)
+	}
+	return b.getMap(refID, beginPos, endPos, filter.Match)
+}
+
+type filterKind uint8
+
+const (
+	valNull filterKind = iota
+	valNum
+	valStr
+)
+
+type filterValue struct {
+	kind filterKind
+	n    float64
+	s    string
+}
+
+var nullValue = filterValue{}
+
+func numValue(n float64) filterValue { return filterValue{kind: valNum, n: n} }
+func strValue(s string) filterValue  { return filterValue{kind: valStr, s: s} }
+
+func boolValue(b bool) filterValue {
+	if b {
+		return numValue(1)
+	}
+	return numValue(0)
+}
+
+func (v filterValue) truth() bool {
+	switch v.kind {
+	case valNum:
+		return v.n != 0
+	case valStr:
+		return v.s != ""
+	}
+	return false
+}
+
+// filter expression tokens
+const (
+	tokEOF = iota
+	tokNum
+	tokStr
+	tokIdent
+	tokTag
+	tokOp
+)
+
+type filterToken struct {
+	kind int
+	text string
+	num  float64
+	pos  int
+}
+
+type filterParser struct {
+	f   *Filter
+	src string
+	off int
+	tok filterToken
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("bam: filter at offset %d: %s", p.tok.pos, fmt.Sprintf(format, args...))
+}
+
+var filterOps = []string{"||", "&&", "==", "!=", "<=", ">=", "=~", "!~", "<", ">", "!", "+", "-", "*", "/", "%", "&", "|", "(", ")"}
+
+// next reads the next token.
+func (p *filterParser) next() error {
+	for p.off < len(p.src) && strings.IndexByte(" \t\r\n", p.src[p.off]) >= 0 {
+		p.off++
+	}
+	p.tok = filterToken{pos: p.off}
+	if p.off >= len(p.src) {
+		p.tok.kind = tokEOF
+		return nil
+	}
+	s := p.src[p.off:]
+	c := s[0]
+	switch {
+	case c >= '0' && c <= '9' || c == '.':
+		n := 1
+		for n < len(s) && (isIdentChar(s[n]) || s[n] == '.') {
+			n++
+			// a signed exponent, as in 1e-3, but not in hex 0xe
+			if n+1 < len(s) && (s[n-1] == 'e' || s[n-1] == 'E') && (s[n] == '+' || s[n] == '-') &&
+				s[n+1] >= '0' && s[n+1] <= '9' && !strings.HasPrefix(strings.ToLower(s), "0x") {
+				n++
+			}
+		}
+		text := s[:n]
+		v, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			i, ierr := strconv.ParseInt(text, 0, 64)
+			if ierr != nil {
+				return p.errorf("invalid number %q", text)
+			}
+			v = float64(i)
+		}
+		p.tok.kind, p.tok.text, p.tok.num = tokNum, text, v
+		p.off += n
+
+	case c == '"' || c == '\'':
+		n := 1
+		for n < len(s) && s[n] != c {
+			if s[n] == '\\' {
+				n++
+			}
+			n++
+		}
+		if n >= len(s) {
+			return p.errorf("unterminated string")
+		}
+		text := s[1:n]
+		if c == '"' {
+			u, err := strconv.Unquote(s[:n+1])
+			if err != nil {
+				return p.errorf("invalid string %s", s[:n+1])
+			}
+			text = u
+		}
+		p.tok.kind, p.tok.text = tokStr, text
+		p.off += n + 1
+
+	case c == '[':
+		end := strings.IndexByte(s, ']')
+		if end != 3 {
+			return p.errorf("invalid aux tag")
+		}
+		p.tok.kind, p.tok.text = tokTag, s[1:3]
+		p.off += 4
+
+	case isIdentChar(c):
+		n := 1
+		for n < len(s) && (isIdentChar(s[n]) || s[n] == '.') {
+			n++
+		}
+		p.tok.kind, p.tok.text = tokIdent, s[:n]
+		p.off += n
+
+	default:
+		for _, op := range filterOps {
+			if strings.HasPrefix(s, op) {
+				p.tok.kind, p.tok.text = tokOp, op
+				p.off += len(op)
+				return nil
+			}
+		}
+		return p.errorf("unexpected %q", s[:1])
+	}
+	return nil
+}
+
+func isIdentChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// isOp returns true if the current token is one of the operators.
+func (p *filterParser) isOp(ops ...string) bool {
+	if p.tok.kind != tokOp {
+		return false
+	}
+	for _, op := range ops {
+		if p.tok.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+type evalFunc = func(*Alignment) filterValue
+
+func (p *filterParser) parseOr() (evalFunc, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.isOp("||") {
+		if err = p.next(); err != nil {
+			break
+		}
+		var y evalFunc
+		if y, err = p.parseAnd(); err != nil {
+			break
+		}
+		l := x
+		x = func(a *Alignment) filterValue { return boolValue(l(a).truth() || y(a).truth()) }
+	}
+	return x, err
+}
+
+func (p *filterParser) parseAnd() (evalFunc, error) {
+	x, err := p.parseCompare()
+	for err == nil && p.isOp("&&") {
+		if err = p.next(); err != nil {
+			break
+		}
+		var y evalFunc
+		if y, err = p.parseCompare(); err != nil {
+			break
+		}
+		l := x
+		x = func(a *Alignment) filterValue { return boolValue(l(a).truth() && y(a).truth()) }
+	}
+	return x, err
+}
+
+func (p *filterParser) parseCompare() (evalFunc, error) {
+	x, err := p.parseBinary(0)
+	if err != nil || !p.isOp("==", "!=", "<", "<=", ">", ">=", "=~", "!~") {
+		return x, err
+	}
+	op := p.tok.text
+	if err = p.next(); err != nil {
+		return nil, err
+	}
+
+	if op == "=~" || op == "!~" {
+		if p.tok.kind != tokStr {
+			return nil, p.errorf("%s needs a string literal regular expression", op)
+		}
+		re, err := regexp.Compile(p.tok.text)
+		if err != nil {
+			return nil, p.errorf("%v", err)
+		}
+		if err = p.next(); err != nil {
+			return nil, err
+		}
+		want := op == "=~"
+		return func(a *Alignment) filterValue {
+			v := x(a)
+			switch v.kind {
+			case valNull:
+				return boolValue(false)
+			case valNum:
+				return boolValue(re.MatchString(strconv.FormatFloat(v.n, 'f', -1, 64)) == want)
+			}
+			return boolValue(re.MatchString(v.s) == want)
+		}, nil
+	}
+
+	y, err := p.parseBinary(0)
+	if err != nil {
+		return nil, err
+	}
+	return func(a *Alignment) filterValue {
+		l, r := x(a), y(a)
+		if l.kind == valNull || r.kind == valNull {
+			return boolValue(false)
+		}
+		var c int
+		if l.kind == valNum && r.kind == valNum {
+			switch {
+			case l.n < r.n:
+				c = -1
+			case l.n > r.n:
+				c = 1
+			}
+		} else {
+			c = strings.Compare(l.string(), r.string())
+		}
+		switch op {
+		case "==":
+			return boolValue(c == 0)
+		case "!=":
+			return boolValue(c != 0)
+		case "<":
+			return boolValue(c < 0)
+		case "<=":
+			return boolValue(c <= 0)
+		case ">":
+			return boolValue(c > 0)
+		}
+		return boolValue(c >= 0)
+	}, nil
+}
+
+func (v filterValue) string() string {
+	if v.kind == valNum {
+		return strconv.FormatFloat(v.n, 'f', -1, 64)
+	}
+	return v.s
+}
+
+// binary operators by precedence level, lowest first
+var filterLevels = [][]string{{"+", "-", "|"}, {"*", "/", "%", "&"}}
+
+func (p *filterParser) parseBinary(level int) (evalFunc, error) {
+	if level == len(filterLevels) {
+		return p.parseUnary()
+	}
+	x, err := p.parseBinary(level + 1)
+	for err == nil && p.isOp(filterLevels[level]...) {
+		op := p.tok.text
+		if err = p.next(); err != nil {
+			break
+		}
+		var y evalFunc
+		if y, err = p.parseBinary(level + 1); err != nil {
+			break
+		}
+		x = arith(op, x, y)
+	}
+	return x, err
+}
+
+func arith(op string, x, y evalFunc) evalFunc {
+	return func(a *Alignment) filterValue {
+		l, r := x(a), y(a)
+		if l.kind != valNum || r.kind != valNum {
+			return nullValue
+		}
+		switch op {
+		case "+":
+			return numValue(l.n + r.n)
+		case "-":
+			return numValue(l.n - r.n)
+		case "*":
+			return numValue(l.n * r.n)
+		case "/":
+			if r.n == 0 {
+				return nullValue
+			}
+			return numValue(l.n / r.n)
+		case "%":
+			if r.n == 0 {
+				return nullValue
+			}
+			return numValue(math.Mod(l.n, r.n))
+		case "&":
+			return numValue(float64(int64(l.n) & int64(r.n)))
+		}
+		return numValue(float64(int64(l.n) | int64(r.n)))
+	}
+}
+
+func (p *filterParser) parseUnary() (evalFunc, error) {
+	if p.isOp("!", "-") {
+		op := p.tok.text
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if op == "!" {
+			return func(a *Alignment) filterValue { return boolValue(!x(a).truth()) }, nil
+		}
+		return func(a *Alignment) filterValue {
+			v := x(a)
+			if v.kind != valNum {
+				return nullValue
+			}
+			return numValue(-v.n)
+		}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *filterParser) parsePrimary() (evalFunc, error) {
+	tok := p.tok
+	switch tok.kind {
+	case tokNum:
+		v := numValue(tok.num)
+		return func(*Alignment) filterValue { return v }, p.next()
+	case tokStr:
+		v := strValue(tok.text)
+		return func(*Alignment) filterValue { return v }, p.next()
+	case tokTag:
+		tag := tok.text
+		return func(a *Alignment) filterValue { return a.auxValue(tag) }, p.next()
+	case tokIdent:
+		get, ok := p.field(tok.text)
+		if !ok {
+			return nil, p.errorf("unknown value %q", tok.text)
+		}
+		return get, p.next()
+	}
+	if p.isOp("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.isOp(")") {
+			return nil, p.errorf("missing )")
+		}
+		return x, p.next()
+	}
+	if tok.kind == tokEOF {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	return nil, p.errorf("unexpected %q", tok.text)
+}
+
+var filterFlagNames = map[string]uint16{
+	"paired":        FlagPaired,
+	"proper_pair":   FlagProperPair,
+	"unmap":         FlagUnmapped,
+	"munmap":        FlagMateUnmapped,
+	"reverse":       FlagReverse,
+	"mreverse":      FlagMateReverse,
+	"read1":         FlagRead1,
+	"read2":         FlagRead2,
+	"secondary":     FlagSecondary,
+	"qcfail":        FlagQCFail,
+	"dup":           FlagDuplicate,
+	"duplicate":     FlagDuplicate,
+	"supplementary": FlagSupplementary,
+}
+
+// field returns the function getting a named record value.
+func (p *filterParser) field(name string) (evalFunc, bool) {
+	refs := p.f.refs
+	refName := func(id int32) filterValue {
+		if id < 0 || int(id) >= len(refs) {
+			return strValue("*")
+		}
+		return strValue(refs[id].Name)
+	}
+
+	if strings.HasPrefix(name, "flag.") {
+		bit, ok := filterFlagNames[name[5:]]
+		return func(a *Alignment) filterValue { return boolValue(a.flag&bit != 0) }, ok
+	}
+	var get evalFunc
+	switch name {
+	case "qname":
+		get = func(a *Alignment) filterValue { return strValue(a.ReadName) }
+	case "flag":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.flag)) }
+	case "rname":
+		get = func(a *Alignment) filterValue { return refName(a.refID) }
+	case "refid":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.refID)) }
+	case "pos":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.pos) + 1) }
+	case "endpos":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.End())) }
+	case "mapq":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.mapq)) }
+	case "cigar":
+		get = func(a *Alignment) filterValue { return strValue(a.CigarString()) }
+	case "mrname":
+		get = func(a *Alignment) filterValue { return refName(a.nextRefID) }
+	case "mrefid":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.nextRefID)) }
+	case "mpos":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.nextPos) + 1) }
+	case "tlen":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.tlen)) }
+	case "qlen":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.seqLen)) }
+	case "rlen":
+		get = func(a *Alignment) filterValue { return numValue(float64(a.End() - a.pos)) }
+	case "seq":
+		get = func(a *Alignment) filterValue { return strValue(a.Sequence()) }
+	default:
+		return nil, false
+	}
+	return get, true
+}
+
+// auxValue returns an aux tag as a filter value.
+func (a *Alignment) auxValue(tag string) filterValue {
+	v, ok := a.AuxData[tag]
+	if !ok {
+		return nullValue
+	}
+	switch x := v.(type) {
+	case string:
+		return strValue(x)
+	case uint8:
+		if a.auxType(tag) == 'A' {
+			return strValue(string(rune(x)))
+		}
+		return numValue(float64(x))
+	case int8:
+		return numValue(float64(x))
+	case int16:
+		return numValue(float64(x))
+	case uint16:
+		return numValue(float64(x))
+	case int32:
+		return numValue(float64(x))
+	case uint32:
+		return numValue(float64(x))
+	case float32:
+		return numValue(float64(x))
+	case []byte:
+		return strValue(fmt.Sprintf("%X", x))
+	}
+	// arrays are only tested for presence
+	return numValue(1)
+}
@@ -0,0 +1,85 @@
+package bam
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFilter(t *testing.T) {
+	a := newTestRecord("read7", 1, 99, FlagPaired|FlagRead1|FlagDuplicate, "5S20M", "ACGTACGTACGTACGTACGTACGTA").setMate(0, 500, -300)
+	a.mapq = 37
+	a.SetAux("NM", int8(2))
+	a.SetAux("XS", float32(0.0005))
+	a.SetAux("RG", "grp1")
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`mapq >= 30 && !flag.duplicate && [NM] <= 3`, false},
+		{`mapq >= 30 && flag.dup && [NM] <= 3 && rname =~ "^chr[0-9]+$"`, true},
+		{`rname == "chr2" && mrname == "chr1" && refid == 1 && mrefid == 0`, true},
+		{`pos == 100 && endpos == 119 && mpos == 501 && tlen == -300`, true},
+		{`qlen == 25 && rlen == 20 && cigar == "5S20M"`, true},
+		{`qname =~ "^read[0-9]$" && qname !~ "^read1"`, true},
+		{`flag & 0x40 && flag == 1089`, true},
+		{`[RG] == "grp1" && [XX] != 1`, false}, // a missing tag is null
+		{`![XX]`, true},
+		{`(mapq + 3) / 4 == 10 && mapq % 10 == 7 && -mapq < 0`, true},
+		{`[XS] < 1e-3 && [XS] > 5e-5 && [XS] < 1E+0 && 2.5e1 == 25`, true},
+		{`0x1e == 30 && 1e3 == 1000`, true},
+		{`mapq > 1 / 0`, false},
+		{`flag.read2 || flag.paired && !flag.secondary`, true},
+	}
+	for _, tc := range tests {
+		f, err := CompileFilter(tc.expr, testRefs)
+		if err != nil {
+			t.Errorf("CompileFilter(%q): %v", tc.expr, err)
+			continue
+		}
+		if got := f.Match(a); got != tc.want {
+			t.Errorf("%q = %v, want %v", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestFilterErrors(t *testing.T) {
+	for _, expr := range []string{
+		`mapq >=`,
+		`mapq > 30 )`,
+		`(mapq > 30`,
+		`nosuchfield == 1`,
+		`flag.nosuchflag`,
+		`qname =~ qname`,
+		`qname =~ "("`,
+		`"unterminated`,
+		`1e-`,
+	} {
+		if _, err := CompileFilter(expr, testRefs); err == nil {
+			t.Errorf("CompileFilter(%q) succeeded", expr)
+		}
+	}
+}
+
+func TestGetFilteredMap(t *testing.T) {
+	filename := writeTestFiles(t, "filteredmap", manyTestRecords(2000), true)
+	b := loadTestFile(t, filename, nil)
+	f, err := CompileFilter("flag.reverse", b.References)
+	if err != nil {
+		t.Fatal(err)
+	}
+	all := b.GetMap(0, 1000, 1200)
+	if got := b.GetFilteredMap(0, 1000, 1200, nil); !reflect.DeepEqual(got, all) {
+		t.Errorf("a nil filter kept %d of %d rows", len(got), len(all))
+	}
+	rev := b.GetFilteredMap(0, 1000, 1200, f)
+	want := 0
+	for _, a := range collect(t, b.mapFetch(0, 1000, 1200)) {
+		if a.Flag()&FlagReverse != 0 {
+			want++
+		}
+	}
+	if len(rev) != want || want == 0 || want == len(all) {
+		t.Errorf("filtered map has %d of %d rows, want %d", len(rev), len(all), want)
+	}
+}
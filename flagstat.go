@@ -0,0 +1,184 @@
+package bam
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// FlagStatCounts are the flagstat counts of either the QC-passed or the
+// QC-failed reads. They follow samtools flagstat: the pairing counts only
+// include primary alignments.
+type FlagStatCounts struct {
+	Total             uint64 `json:"total"`
+	Primary           uint64 `json:"primary"`
+	Secondary         uint64 `json:"secondary"`
+	Supplementary     uint64 `json:"supplementary"`
+	Duplicates        uint64 `json:"duplicates"`
+	PrimaryDuplicates uint64 `json:"primary duplicates"`
+	Mapped            uint64 `json:"mapped"`
+	PrimaryMapped     uint64 `json:"primary mapped"`
+	Paired            uint64 `json:"paired in sequencing"`
+	Read1             uint64 `json:"read1"`
+	Read2             uint64 `json:"read2"`
+	ProperlyPaired    uint64 `json:"properly paired"`
+	BothMapped        uint64 `json:"with itself and mate mapped"`
+	Singletons        uint64 `json:"singletons"`
+	MateDiffChr       uint64 `json:"with mate mapped to a different chr"`
+	MateDiffChrMapQ5  uint64 `json:"with mate mapped to a different chr (mapQ >= 5)"`
+}
+
+// A FlagStat accumulates samtools flagstat style counts over alignments.
+// The zero value is ready to use.
+type FlagStat struct {
+	Passed FlagStatCounts `json:"QC-passed reads"`
+	Failed FlagStatCounts `json:"QC-failed reads"`
+}
+
+// FlagStat counts every alignment in the file.
+func (b *AlignmentMap) FlagStat() (*FlagStat, error) {
+	s := &FlagStat{}
+	it := b.All()
+	for it.Next() {
+		s.Add(it.Record())
+	}
+	return s, it.Err()
+}
+
+// Add counts an alignment.
+func (s *FlagStat) Add(a *Alignment) {
+	c := &s.Passed
+	if a.flag&FlagQCFail != 0 {
+		c = &s.Failed
+	}
+	c.Total++
+	switch {
+	case a.flag&FlagSecondary != 0:
+		c.Secondary++
+	case a.flag&FlagSupplementary != 0:
+		c.Supplementary++
+	default:
+		c.Primary++
+		if a.flag&FlagPaired != 0 {
+			c.Paired++
+			if a.flag&FlagProperPair != 0 && a.flag&FlagUnmapped == 0 {
+				c.ProperlyPaired++
+			}
+			if a.flag&FlagRead1 != 0 {
+				c.Read1++
+			}
+			if a.flag&FlagRead2 != 0 {
+				c.Read2++
+			}
+			if a.flag&FlagMateUnmapped != 0 && a.flag&FlagUnmapped == 0 {
+				c.Singletons++
+			}
+			if a.flag&(FlagUnmapped|FlagMateUnmapped) == 0 {
+				c.BothMapped++
+				if a.nextRefID != a.refID {
+					c.MateDiffChr++
+					if a.mapq >= 5 {
+						c.MateDiffChrMapQ5++
+					}
+				}
+			}
+		}
+		if a.flag&FlagUnmapped == 0 {
+			c.PrimaryMapped++
+		}
+		if a.flag&FlagDuplicate != 0 {
+			c.PrimaryDuplicates++
+		}
+	}
+	if a.flag&FlagUnmapped == 0 {
+		c.Mapped++
+	}
+	if a.flag&FlagDuplicate != 0 {
+		c.Duplicates++
+	}
+}
+
+// Merge adds the counts of other to s.
+func (s *FlagStat) Merge(other *FlagStat) {
+	s.Passed.merge(&other.Passed)
+	s.Failed.merge(&other.Failed)
+}
+
+func (c *FlagStatCounts) merge(o *FlagStatCounts) {
+	c.Total += o.Total
+	c.Primary += o.Primary
+	c.Secondary += o.Secondary
+	c.Supplementary += o.Supplementary
+	c.Duplicates += o.Duplicates
+	c.PrimaryDuplicates += o.PrimaryDuplicates
+	c.Mapped += o.Mapped
+	c.PrimaryMapped += o.PrimaryMapped
+	c.Paired += o.Paired
+	c.Read1 += o.Read1
+	c.Read2 += o.Read2
+	c.ProperlyPaired += o.ProperlyPaired
+	c.BothMapped += o.BothMapped
+	c.Singletons += o.Singletons
+	c.MateDiffChr += o.MateDiffChr
+	c.MateDiffChrMapQ5 += o.MateDiffChrMapQ5
+}
+
+// percent returns n as a percentage of total, or nil if total is 0.
+func percent(n, total uint64) *float64 {
+	if total == 0 {
+		return nil
+	}
+	p := 100 * float64(n) / float64(total)
+	return &p
+}
+
+// MarshalJSON encodes the counts with the percentages added, using the
+// keys of samtools flagstat -O json.
+func (c FlagStatCounts) MarshalJSON() ([]byte, error) {
+	type counts FlagStatCounts
+	return json.Marshal(struct {
+		counts
+		MappedPct         *float64 `json:"mapped %"`
+		PrimaryMappedPct  *float64 `json:"primary mapped %"`
+		ProperlyPairedPct *float64 `json:"properly paired %"`
+		SingletonsPct     *float64 `json:"singletons %"`
+	}{
+		counts(c),
+		percent(c.Mapped, c.Total),
+		percent(c.PrimaryMapped, c.Primary),
+		percent(c.ProperlyPaired, c.Paired),
+		percent(c.Singletons, c.Paired),
+	})
+}
+
+// String formats the counts like the default samtools flagstat output.
+func (s *FlagStat) String() string {
+	p, f := &s.Passed, &s.Failed
+	pct := func(n, total uint64) string {
+		if v := percent(n, total); v != nil {
+			return fmt.Sprintf("%.2f%%", *v)
+		}
+		return "N/A"
+	}
+	var sb strings.Builder
+	line := func(a, b uint64, what string) {
+		fmt.Fprintf(&sb, "%d + %d %s\n", a, b, what)
+	}
+	line(p.Total, f.Total, "in total (QC-passed reads + QC-failed reads)")
+	line(p.Primary, f.Primary, "primary")
+	line(p.Secondary, f.Secondary, "secondary")
+	line(p.Supplementary, f.Supplementary, "supplementary")
+	line(p.Duplicates, f.Duplicates, "duplicates")
+	line(p.PrimaryDuplicates, f.PrimaryDuplicates, "primary duplicates")
+	line(p.Mapped, f.Mapped, "mapped ("+pct(p.Mapped, p.Total)+" : "+pct(f.Mapped, f.Total)+")")
+	line(p.PrimaryMapped, f.PrimaryMapped, "primary mapped ("+pct(p.PrimaryMapped, p.Primary)+" : "+pct(f.PrimaryMapped, f.Primary)+")")
+	line(p.Paired, f.Paired, "paired in sequencing")
+	line(p.Read1, f.Read1, "read1")
+	line(p.Read2, f.Read2, "read2")
+	line(p.ProperlyPaired, f.ProperlyPaired, "properly paired ("+pct(p.ProperlyPaired, p.Paired)+" : "+pct(f.ProperlyPaired, f.Paired)+")")
+	line(p.BothMapped, f.BothMapped, "with itself and mate mapped")
+	line(p.Singletons, f.Singletons, "singletons ("+pct(p.Singletons, p.Paired)+" : "+pct(f.Singletons, f.Paired)+")")
+	line(p.MateDiffChr, f.MateDiffChr, "with mate mapped to a different chr")
+	line(p.MateDiffChrMapQ5, f.MateDiffChrMapQ5, "with mate mapped to a different chr (mapQ>=5)")
+	return sb.String()
+}
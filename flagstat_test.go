@@ -0,0 +1,90 @@
+package bam
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// flagStatRecords covers each of the flagstat categories.
+func flagStatRecords() []*Alignment {
+	const seq = "ACGTACGTAC"
+	paired := uint16(FlagPaired)
+	lowQual := newTestRecord("r6", 0, 600, paired|FlagRead2, "10M", seq).setMate(1, 100, 0)
+	lowQual.mapq = 3
+	return []*Alignment{
+		newTestRecord("r1", 0, 100, paired|FlagProperPair|FlagRead1, "10M", seq).setMate(0, 200, 110),
+		newTestRecord("r2", 0, 200, paired|FlagProperPair|FlagRead2|FlagReverse, "10M", seq).setMate(0, 100, -110),
+		newTestRecord("r3", 0, 300, paired|FlagRead1|FlagMateUnmapped, "10M", seq).setMate(0, 300, 0),
+		newTestRecord("r4", 0, 300, paired|FlagRead2|FlagUnmapped, "*", seq).setMate(0, 300, 0),
+		newTestRecord("r5", 0, 500, paired|FlagRead1, "10M", seq).setMate(1, 100, 0),
+		lowQual,
+		newTestRecord("r7", 0, 700, FlagSecondary, "10M", seq),
+		newTestRecord("r8", 0, 800, FlagSupplementary, "10M", seq),
+		newTestRecord("r9", 0, 900, FlagDuplicate, "10M", seq),
+		newTestRecord("r10", 1, 100, FlagQCFail, "10M", seq),
+		newTestRecord("r11", -1, -1, FlagUnmapped, "*", seq),
+	}
+}
+
+const flagStatText = `10 + 1 in total (QC-passed reads + QC-failed reads)
+8 + 1 primary
+1 + 0 secondary
+1 + 0 supplementary
+1 + 0 duplicates
+1 + 0 primary duplicates
+8 + 1 mapped (80.00% : 100.00%)
+6 + 1 primary mapped (75.00% : 100.00%)
+6 + 0 paired in sequencing
+3 + 0 read1
+3 + 0 read2
+2 + 0 properly paired (33.33% : N/A)
+4 + 0 with itself and mate mapped
+1 + 0 singletons (16.67% : N/A)
+2 + 0 with mate mapped to a different chr
+1 + 0 with mate mapped to a different chr (mapQ>=5)
+`
+
+func TestFlagStat(t *testing.T) {
+	filename := writeTestFiles(t, "flagstat", flagStatRecords(), false)
+	b := loadTestFile(t, filename, nil)
+	s, err := b.FlagStat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := s.String(); got != flagStatText {
+		t.Errorf("got\n%s\nwant\n%s", got, flagStatText)
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed map[string]map[string]interface{}
+	if err = json.Unmarshal(data, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	passed, failed := parsed["QC-passed reads"], parsed["QC-failed reads"]
+	if passed["primary mapped"] != 6.0 || passed["mapped %"] != 80.0 || passed["with mate mapped to a different chr (mapQ >= 5)"] != 1.0 {
+		t.Errorf("wrong QC-passed JSON counts: %v", passed)
+	}
+	if failed["total"] != 1.0 || failed["properly paired %"] != nil {
+		t.Errorf("wrong QC-failed JSON counts: %v", failed)
+	}
+}
+
+func TestFlagStatMerge(t *testing.T) {
+	recs := flagStatRecords()
+	var all, first, second FlagStat
+	for i, a := range recs {
+		all.Add(a)
+		if i < len(recs)/2 {
+			first.Add(a)
+		} else {
+			second.Add(a)
+		}
+	}
+	first.Merge(&second)
+	if first != all {
+		t.Errorf("merged counts %+v, want %+v", first, all)
+	}
+}
@@ -0,0 +1,141 @@
+package bam
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Reheader renames the reference sequences to the given naming convention
+// (such as "ucsc" or "ensembl") using the aliases, in both References and
+// the @SQ lines of the Header. Names without an alias in that convention
+// are left unchanged. It returns the number of references renamed.
+func (b *AlignmentMap) Reheader(a *Aliases, convention string) int {
+	renamed := make(map[string]string)
+	for i, r := range b.References {
+		if n, ok := a.Convert(r.Name, convention); ok && n != r.Name {
+			renamed[r.Name] = n
+			b.References[i].Name = n
+		}
+	}
+	if len(renamed) == 0 {
+		return 0
+	}
+	b.Header = renameSQ(b.Header, renamed)
+
+	b.refMu.Lock()
+	b.refIDs = nil
+	b.refMu.Unlock()
+	return len(renamed)
+}
+
+// Copy writes the file to w with the current Header and References, such
+// as after Reheader. The alignments are never decoded: their compressed
+// blocks are copied through unchanged, except for any alignments sharing
+// a block with the old header, which are compressed again. When the file
+// is no longer open, the cached blocks are compressed again instead.
+//
+// The references may be renamed but must stay in the same order, as the
+// alignments refer to them by index.
+func (b *AlignmentMap) Copy(w io.Writer) error {
+	bw, err := NewWriter(w, b.Header, b.References)
+	if err != nil {
+		return err
+	}
+	pos, skip := b.firstOffset.Compressed(), int(b.firstOffset.Uncompressed())
+	for pos < b.size && (b.r == nil || skip > 0) {
+		data, bsize, err := b.block(pos)
+		if err != nil {
+			return err
+		}
+		if skip > len(data) {
+			return fmt.Errorf("bam: invalid offset of the first alignment")
+		}
+		bw.write(data[skip:])
+		pos, skip = pos+int64(bsize), 0
+	}
+	if b.r == nil {
+		return bw.Close()
+	}
+
+	// everything from here on, including the end-of-file marker, is
+	// copied as is
+	bw.flush()
+	if bw.err != nil {
+		return bw.err
+	}
+	_, err = io.Copy(w, io.NewSectionReader(b.r, pos, b.size-pos))
+	return err
+}
+
+// renameSQ replaces the SN: names of the @SQ lines of a SAM header.
+func renameSQ(header string, renamed map[string]string) string {
+	lines := strings.SplitAfter(header, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "@SQ\t") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		for j, f := range fields {
+			if !strings.HasPrefix(f, "SN:") {
+				continue
+			}
+			nl := ""
+			if strings.HasSuffix(f, "\n") {
+				f, nl = strings.TrimSuffix(f, "\n"), "\n"
+			}
+			if n, ok := renamed[f[3:]]; ok {
+				fields[j] = "SN:" + n + nl
+			}
+		}
+		lines[i] = strings.Join(fields, "\t")
+	}
+	return strings.Join(lines, "")
+}
+
+// setSortOrder sets the SO: field of the @HD line of a SAM header, adding
+// the @HD line if there is none.
+func setSortOrder(header, order string) string {
+	if !strings.HasPrefix(header, "@HD\t") {
+		return "@HD\tVN:1.6\tSO:" + order + "\n" + header
+	}
+	line, rest := header, ""
+	if i := strings.IndexByte(header, '\n'); i >= 0 {
+		line, rest = header[:i], header[i:]
+	}
+	fields := strings.Split(line, "\t")
+	found := false
+	for i, f := range fields {
+		if strings.HasPrefix(f, "SO:") {
+			fields[i] = "SO:" + order
+			found = true
+		}
+	}
+	if !found {
+		fields = append(fields, "SO:"+order)
+	}
+	return strings.Join(fields, "\t") + rest
+}
+
+// headerField returns the value of a TAG:value field of a header line.
+func headerField(line, tag string) (string, bool) {
+	for _, f := range strings.Split(strings.TrimSuffix(line, "\n"), "\t")[1:] {
+		if strings.HasPrefix(f, tag+":") {
+			return f[len(tag)+1:], true
+		}
+	}
+	return "", false
+}
+
+// setHeaderField replaces the value of a TAG:value field of a header
+// line, adding the field if it is missing.
+func setHeaderField(line, tag, value string) string {
+	fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+	for i, f := range fields[1:] {
+		if strings.HasPrefix(f, tag+":") {
+			fields[i+1] = tag + ":" + value
+			return strings.Join(fields, "\t")
+		}
+	}
+	return strings.Join(append(fields, tag+":"+value), "\t")
+}
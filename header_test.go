@@ -0,0 +1,110 @@
+package bam
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSharedBlockBAM writes a BAM file whose first alignments share a
+// block with the header, as samtools writes them.
+func writeSharedBlockBAM(t *testing.T, header string, refs []Reference, recs []*Alignment) []byte {
+	var buf bytes.Buffer
+	bw, err := newBlockWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	le := binary.LittleEndian
+	h := []byte{'B', 'A', 'M', 1}
+	h = le.AppendUint32(h, uint32(len(header)))
+	h = append(h, header...)
+	h = le.AppendUint32(h, uint32(len(refs)))
+	for _, r := range refs {
+		h = le.AppendUint32(h, uint32(len(r.Name)+1))
+		h = append(h, r.Name...)
+		h = append(h, 0)
+		h = le.AppendUint32(h, uint32(r.Length))
+	}
+	bw.write(h)
+	for _, a := range recs {
+		bw.Write(a)
+	}
+	if err = bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReheaderCopy(t *testing.T) {
+	recs := manyTestRecords(3000)
+	header := testHeader(testRefs)
+	files := map[string][]byte{
+		"fresh block":  writeTestBAM(t, header, testRefs, recs),
+		"shared block": writeSharedBlockBAM(t, header, testRefs, recs),
+	}
+	for name, data := range files {
+		filename := filepath.Join(t.TempDir(), "in.bam")
+		if err := os.WriteFile(filename, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		for _, partial := range []bool{false, true} {
+			b := loadTestFile(t, filename, nil)
+			if partial {
+				b.Close()
+				b = loadTestFile(t, filename, &Options{Cache: NewBlockCache(1 << 20)})
+				if b.r == nil {
+					t.Fatal("file with its own cache was closed")
+				}
+			} else if b.r != nil {
+				t.Fatal("fully loaded file was left open")
+			}
+
+			if n := b.Reheader(HumanAliases(), "ensembl"); n != 2 {
+				t.Errorf("%s: renamed %d references, want 2", name, n)
+			}
+			var out bytes.Buffer
+			if err := b.Copy(&out); err != nil {
+				t.Fatal(err)
+			}
+
+			c, got := readTestBAM(t, out.Bytes())
+			if c.References[0].Name != "1" || c.References[1].Name != "2" {
+				t.Errorf("%s: references are %v after reheader", name, c.References)
+			}
+			if !strings.Contains(c.Header, "@SQ\tSN:1\tLN:1000000\n") {
+				t.Errorf("%s: header wasn't renamed:\n%s", name, c.Header)
+			}
+			if len(got) != len(recs) {
+				t.Fatalf("%s: copied %d alignments, want %d", name, len(got), len(recs))
+			}
+			for i, a := range got {
+				if !bytes.Equal(a.marshal(nil), recs[i].marshal(nil)) {
+					t.Fatalf("%s: alignment %d changed in the copy", name, i)
+				}
+			}
+
+			// blocks after the header are copied through unchanged
+			rest := data[b.firstOffset.Compressed():]
+			if b.firstOffset.Uncompressed() == 0 && b.r != nil && !bytes.HasSuffix(out.Bytes(), rest) {
+				t.Errorf("%s: alignment blocks were compressed again", name)
+			}
+		}
+	}
+}
+
+func TestSetSortOrder(t *testing.T) {
+	tests := map[string]string{
+		"@HD\tVN:1.6\tSO:unsorted\n@SQ\tSN:a\tLN:1\n": "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:a\tLN:1\n",
+		"@HD\tVN:1.6\n":     "@HD\tVN:1.6\tSO:coordinate\n",
+		"@SQ\tSN:a\tLN:1\n": "@HD\tVN:1.6\tSO:coordinate\n@SQ\tSN:a\tLN:1\n",
+	}
+	for in, want := range tests {
+		if got := setSortOrder(in, "coordinate"); got != want {
+			t.Errorf("setSortOrder(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,276 @@
+package bam
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var testRefs = []Reference{{Name: "chr1", Length: 1000000}, {Name: "chr2", Length: 500000}}
+
+// testHeader returns a SAM header with @SQ lines for the references.
+func testHeader(refs []Reference, extra ...string) string {
+	var sb strings.Builder
+	sb.WriteString("@HD\tVN:1.6\tSO:coordinate\n")
+	for _, r := range refs {
+		fmt.Fprintf(&sb, "@SQ\tSN:%s\tLN:%d\n", r.Name, r.Length)
+	}
+	for _, line := range extra {
+		sb.WriteString(line + "\n")
+	}
+	return sb.String()
+}
+
+// newTestRecord builds an alignment from SAM-like fields. A seq of "*"
+// gives a record without bases, and every base has quality 30.
+func newTestRecord(name string, refID, pos int32, flag uint16, cigar, seq string) *Alignment {
+	a := &Alignment{
+		refID:     refID,
+		pos:       pos,
+		mapq:      60,
+		flag:      flag,
+		nextRefID: -1,
+		nextPos:   -1,
+		ReadName:  name,
+		AuxData:   make(map[string]interface{}),
+	}
+	for cigar != "" && cigar != "*" {
+		i := strings.IndexAny(cigar, cigarChars)
+		n, _ := strconv.Atoi(cigar[:i])
+		a.cigarPacked = append(a.cigarPacked, uint32(n)<<4|uint32(strings.IndexByte(cigarChars, cigar[i])))
+		cigar = cigar[i+1:]
+	}
+	if seq == "*" {
+		seq = ""
+	}
+	a.seqLen = int32(len(seq))
+	a.seqPacked = make([]byte, (len(seq)+1)/2)
+	for i := 0; i < len(seq); i++ {
+		code := byte(strings.IndexByte("=ACMGRSVTWYHKDBN", seq[i]))
+		if i%2 == 0 {
+			code <<= 4
+		}
+		a.seqPacked[i/2] |= code
+	}
+	a.qual = strings.Repeat("\x1e", len(seq))
+	a.bin = a.computeBin()
+	return a
+}
+
+// setMate fills in the mate fields of a paired record.
+func (a *Alignment) setMate(refID, pos, tlen int32) *Alignment {
+	a.nextRefID, a.nextPos, a.tlen = refID, pos, tlen
+	return a
+}
+
+// manyTestRecords returns n sorted 100bp reads spread over both test
+// references, enough to fill several BGZF blocks.
+func manyTestRecords(n int) []*Alignment {
+	const bases = "ACGTTGCAAC"
+	seq := strings.Repeat(bases, 10)
+	var recs []*Alignment
+	for i := 0; i < n; i++ {
+		refID := int32(0)
+		pos := int32(i * 37)
+		if i >= n/2 {
+			refID, pos = 1, int32((i-n/2)*53)
+		}
+		flag := uint16(0)
+		if i%3 == 0 {
+			flag = FlagReverse
+		}
+		recs = append(recs, newTestRecord(fmt.Sprintf("read%d", i), refID, pos, flag, "50M2D50M", seq))
+	}
+	return recs
+}
+
+// writeTestBAM encodes the alignments as a BAM file.
+func writeTestBAM(t testing.TB, header string, refs []Reference, recs []*Alignment) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, header, refs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range recs {
+		if err = w.Write(a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// buildTestBAI indexes a coordinate sorted BAM file the way samtools
+// does, including the pseudo-bins and the n_no_coor trailer.
+func buildTestBAI(t testing.TB, data []byte) []byte {
+	t.Helper()
+	b, err := open(bytes.NewReader(data), int64(len(data)), &Options{Cache: newMapCache(0)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type refIndex struct {
+		bins      map[uint32][]Chunk
+		order     []uint32
+		intervals []Offset
+		span      Chunk
+		mapped    uint64
+		unmapped  uint64
+	}
+	refs := make([]refIndex, len(b.References))
+	var noCoor uint64
+
+	begin := b.firstOffset
+	it := b.All()
+	for it.Next() {
+		a := it.Record()
+		end := it.offset()
+		if a.refID < 0 {
+			noCoor++
+			begin = end
+			continue
+		}
+		r := &refs[a.refID]
+		if r.bins == nil {
+			r.bins = make(map[uint32][]Chunk)
+			r.span.Begin = begin
+		}
+		r.span.End = end
+		if a.flag&FlagUnmapped != 0 {
+			r.unmapped++
+		} else {
+			r.mapped++
+		}
+
+		bin := uint32(a.computeBin())
+		cs := r.bins[bin]
+		if n := len(cs); n > 0 && cs[n-1].End == begin {
+			cs[n-1].End = end
+		} else {
+			if cs == nil {
+				r.order = append(r.order, bin)
+			}
+			cs = append(cs, Chunk{begin, end})
+		}
+		r.bins[bin] = cs
+
+		for w := int(a.pos >> 14); w <= int((a.End()-1)>>14); w++ {
+			for len(r.intervals) <= w {
+				r.intervals = append(r.intervals, 0)
+			}
+			if r.intervals[w] == 0 {
+				r.intervals[w] = begin
+			}
+		}
+		begin = end
+	}
+	if err = it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	le := binary.LittleEndian
+	out := []byte{'B', 'A', 'I', 1}
+	out = le.AppendUint32(out, uint32(len(refs)))
+	for _, r := range refs {
+		if r.bins == nil {
+			out = le.AppendUint32(out, 0)
+			out = le.AppendUint32(out, 0)
+			continue
+		}
+		out = le.AppendUint32(out, uint32(len(r.order)+1))
+		for _, bin := range r.order {
+			out = le.AppendUint32(out, bin)
+			out = le.AppendUint32(out, uint32(len(r.bins[bin])))
+			for _, c := range r.bins[bin] {
+				out = le.AppendUint64(out, uint64(c.Begin))
+				out = le.AppendUint64(out, uint64(c.End))
+			}
+		}
+		out = le.AppendUint32(out, 37450)
+		out = le.AppendUint32(out, 2)
+		out = le.AppendUint64(out, uint64(r.span.Begin))
+		out = le.AppendUint64(out, uint64(r.span.End))
+		out = le.AppendUint64(out, r.mapped)
+		out = le.AppendUint64(out, r.unmapped)
+
+		// samtools carries the previous offset into empty windows
+		for i := 1; i < len(r.intervals); i++ {
+			if r.intervals[i] == 0 {
+				r.intervals[i] = r.intervals[i-1]
+			}
+		}
+		out = le.AppendUint32(out, uint32(len(r.intervals)))
+		for _, o := range r.intervals {
+			out = le.AppendUint64(out, uint64(o))
+		}
+	}
+	return le.AppendUint64(out, noCoor)
+}
+
+// writeTestFiles writes the alignments to name.bam, with a .bai index
+// when indexed is set, in a temporary directory and returns its path.
+func writeTestFiles(t testing.TB, name string, recs []*Alignment, indexed bool) string {
+	t.Helper()
+	data := writeTestBAM(t, testHeader(testRefs), testRefs, recs)
+	filename := filepath.Join(t.TempDir(), name+".bam")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if indexed {
+		if err := os.WriteFile(filename+".bai", buildTestBAI(t, data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filename
+}
+
+// loadTestFile loads a file written by writeTestFiles.
+func loadTestFile(t testing.TB, filename string, opts *Options) *AlignmentMap {
+	t.Helper()
+	b, err := LoadWithOptions(filename, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { b.Close() })
+	return b
+}
+
+// readTestBAM decodes every alignment of an in-memory BAM file.
+func readTestBAM(t testing.TB, data []byte) (*AlignmentMap, []*Alignment) {
+	t.Helper()
+	b, err := open(bytes.NewReader(data), int64(len(data)), &Options{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b, b.Alignments
+}
+
+// names lists the read names of the alignments.
+func names(recs []*Alignment) []string {
+	var res []string
+	for _, a := range recs {
+		res = append(res, a.ReadName)
+	}
+	return res
+}
+
+// collect reads every record of an Iterator.
+func collect(t testing.TB, it *Iterator) []*Alignment {
+	t.Helper()
+	var res []*Alignment
+	for it.Next() {
+		res = append(res, it.Record())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
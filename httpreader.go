@@ -0,0 +1,188 @@
+package bam
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultReadAhead is the minimum number of bytes fetched by each request
+// of an HTTPReaderAt. BGZF blocks are at most 64KB, so this covers a
+// handful of neighbouring blocks per round trip.
+var DefaultReadAhead = 256 * 1024
+
+// httpWindows is the number of recently fetched ranges kept for reuse.
+const httpWindows = 4
+
+// An HTTPReaderAt reads a remote file using HTTP Range requests.
+// It is safe for concurrent use.
+type HTTPReaderAt struct {
+	url     string
+	client  *http.Client
+	size    int64
+	version string // ETag or Last-Modified, to tell revisions apart
+
+	// ReadAhead is the minimum number of bytes fetched per request.
+	ReadAhead int
+
+	mu      sync.Mutex
+	windows []httpWindow // most recently used first
+}
+
+type httpWindow struct {
+	off  int64
+	data []byte
+}
+
+// NewHTTPReaderAt prepares to read the file at url, which must be served
+// by a server supporting Range requests. A nil client uses
+// http.DefaultClient.
+func NewHTTPReaderAt(url string, client *http.Client) (*HTTPReaderAt, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	h := &HTTPReaderAt{
+		url:       url,
+		client:    client,
+		ReadAhead: DefaultReadAhead,
+	}
+
+	// a 1-byte range reports the full size in Content-Range
+	resp, err := h.get(0, 1)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	h.version = resp.Header.Get("ETag")
+	if h.version == "" {
+		h.version = resp.Header.Get("Last-Modified")
+	}
+	cr := resp.Header.Get("Content-Range")
+	i := strings.LastIndexByte(cr, '/')
+	if i < 0 {
+		return nil, fmt.Errorf("bam: missing Content-Range from %s", url)
+	}
+	h.size, err = strconv.ParseInt(cr[i+1:], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bam: invalid Content-Range '%s' from %s", cr, url)
+	}
+	return h, nil
+}
+
+// Size returns the size of the remote file.
+func (h *HTTPReaderAt) Size() int64 {
+	return h.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (h *HTTPReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= h.size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if off+want > h.size {
+		want = h.size - off
+	}
+
+	h.mu.Lock()
+	for i, w := range h.windows {
+		if off >= w.off && off+want <= w.off+int64(len(w.data)) {
+			copy(h.windows[1:i+1], h.windows[:i])
+			h.windows[0] = w
+			h.mu.Unlock()
+			return h.result(p, copy(p, w.data[off-w.off:]))
+		}
+	}
+	h.mu.Unlock()
+
+	n := want
+	if n < int64(h.ReadAhead) {
+		n = int64(h.ReadAhead)
+	}
+	if off+n > h.size {
+		n = h.size - off
+	}
+	resp, err := h.get(off, n)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	data := make([]byte, n)
+	if _, err = io.ReadFull(resp.Body, data); err != nil {
+		return 0, err
+	}
+
+	h.mu.Lock()
+	if len(h.windows) < httpWindows {
+		h.windows = append(h.windows, httpWindow{})
+	}
+	copy(h.windows[1:], h.windows)
+	h.windows[0] = httpWindow{off, data}
+	h.mu.Unlock()
+
+	return h.result(p, copy(p, data))
+}
+
+func (h *HTTPReaderAt) result(p []byte, n int) (int, error) {
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *HTTPReaderAt) get(off, n int64) (*http.Response, error) {
+	req, err := http.NewRequest("GET", h.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+n-1))
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("bam: range request to %s failed: %s", h.url, resp.Status)
+	}
+	return resp, nil
+}
+
+// OpenURL opens a remote BAM dataset and its ".bai" index over HTTP,
+// using the given options as with OpenReaderAt. Only the header and index
+// are fetched up front, queries then fetch just the blocks they need.
+func OpenURL(url string, opts *Options) (*AlignmentMap, error) {
+	h, err := NewHTTPReaderAt(url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.client.Get(url + ".bai")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bam: fetching index %s.bai failed: %s", url, resp.Status)
+	}
+	b, err := OpenReaderAt(h, h.Size(), resp.Body, opts)
+	if err != nil {
+		return nil, err
+	}
+	b.filename = url
+	return b, nil
+}
+
+// readers numbers the io.ReaderAts opened without a known identity.
+var readers uint64
+
+// readerIdentity names the file read through r. Readers that can't say
+// which file they read are never assumed to be the same file.
+func readerIdentity(r io.ReaderAt, size int64) string {
+	if h, ok := r.(*HTTPReaderAt); ok {
+		return fmt.Sprintf("%s:%d:%s", h.url, size, h.version)
+	}
+	return fmt.Sprintf("reader-%d:%d", atomic.AddUint64(&readers, 1), size)
+}
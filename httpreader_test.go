@@ -0,0 +1,147 @@
+package bam
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serveTestFiles serves the files by name with Range support, counting
+// the requests made.
+func serveTestFiles(t *testing.T, files map[string][]byte) (*httptest.Server, *int64) {
+	var requests int64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&requests, 1)
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(data))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestHTTPReaderAt(t *testing.T) {
+	data := make([]byte, 100000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	srv, requests := serveTestFiles(t, map[string][]byte{"/data": data})
+
+	h, err := NewHTTPReaderAt(srv.URL+"/data", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Size() != int64(len(data)) {
+		t.Fatalf("Size() = %d, want %d", h.Size(), len(data))
+	}
+	h.ReadAhead = 4096
+
+	p := make([]byte, 100)
+	for _, off := range []int64{0, 50, 3000, 99950} {
+		n, err := h.ReadAt(p, off)
+		want := data[off:]
+		if len(want) > len(p) {
+			want = want[:len(p)]
+		}
+		if n != len(want) || !bytes.Equal(p[:n], want) {
+			t.Errorf("ReadAt(%d) read %d bytes, want %d matching", off, n, len(want))
+		}
+		if n < len(p) && err != io.EOF {
+			t.Errorf("short ReadAt(%d) gave error %v, want io.EOF", off, err)
+		}
+	}
+	// the size probe, then 0 and 99950; 50 and 3000 are in the first window
+	if got := atomic.LoadInt64(requests); got != 3 {
+		t.Errorf("made %d requests, want 3", got)
+	}
+	if _, err = h.ReadAt(p, int64(len(data))); err != io.EOF {
+		t.Errorf("ReadAt past the end gave %v, want io.EOF", err)
+	}
+}
+
+func TestOpenURL(t *testing.T) {
+	recs := manyTestRecords(4000)
+	filename := writeTestFiles(t, "remote", recs, true)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := os.ReadFile(filename + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv, requests := serveTestFiles(t, map[string][]byte{"/x.bam": data, "/x.bam.bai": idx})
+
+	// smaller than the file, so that queries need more range requests
+	old := DefaultReadAhead
+	DefaultReadAhead = 8192
+	defer func() { DefaultReadAhead = old }()
+
+	b, err := OpenURL(srv.URL+"/x.bam", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if !reflect.DeepEqual(b.References, testRefs) {
+		t.Errorf("References = %v, want %v", b.References, testRefs)
+	}
+	opened := atomic.LoadInt64(requests)
+
+	got := names(collect(t, b.Fetch(1, 20000, 30000)))
+	if want := overlapping(recs, 1, 20000, 30000); !reflect.DeepEqual(got, want) {
+		t.Errorf("remote Fetch gave %d reads, want %d", len(got), len(want))
+	}
+	if atomic.LoadInt64(requests) == opened {
+		t.Error("query made no range requests")
+	}
+
+	if _, err = OpenURL(srv.URL+"/missing.bam", nil); err == nil {
+		t.Error("opening a missing URL succeeded")
+	}
+}
+
+func TestOpenReaderAtOptions(t *testing.T) {
+	filename := writeTestFiles(t, "readerat", manyTestRecords(2000), true)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := os.ReadFile(filename + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewBlockCache(1 << 20)
+	b, err := OpenReaderAt(bytes.NewReader(data), int64(len(data)), bytes.NewReader(idx), &Options{Cache: cache})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(t, b.Fetch(1, 0, 5000))
+	if cache.Stats().Bytes == 0 {
+		t.Error("OpenReaderAt didn't use Options.Cache")
+	}
+	b.Close()
+
+	c := withSharedCache(t, 1<<20)
+	b, err = OpenReaderAt(bytes.NewReader(data), int64(len(data)), bytes.NewReader(idx), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(t, b.Fetch(1, 0, 5000))
+	if c.Stats().Bytes == 0 {
+		t.Error("OpenReaderAt didn't use the SharedBlockCache")
+	}
+	b.Close()
+	if len(c.files) != 0 {
+		t.Error("Close didn't release the shared cache")
+	}
+}
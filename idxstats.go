@@ -0,0 +1,57 @@
+package bam
+
+// IdxStat is the read count of one reference, as in samtools idxstats.
+type IdxStat struct {
+	Name     string
+	Length   int
+	Mapped   uint64
+	Unmapped uint64 // unmapped reads placed on the reference (by their mate)
+}
+
+// IdxStats returns the mapped and unmapped read counts of each reference,
+// followed by an entry named "*" for the unplaced unmapped reads. The
+// counts are taken from the index, or from the alignments already in
+// memory when there is no index. Unplaced reads are counted by reading
+// them when the index doesn't record their number.
+func (b *AlignmentMap) IdxStats() ([]IdxStat, error) {
+	res := make([]IdxStat, len(b.References)+1)
+	for i, r := range b.References {
+		res[i].Name = r.Name
+		res[i].Length = r.Length
+	}
+	unplaced := &res[len(b.References)]
+	unplaced.Name = "*"
+
+	if b.Index != nil {
+		for i, r := range b.Index.Refs {
+			if i < len(b.References) {
+				res[i].Mapped = r.TotalMapped
+				res[i].Unmapped = r.TotalUnmapped
+			}
+		}
+		if b.Index.HasUnplaced {
+			unplaced.Unmapped = b.Index.Unplaced
+			return res, nil
+		}
+		it := b.FetchUnplaced()
+		for it.Next() {
+			unplaced.Unmapped++
+		}
+		return res, it.Err()
+	}
+
+	it := b.All()
+	for it.Next() {
+		a := it.Record()
+		s := unplaced
+		if a.refID >= 0 && int(a.refID) < len(b.References) {
+			s = &res[a.refID]
+		}
+		if a.flag&FlagUnmapped != 0 {
+			s.Unmapped++
+		} else {
+			s.Mapped++
+		}
+	}
+	return res, it.Err()
+}
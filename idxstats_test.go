@@ -0,0 +1,55 @@
+package bam
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestIdxStats(t *testing.T) {
+	recs := manyTestRecords(1000)
+	recs = append(recs[:500], append([]*Alignment{
+		newTestRecord("mate", 0, int32(499*37), FlagPaired|FlagUnmapped, "*", "ACGT"),
+	}, recs[500:]...)...)
+	for _, name := range []string{"u1", "u2", "u3"} {
+		recs = append(recs, newTestRecord(name, -1, -1, FlagUnmapped, "*", "ACGT"))
+	}
+	want := []IdxStat{
+		{Name: "chr1", Length: 1000000, Mapped: 500, Unmapped: 1},
+		{Name: "chr2", Length: 500000, Mapped: 500},
+		{Name: "*", Unmapped: 3},
+	}
+	filename := writeTestFiles(t, "idxstats", recs, true)
+
+	check := func(what string, b *AlignmentMap) {
+		t.Helper()
+		got, err := b.IdxStats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %+v, want %+v", what, got, want)
+		}
+	}
+
+	b := loadTestFile(t, filename, &Options{IndexOnly: true})
+	if !b.Index.HasUnplaced || b.Index.Unplaced != 3 {
+		t.Errorf("index has unplaced count %d (%v), want 3", b.Index.Unplaced, b.Index.HasUnplaced)
+	}
+	check("index", b)
+	check("no index", loadTestFile(t, writeTestFiles(t, "noindex", recs, false), nil))
+
+	// an index without the n_no_coor trailer
+	bai, err := os.ReadFile(filename + ".bai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(filename+".bai", bai[:len(bai)-8], 0644); err != nil {
+		t.Fatal(err)
+	}
+	b = loadTestFile(t, filename, &Options{IndexOnly: true})
+	if b.Index.HasUnplaced {
+		t.Error("truncated index claims to record the unplaced reads")
+	}
+	check("index without n_no_coor", b)
+}
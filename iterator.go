@@ -0,0 +1,254 @@
+package bam
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// An Iterator steps through the alignments overlapping a region.
+//
+// Each Iterator carries its own read state and reads blocks with ReadAt, so
+// any number of Iterators may be used concurrently on the same AlignmentMap.
+// A single Iterator must not be shared between goroutines.
+type Iterator struct {
+	b        *AlignmentMap
+	refID    int32
+	beginPos uint64
+	endPos   uint64
+
+	all      bool // every alignment in file order, regardless of region
+	unplaced bool // with all, only the reads without a reference
+	tlenSpan bool // overlap by POS+TLEN with the region's end included, as GetMap does
+
+	// index-driven reads
+	indexed bool
+	chunks  []Chunk
+	ci      int
+	inChunk bool   // positioned within chunks[ci]
+	blk     int64  // compressed offset of the current block
+	bsize   uint16 // compressed size of the current block
+	data    []byte // uncompressed data of the current block
+	off     int    // read position within data
+
+	// in-memory reads
+	list []*Alignment
+	li   int
+
+	rec *Alignment
+	err error
+}
+
+// Fetch returns an Iterator over the alignments on reference refID that
+// overlap the 0-based, half-open range [beginPos, endPos).
+func (b *AlignmentMap) Fetch(refID int32, beginPos, endPos uint64) *Iterator {
+	it := &Iterator{
+		b:        b,
+		refID:    refID,
+		beginPos: beginPos,
+		endPos:   endPos,
+	}
+	if refID < 0 || int(refID) >= len(b.References) {
+		it.err = fmt.Errorf("bam: invalid reference id %d", refID)
+		return it
+	}
+	if b.Index == nil {
+		if b.partial {
+			it.err = fmt.Errorf("bam: file is too large - please index it")
+		}
+		it.list = b.Alignments
+		return it
+	}
+	if int(refID) >= len(b.Index.Refs) {
+		// no alignments were indexed for this reference
+		return it
+	}
+	it.indexed = true
+	it.chunks = b.Index.Refs[refID].chunks(beginPos, endPos)
+	return it
+}
+
+// mapFetch returns an Iterator over the alignments shown by GetMap: those
+// in the smallest bin holding the region whose POS+TLEN span overlaps the
+// closed range [beginPos, endPos].
+func (b *AlignmentMap) mapFetch(refID int32, beginPos, endPos uint64) *Iterator {
+	it := b.Fetch(refID, beginPos, endPos)
+	it.tlenSpan = true
+	if it.indexed {
+		iref := &b.Index.Refs[refID]
+		it.chunks = iref.Bins[iref.getBin(beginPos, endPos)]
+	}
+	return it
+}
+
+// All returns an Iterator over every alignment in file order, including
+// unmapped reads. It doesn't need an index.
+func (b *AlignmentMap) All() *Iterator {
+	it := &Iterator{b: b, all: true}
+	if !b.partial {
+		it.list = b.Alignments
+		return it
+	}
+	it.indexed = true
+	it.chunks = []Chunk{{Begin: b.firstOffset, End: Offset(b.size << 16)}}
+	return it
+}
+
+// FetchUnplaced returns an Iterator over the unmapped reads that have no
+// reference (refID -1). In a sorted file these follow all of the placed
+// reads, so with an index reading starts after the last indexed offset.
+func (b *AlignmentMap) FetchUnplaced() *Iterator {
+	it := &Iterator{b: b, refID: -1, all: true, unplaced: true}
+	if !b.partial {
+		it.list = b.Alignments
+		return it
+	}
+	start := b.firstOffset
+	if b.Index != nil {
+		start = b.Index.lastOffset(start)
+	}
+	it.indexed = true
+	it.chunks = []Chunk{{Begin: start, End: Offset(b.size << 16)}}
+	return it
+}
+
+// Next advances to the next overlapping alignment, which will then be
+// available through Record. It returns false when there are no more
+// alignments or an error occurred.
+func (it *Iterator) Next() bool {
+	it.rec = nil
+	if it.err != nil {
+		return false
+	}
+
+	if !it.indexed {
+		for it.li < len(it.list) {
+			ba := it.list[it.li]
+			it.li++
+			if it.overlaps(ba) {
+				it.rec = ba
+				return true
+			}
+		}
+		return false
+	}
+
+	for it.ci < len(it.chunks) {
+		c := it.chunks[it.ci]
+		if !it.inChunk {
+			if it.err = it.seek(c.Begin); it.err != nil {
+				return false
+			}
+			it.inChunk = true
+		}
+		if it.offset() >= c.End {
+			it.ci++
+			it.inChunk = false
+			continue
+		}
+
+		ba, err := it.readAlignment()
+		if err != nil {
+			if err != io.EOF {
+				it.err = err
+			}
+			return false
+		}
+		if !it.all && (ba.refID != it.refID || !it.before(ba)) {
+			// sorted file, so nothing further can overlap
+			it.ci = len(it.chunks)
+			return false
+		}
+		if it.overlaps(ba) {
+			it.rec = ba
+			return true
+		}
+	}
+	return false
+}
+
+// Record returns the current alignment.
+func (it *Iterator) Record() *Alignment {
+	return it.rec
+}
+
+// Err returns the first error encountered while iterating.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+func (it *Iterator) overlaps(ba *Alignment) bool {
+	if it.all {
+		return !it.unplaced || ba.refID < 0
+	}
+	if ba.refID != it.refID {
+		return false
+	}
+	if it.tlenSpan {
+		return ba.pos+ba.tlen >= int32(it.beginPos) && it.before(ba)
+	}
+	return it.before(ba) && uint64(ba.End()) > it.beginPos
+}
+
+// before reports whether the alignment starts before the end of the region.
+func (it *Iterator) before(ba *Alignment) bool {
+	if it.tlenSpan {
+		return ba.pos <= int32(it.endPos)
+	}
+	return uint64(ba.pos) < it.endPos
+}
+
+// offset returns the virtual offset of the next unread byte.
+func (it *Iterator) offset() Offset {
+	if it.off >= len(it.data) {
+		return Offset((it.blk + int64(it.bsize)) << 16)
+	}
+	return Offset(it.blk<<16 | int64(it.off))
+}
+
+func (it *Iterator) seek(o Offset) error {
+	if it.data != nil && o.Compressed() == it.blk {
+		// still within the current block
+		it.off = int(o.Uncompressed())
+		return nil
+	}
+	data, bsize, err := it.b.block(o.Compressed())
+	if err != nil {
+		return err
+	}
+	it.blk = o.Compressed()
+	it.bsize = bsize
+	it.data = data
+	it.off = int(o.Uncompressed())
+	return nil
+}
+
+func (it *Iterator) readFull(p []byte) error {
+	for len(p) > 0 {
+		if it.off >= len(it.data) {
+			if err := it.seek(Offset((it.blk + int64(it.bsize)) << 16)); err != nil {
+				return err
+			}
+			continue
+		}
+		n := copy(p, it.data[it.off:])
+		it.off += n
+		p = p[n:]
+	}
+	return nil
+}
+
+func (it *Iterator) readAlignment() (*Alignment, error) {
+	var sz [4]byte
+	if err := it.readFull(sz[:]); err != nil {
+		return nil, err
+	}
+	r := make([]byte, int(binary.LittleEndian.Uint32(sz[:])))
+	if err := it.readFull(r); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return parseAlignment(r), nil
+}
@@ -0,0 +1,173 @@
+package bam
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// overlapping scans the records for those overlapping [begin, end).
+func overlapping(recs []*Alignment, refID int32, begin, end uint64) []string {
+	var res []string
+	for _, a := range recs {
+		if a.refID == refID && uint64(a.pos) < end && uint64(a.End()) > begin {
+			res = append(res, a.ReadName)
+		}
+	}
+	return res
+}
+
+var fetchRegions = []struct {
+	refID      int32
+	begin, end uint64
+}{
+	{0, 0, 1},
+	{0, 1000, 5000},
+	{0, 16300, 16400}, // across a 16kb window
+	{0, 30000, 90000},
+	{1, 0, 100},
+	{1, 20000, 200000},
+	{1, 400000, 500000}, // past the last read
+}
+
+func TestFetch(t *testing.T) {
+	recs := manyTestRecords(4000)
+	filename := writeTestFiles(t, "fetch", recs, true)
+
+	for _, mode := range []string{"loaded", "indexed"} {
+		b := loadTestFile(t, filename, &Options{IndexOnly: mode == "indexed"})
+		for _, r := range fetchRegions {
+			got := names(collect(t, b.Fetch(r.refID, r.begin, r.end)))
+			want := overlapping(recs, r.refID, r.begin, r.end)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("%s Fetch(%d, %d, %d) = %d reads, want %d", mode, r.refID, r.begin, r.end, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestFetchConcurrent(t *testing.T) {
+	filename := writeTestFiles(t, "concurrent", manyTestRecords(4000), true)
+
+	// a cache smaller than the file, so that blocks are evicted and
+	// reloaded while queries are running
+	b := loadTestFile(t, filename, &Options{IndexOnly: true, Cache: NewBlockCache(256 << 10)})
+
+	want := make([][]string, len(fetchRegions))
+	for i, r := range fetchRegions {
+		want[i] = names(collect(t, b.Fetch(r.refID, r.begin, r.end)))
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for n := 0; n < 20; n++ {
+				i := (g + n) % len(fetchRegions)
+				r := fetchRegions[i]
+				it := b.Fetch(r.refID, r.begin, r.end)
+				var got []string
+				for it.Next() {
+					got = append(got, it.Record().ReadName)
+				}
+				if err := it.Err(); err != nil {
+					errs <- err
+					return
+				}
+				if !reflect.DeepEqual(got, want[i]) {
+					errs <- fmt.Errorf("goroutine %d: region %d gave %d reads, want %d", g, i, len(got), len(want[i]))
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if st := b.CacheStats(); st.Evictions == 0 {
+		t.Errorf("no blocks were evicted (%+v), the test needs a smaller cache", st)
+	}
+}
+
+func TestGetMapConcurrent(t *testing.T) {
+	filename := writeTestFiles(t, "getmap", manyTestRecords(2000), true)
+	b := loadTestFile(t, filename, &Options{IndexOnly: true, Cache: NewBlockCache(128 << 10)})
+
+	want := b.GetMap(0, 1000, 1200)
+	if len(want) == 0 {
+		t.Fatal("GetMap returned no rows")
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := b.GetMap(0, 1000, 1200); !reflect.DeepEqual(got, want) {
+				t.Errorf("concurrent GetMap gave %d rows, want %d", len(got), len(want))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestGetMapSpan(t *testing.T) {
+	const seq = "ACGTACGTAC"
+	recs := []*Alignment{
+		newTestRecord("tlen", 0, 100, 0, "10M", seq).setMate(0, 390, 300),
+		newTestRecord("cigar", 0, 295, 0, "10M", seq),
+		newTestRecord("inside", 0, 305, 0, "10M", seq),
+		newTestRecord("end", 0, 320, 0, "10M", seq),
+	}
+	filename := writeTestFiles(t, "getmapspan", recs, true)
+
+	// reads are placed by POS+TLEN, and one starting at the end of the
+	// region is included
+	blank := strings.Repeat(" ", 20)
+	want := []string{blank, "     ACGTACGTAC     ", blank}
+	for _, opts := range []*Options{nil, {IndexOnly: true}} {
+		b := loadTestFile(t, filename, opts)
+		if got := b.GetMap(0, 300, 320); !reflect.DeepEqual(got, want) {
+			t.Errorf("options %+v: got %q, want %q", opts, got, want)
+		}
+	}
+}
+
+func TestFetchUnplaced(t *testing.T) {
+	recs := manyTestRecords(4000)
+	recs = append(recs[:100], append([]*Alignment{
+		newTestRecord("placed", 0, int32(99*37), FlagPaired|FlagUnmapped, "*", "ACGT"),
+	}, recs[100:]...)...)
+	want := []string{"u1", "u2", "u3"}
+	for _, name := range want {
+		recs = append(recs, newTestRecord(name, -1, -1, FlagUnmapped, "*", "ACGT"))
+	}
+	filename := writeTestFiles(t, "unplaced", recs, true)
+
+	for _, mode := range []string{"loaded", "indexed"} {
+		b := loadTestFile(t, filename, &Options{IndexOnly: mode == "indexed"})
+		if got := names(collect(t, b.FetchUnplaced())); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: FetchUnplaced = %v, want %v", mode, got, want)
+		}
+	}
+
+	// only the last blocks are read through the index
+	b := loadTestFile(t, filename, &Options{IndexOnly: true})
+	collect(t, b.FetchUnplaced())
+	tail := b.CacheStats().Misses
+	collect(t, b.All())
+	if all := b.CacheStats().Misses; tail > 3 || all < 3*tail {
+		t.Errorf("FetchUnplaced loaded %d blocks of %d", tail, all)
+	}
+
+	// a file without unplaced reads
+	b = loadTestFile(t, writeTestFiles(t, "placed", recs[:4001], true), &Options{IndexOnly: true})
+	if got := collect(t, b.FetchUnplaced()); len(got) != 0 {
+		t.Errorf("FetchUnplaced found %d reads in a file without unplaced reads", len(got))
+	}
+}
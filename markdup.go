@@ -0,0 +1,432 @@
+package bam
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MarkDupOptions control MarkDuplicates.
+type MarkDupOptions struct {
+	// Remove leaves duplicates out of the output instead of flagging them.
+	Remove bool
+
+	// OpticalDistance is the largest distance in x and y, as parsed from
+	// Illumina read names, between two reads of a duplicate set on the
+	// same tile for them to be counted as optical duplicates. Zero turns
+	// optical duplicate detection off.
+	OpticalDistance int
+}
+
+// DuplicationMetrics summarize the duplicates of one library, with the
+// fields of the Picard MarkDuplicates metrics.
+type DuplicationMetrics struct {
+	Library                   string  `json:"library"`
+	UnpairedReadsExamined     uint64  `json:"unpaired_reads_examined"`
+	ReadPairsExamined         uint64  `json:"read_pairs_examined"`
+	SecondaryOrSupplementary  uint64  `json:"secondary_or_supplementary_rds"`
+	UnmappedReads             uint64  `json:"unmapped_reads"`
+	UnpairedReadDuplicates    uint64  `json:"unpaired_read_duplicates"`
+	ReadPairDuplicates        uint64  `json:"read_pair_duplicates"`
+	ReadPairOpticalDuplicates uint64  `json:"read_pair_optical_duplicates"`
+	PercentDuplication        float64 `json:"percent_duplication"`
+
+	// EstimatedLibrarySize is the estimated number of unique molecules,
+	// from the read pairs. It is 0 when it can't be estimated.
+	EstimatedLibrarySize uint64 `json:"estimated_library_size"`
+}
+
+// dupEnd is the 5' end of a read used to find duplicates.
+type dupEnd struct {
+	refID int32
+	pos   int32 // unclipped 5' position
+	rev   bool
+}
+
+type dupFragKey struct {
+	lib int
+	end dupEnd
+}
+
+type dupPairKey struct {
+	lib        int
+	end1, end2 dupEnd
+}
+
+// dupRead is a primary read, or pair of reads, that could be a duplicate.
+type dupRead struct {
+	idx   [2]int    // record numbers in file order, idx[1] is -1 for a fragment
+	mates [2]uint16 // FlagRead1/FlagRead2 bits of each read
+	score int
+	name  string
+}
+
+// MarkDuplicates writes all of the alignments to w as a BAM file with the
+// duplicate flag set on the reads (or read pairs) that share their 5'
+// positions and strands with a better one, as Picard MarkDuplicates does.
+// The read with the highest sum of base qualities is kept. Unclipped
+// positions are used, so soft clipping doesn't hide duplicates, and
+// paired reads take precedence over fragments at the same position.
+// Secondary and supplementary alignments follow their primary.
+//
+// The alignments are read twice, the first time only keeping what is
+// needed to find the duplicates. It returns the metrics of each library.
+func (b *AlignmentMap) MarkDuplicates(w io.Writer, opts *MarkDupOptions) ([]DuplicationMetrics, error) {
+	o := MarkDupOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	libIndex, libNames := b.libraries()
+	metrics := make([]DuplicationMetrics, len(libNames))
+	for i, name := range libNames {
+		metrics[i].Library = name
+	}
+	lib := func(a *Alignment) int {
+		rg, _ := a.AuxData["RG"].(string)
+		if i, ok := libIndex[rg]; ok {
+			return i
+		}
+		return 0
+	}
+
+	frags := make(map[dupFragKey][]dupRead)
+	pairs := make(map[dupPairKey][]dupRead)
+	pairEnds := make(map[dupFragKey]bool) // ends of reads with a mapped mate
+	waiting := make(map[string]pairWait)  // first mates seen, by name
+
+	n := 0
+	it := b.All()
+	for ; it.Next(); n++ {
+		a := it.Record()
+		l := lib(a)
+		m := &metrics[l]
+		switch {
+		case a.flag&(FlagSecondary|FlagSupplementary) != 0:
+			m.SecondaryOrSupplementary++
+			continue
+		case a.flag&FlagUnmapped != 0 || a.refID < 0:
+			m.UnmappedReads++
+			continue
+		}
+
+		end := a.dupEnd()
+		if a.flag&FlagPaired == 0 || a.flag&FlagMateUnmapped != 0 {
+			m.UnpairedReadsExamined++
+			k := dupFragKey{l, end}
+			frags[k] = append(frags[k], dupRead{idx: [2]int{n, -1}, mates: [2]uint16{a.flag & (FlagRead1 | FlagRead2)},
+				score: a.dupScore(), name: a.ReadName})
+			continue
+		}
+
+		pairEnds[dupFragKey{l, end}] = true
+		first, ok := waiting[a.ReadName]
+		if !ok {
+			waiting[a.ReadName] = pairWait{lib: l, end: end, idx: n, mate: a.flag & (FlagRead1 | FlagRead2), score: a.dupScore()}
+			continue
+		}
+		delete(waiting, a.ReadName)
+		m.ReadPairsExamined++
+		k := dupPairKey{lib: l, end1: first.end, end2: end}
+		if end.less(first.end) {
+			k.end1, k.end2 = end, first.end
+		}
+		pairs[k] = append(pairs[k], dupRead{idx: [2]int{first.idx, n}, mates: [2]uint16{first.mate, a.flag & (FlagRead1 | FlagRead2)},
+			score: first.score + a.dupScore(), name: a.ReadName})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	// reads whose mate wasn't found are treated as fragments
+	for name, wt := range waiting {
+		metrics[wt.lib].UnpairedReadsExamined++
+		k := dupFragKey{wt.lib, wt.end}
+		frags[k] = append(frags[k], dupRead{idx: [2]int{wt.idx, -1}, mates: [2]uint16{wt.mate}, score: wt.score, name: name})
+	}
+
+	dup := make([]bool, n)
+	dupNames := make(map[string]bool) // primary reads marked, by name and read number
+	mark := func(r dupRead, i int) {
+		dup[r.idx[i]] = true
+		dupNames[dupName(r.name, r.mates[i])] = true
+	}
+	for k, set := range pairs {
+		if len(set) < 2 {
+			continue
+		}
+		best := bestDupRead(set)
+		m := &metrics[k.lib]
+		for i, r := range set {
+			if i != best {
+				mark(r, 0)
+				mark(r, 1)
+				m.ReadPairDuplicates++
+			}
+		}
+		if o.OpticalDistance > 0 {
+			m.ReadPairOpticalDuplicates += uint64(countOptical(set, o.OpticalDistance))
+		}
+	}
+	for k, set := range frags {
+		best := -1 // all are duplicates of a pair at the same position
+		if !pairEnds[k] {
+			best = bestDupRead(set)
+		}
+		for i, r := range set {
+			if i != best {
+				mark(r, 0)
+				metrics[k.lib].UnpairedReadDuplicates++
+			}
+		}
+	}
+
+	bw, err := NewWriter(w, b.Header, b.References)
+	if err != nil {
+		return nil, err
+	}
+	it = b.All()
+	for i := 0; it.Next() && i < n; i++ {
+		a := it.Record()
+		isDup := dup[i]
+		if a.flag&(FlagSecondary|FlagSupplementary) != 0 {
+			isDup = dupNames[dupName(a.ReadName, a.flag&(FlagRead1|FlagRead2))]
+		}
+		if isDup && o.Remove {
+			continue
+		}
+		if isDup != (a.flag&FlagDuplicate != 0) {
+			a = a.clone()
+			a.flag ^= FlagDuplicate
+		}
+		if err = bw.Write(a); err != nil {
+			return nil, err
+		}
+	}
+	if err = it.Err(); err != nil {
+		return nil, err
+	}
+	if err = bw.Close(); err != nil {
+		return nil, err
+	}
+
+	for i := range metrics {
+		m := &metrics[i]
+		if total := m.UnpairedReadsExamined + 2*m.ReadPairsExamined; total > 0 {
+			m.PercentDuplication = float64(m.UnpairedReadDuplicates+2*m.ReadPairDuplicates) / float64(total)
+		}
+		m.EstimatedLibrarySize = estimateLibrarySize(m.ReadPairsExamined-m.ReadPairOpticalDuplicates,
+			m.ReadPairsExamined-m.ReadPairDuplicates)
+	}
+	return metrics, nil
+}
+
+type pairWait struct {
+	lib   int
+	end   dupEnd
+	idx   int
+	mate  uint16
+	score int
+}
+
+// dupName identifies a read of a template, for finding the secondary and
+// supplementary alignments of duplicates.
+func dupName(name string, mate uint16) string {
+	return name + "/" + strconv.Itoa(int(mate))
+}
+
+// libraries maps the read group IDs to library numbers, using the LB: of
+// the @RG header lines. Library 0 is for reads without a known library.
+func (b *AlignmentMap) libraries() (map[string]int, []string) {
+	const unknown = "Unknown Library"
+	index := make(map[string]int)
+	names := []string{unknown}
+	byName := map[string]int{unknown: 0}
+	for _, line := range strings.Split(b.Header, "\n") {
+		if !strings.HasPrefix(line, "@RG\t") {
+			continue
+		}
+		id, _ := headerField(line, "ID")
+		lb, ok := headerField(line, "LB")
+		if !ok {
+			lb = unknown
+		}
+		i, ok := byName[lb]
+		if !ok {
+			i = len(names)
+			byName[lb] = i
+			names = append(names, lb)
+		}
+		index[id] = i
+	}
+	return index, names
+}
+
+// dupEnd returns the unclipped 5' end of the read.
+func (a *Alignment) dupEnd() dupEnd {
+	cigar := a.Cigar()
+	clipped := func(op CigarOp) bool {
+		return op.Type() == CigarSoftClipped || op.Type() == CigarHardClipped
+	}
+	if a.flag&FlagReverse == 0 {
+		pos := a.pos
+		for _, op := range cigar {
+			if !clipped(op) {
+				break
+			}
+			pos -= int32(op.Len())
+		}
+		return dupEnd{refID: a.refID, pos: pos}
+	}
+	pos := a.End() - 1
+	for i := len(cigar) - 1; i >= 0 && clipped(cigar[i]); i-- {
+		pos += int32(cigar[i].Len())
+	}
+	return dupEnd{refID: a.refID, pos: pos, rev: true}
+}
+
+// dupScore is the sum of the base qualities of at least 15, as used by
+// Picard to choose the read kept from a duplicate set.
+func (a *Alignment) dupScore() int {
+	s := 0
+	for i := 0; i < len(a.qual); i++ {
+		if q := a.qual[i]; q >= 15 && q != 0xff {
+			s += int(q)
+		}
+	}
+	return s
+}
+
+func (e dupEnd) less(o dupEnd) bool {
+	if e.refID != o.refID {
+		return e.refID < o.refID
+	}
+	if e.pos != o.pos {
+		return e.pos < o.pos
+	}
+	return !e.rev && o.rev
+}
+
+// bestDupRead returns the index of the read to keep, the one with the
+// highest score, with ties going to the first in the file.
+func bestDupRead(set []dupRead) int {
+	best := 0
+	for i, r := range set {
+		if r.score > set[best].score || (r.score == set[best].score && r.idx[0] < set[best].idx[0]) {
+			best = i
+		}
+	}
+	return best
+}
+
+// opticalLocation parses the tile and cluster coordinates from the end of
+// an Illumina read name ("...:lane:tile:x:y").
+func opticalLocation(name string) (tile string, x, y int, ok bool) {
+	if i := strings.IndexAny(name, " /#"); i >= 0 {
+		name = name[:i]
+	}
+	fields := strings.Split(name, ":")
+	if len(fields) < 5 {
+		return "", 0, 0, false
+	}
+	n := len(fields)
+	x, errx := strconv.Atoi(fields[n-2])
+	y, erry := strconv.Atoi(fields[n-1])
+	if errx != nil || erry != nil {
+		return "", 0, 0, false
+	}
+	return strings.Join(fields[:n-2], ":"), x, y, true
+}
+
+// countOptical returns the number of reads in a duplicate set that are
+// within distance of another read on the same tile, counting one read of
+// each cluster as the original.
+func countOptical(set []dupRead, distance int) int {
+	type loc struct {
+		tile string
+		x, y int
+	}
+	var locs []loc
+	for _, r := range set {
+		if tile, x, y, ok := opticalLocation(r.name); ok {
+			locs = append(locs, loc{tile, x, y})
+		}
+	}
+	sort.Slice(locs, func(i, j int) bool {
+		if locs[i].tile != locs[j].tile {
+			return locs[i].tile < locs[j].tile
+		}
+		return locs[i].x < locs[j].x
+	})
+	abs := func(v int) int {
+		if v < 0 {
+			return -v
+		}
+		return v
+	}
+	n := 0
+	for i, l := range locs {
+		for j := i - 1; j >= 0 && locs[j].tile == l.tile && l.x-locs[j].x <= distance; j-- {
+			if abs(l.y-locs[j].y) <= distance {
+				n++
+				break
+			}
+		}
+	}
+	return n
+}
+
+// estimateLibrarySize estimates the number of unique molecules in a
+// library from the number of read pairs and unique read pairs, using
+// the Lander-Waterman equation as Picard does. It returns 0 when there
+// are no duplicates to estimate from.
+func estimateLibrarySize(readPairs, uniquePairs uint64) uint64 {
+	n, c := float64(readPairs), float64(uniquePairs)
+	if readPairs == 0 || uniquePairs == 0 || c >= n {
+		return 0
+	}
+	f := func(x float64) float64 { return c/x - 1 + math.Exp(-n/x) }
+	m, M := 1.0, 100.0
+	if f(m*c) < 0 {
+		return 0
+	}
+	for f(M*c) > 0 {
+		M *= 10
+	}
+	for i := 0; i < 40; i++ {
+		r := (m + M) / 2
+		u := f(r * c)
+		if u == 0 {
+			break
+		} else if u > 0 {
+			m = r
+		} else {
+			M = r
+		}
+	}
+	return uint64(c * (m + M) / 2)
+}
+
+// WriteDuplicationMetrics writes the metrics as a tab-separated table in
+// the layout of the Picard MarkDuplicates metrics file.
+func WriteDuplicationMetrics(w io.Writer, metrics []DuplicationMetrics) error {
+	_, err := fmt.Fprintln(w, "LIBRARY\tUNPAIRED_READS_EXAMINED\tREAD_PAIRS_EXAMINED\tSECONDARY_OR_SUPPLEMENTARY_RDS\tUNMAPPED_READS\tUNPAIRED_READ_DUPLICATES\tREAD_PAIR_DUPLICATES\tREAD_PAIR_OPTICAL_DUPLICATES\tPERCENT_DUPLICATION\tESTIMATED_LIBRARY_SIZE")
+	for _, m := range metrics {
+		if err != nil {
+			break
+		}
+		if m.UnpairedReadsExamined+m.ReadPairsExamined+m.SecondaryOrSupplementary+m.UnmappedReads == 0 {
+			continue
+		}
+		size := ""
+		if m.EstimatedLibrarySize > 0 {
+			size = strconv.FormatUint(m.EstimatedLibrarySize, 10)
+		}
+		_, err = fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%.6f\t%s\n", m.Library,
+			m.UnpairedReadsExamined, m.ReadPairsExamined, m.SecondaryOrSupplementary, m.UnmappedReads,
+			m.UnpairedReadDuplicates, m.ReadPairDuplicates, m.ReadPairOpticalDuplicates,
+			m.PercentDuplication, size)
+	}
+	return err
+}
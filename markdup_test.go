@@ -0,0 +1,129 @@
+package bam
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// markDupRecords returns a hand-built set of pairs and fragments, with
+// the reads expected to be flagged as duplicates.
+func markDupRecords() ([]*Alignment, []string) {
+	const seq = "ACGTACGTAC"
+	r1 := uint16(FlagPaired | FlagRead1 | FlagMateReverse)
+	r2 := uint16(FlagPaired | FlagRead2 | FlagReverse)
+
+	// four pairs with their 5' ends at 100+ and 309-. The soft clipped
+	// one has the best qualities and is kept; p2 is an optical
+	// duplicate of p1, p3 is on another tile.
+	p1, p2, p3, p4 := "M1:1:FC:1:1101:1000:1000", "M1:1:FC:1:1101:1010:1005", "M1:1:FC:1:2202:1000:1000", "M1:1:FC:1:3303:5:5"
+	best := newTestRecord(p4, 0, 102, r1, "2S8M", seq).setMate(0, 300, 210)
+	best.qual = strings.Repeat("\x28", len(seq))
+	bestMate := newTestRecord(p4, 0, 300, r2, "10M", seq).setMate(0, 102, -210)
+	bestMate.qual = best.qual
+
+	// f1 is at the same position as the pairs, so it is a duplicate of
+	// them; f3 is better than f2
+	f3 := newTestRecord("f3", 0, 500, 0, "10M", seq)
+	f3.qual = best.qual
+
+	recs := []*Alignment{
+		newTestRecord(p1, 0, 100, r1, "10M", seq).setMate(0, 300, 210),
+		newTestRecord(p2, 0, 100, r1, "10M", seq).setMate(0, 300, 210),
+		newTestRecord(p3, 0, 100, r1, "10M", seq).setMate(0, 300, 210),
+		newTestRecord("f1", 0, 100, 0, "10M", seq),
+		best,
+		newTestRecord(p1, 0, 300, r2, "10M", seq).setMate(0, 100, -210),
+		newTestRecord(p2, 0, 300, r2, "10M", seq).setMate(0, 100, -210),
+		newTestRecord(p3, 0, 300, r2, "10M", seq).setMate(0, 100, -210),
+		bestMate,
+		newTestRecord("f2", 0, 500, 0, "10M", seq),
+		f3,
+		newTestRecord(p1, 1, 50, r1|FlagSecondary, "10M", seq).setMate(0, 300, 0),
+		newTestRecord("u", -1, -1, FlagUnmapped, "*", seq),
+	}
+	for _, a := range recs {
+		a.SetAux("RG", "rg1")
+	}
+	dups := []string{p1, p1, p1, p2, p2, p3, p3, "f1", "f2"}
+	sort.Strings(dups)
+	return recs, dups
+}
+
+func TestMarkDuplicates(t *testing.T) {
+	recs, wantDups := markDupRecords()
+	data := writeTestBAM(t, testHeader(testRefs, "@RG\tID:rg1\tLB:lib1"), testRefs, recs)
+	b, _ := readTestBAM(t, data)
+
+	var buf bytes.Buffer
+	metrics, err := b.MarkDuplicates(&buf, &MarkDupOptions{OpticalDistance: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, out := readTestBAM(t, buf.Bytes())
+	if len(out) != len(recs) {
+		t.Fatalf("wrote %d reads, want %d", len(out), len(recs))
+	}
+	var dups []string
+	for _, a := range out {
+		if a.Flag()&FlagDuplicate != 0 {
+			dups = append(dups, a.ReadName)
+		}
+	}
+	sort.Strings(dups)
+	if !reflect.DeepEqual(dups, wantDups) {
+		t.Errorf("duplicates %v, want %v", dups, wantDups)
+	}
+
+	if len(metrics) != 2 || metrics[1].Library != "lib1" {
+		t.Fatalf("metrics %+v", metrics)
+	}
+	m := metrics[1]
+	m.PercentDuplication = math.Round(m.PercentDuplication*1e6) / 1e6
+	want := DuplicationMetrics{
+		Library:                   "lib1",
+		UnpairedReadsExamined:     3,
+		ReadPairsExamined:         4,
+		SecondaryOrSupplementary:  1,
+		UnmappedReads:             1,
+		UnpairedReadDuplicates:    2,
+		ReadPairDuplicates:        3,
+		ReadPairOpticalDuplicates: 1,
+		PercentDuplication:        math.Round(8.0/11*1e6) / 1e6,
+		EstimatedLibrarySize:      estimateLibrarySize(3, 1),
+	}
+	if m != want {
+		t.Errorf("metrics %+v, want %+v", m, want)
+	}
+
+	var table bytes.Buffer
+	if err = WriteDuplicationMetrics(&table, metrics); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(table.String()), "\n"); len(lines) != 2 || !strings.HasPrefix(lines[1], "lib1\t3\t4\t1\t1\t2\t3\t1\t0.727273\t") {
+		t.Errorf("metrics table %q", table.String())
+	}
+
+	// removing the duplicates leaves the kept pair, f3 and the unmapped read
+	buf.Reset()
+	if _, err = b.MarkDuplicates(&buf, &MarkDupOptions{Remove: true}); err != nil {
+		t.Fatal(err)
+	}
+	_, out = readTestBAM(t, buf.Bytes())
+	if got := len(out); got != len(recs)-len(wantDups) {
+		t.Errorf("kept %d reads, want %d", got, len(recs)-len(wantDups))
+	}
+}
+
+func TestOpticalLocation(t *testing.T) {
+	tile, x, y, ok := opticalLocation("M1:1:FC:1:1101:1000:2000 1:N:0")
+	if !ok || tile != "M1:1:FC:1:1101" || x != 1000 || y != 2000 {
+		t.Errorf("got %q %d %d %v", tile, x, y, ok)
+	}
+	if _, _, _, ok = opticalLocation("read1"); ok {
+		t.Error("parsed a location from a name without one")
+	}
+}
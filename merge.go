@@ -0,0 +1,309 @@
+package bam
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MergeOptions control Merge.
+type MergeOptions struct {
+	// Order is the order the inputs are sorted in, and the order of the
+	// output. SortTag is not supported.
+	Order SortOrder
+
+	// TagFromFile sets the RG tag of every read to the input's file name
+	// (without its extension), adding a matching @RG header line. A name
+	// already used by another input or @RG line gets a -1, -2, ... suffix.
+	TagFromFile bool
+}
+
+// mergeInput holds how the records of one input are rewritten.
+type mergeInput struct {
+	refIDs []int32           // input refID -> output refID
+	rg, pg map[string]string // renamed @RG and @PG IDs
+	tagRG  string            // RG to set on every read, if not empty
+}
+
+// Merge combines sorted BAM files into one sorted BAM written to w. The
+// reference dictionaries are joined in order of first appearance, with
+// names matched through the Aliases of each input, and each input's
+// refIDs are renumbered to match. An input whose references are in a
+// different order than the output is read one reference at a time, which
+// needs an index when the file isn't loaded into memory. The @RG and @PG
+// header lines of all inputs are kept, renaming an ID (and the reads' RG
+// and PG tags) that clashes with a different line of an earlier input. A
+// nil opts merges by coordinate.
+func Merge(inputs []*AlignmentMap, w io.Writer, opts *MergeOptions) error {
+	o := MergeOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("bam: no inputs to merge")
+	}
+	var less func(x, y *Alignment) bool
+	switch o.Order {
+	case SortCoordinate:
+		// not every sorter orders by strand within a position
+		less = func(x, y *Alignment) bool { return coordinateKey(x)>>1 < coordinateKey(y)>>1 }
+	case SortQueryName:
+		less = queryNameLess
+	default:
+		return fmt.Errorf("bam: can't merge by sort order %d", o.Order)
+	}
+
+	refs, sq, ins, err := mergeReferences(inputs)
+	if err != nil {
+		return err
+	}
+	header := mergeHeaders(inputs, ins, sq, &o)
+	if o.Order == SortCoordinate {
+		header = setSortOrder(header, "coordinate")
+	} else {
+		header = setSortOrder(header, "queryname")
+	}
+
+	bw, err := NewWriter(w, header, refs)
+	if err != nil {
+		return err
+	}
+	h := &mergeHeap{less: less}
+	for i, b := range inputs {
+		src := &mergeSource{it: b.All(), idx: i, fix: ins[i].fix}
+		if o.Order == SortCoordinate && !ins[i].ordered() {
+			// read each reference in the output order instead
+			its := ins[i].byOutputRef(b)
+			src.it, src.rest = its[0], its[1:]
+		}
+		if err = h.push(src); err != nil {
+			return err
+		}
+	}
+	for h.Len() > 0 {
+		s := h.srcs[0]
+		prev := s.cur
+		if err = bw.Write(prev); err != nil {
+			return err
+		}
+		if s.next() {
+			if o.Order == SortCoordinate && less(s.cur, prev) {
+				return fmt.Errorf("bam: input %d is not sorted", s.idx+1)
+			}
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+		if s.err != nil {
+			return s.err
+		}
+	}
+	return bw.Close()
+}
+
+// mergeReferences joins the reference dictionaries of the inputs. It also
+// returns the @SQ header line of each output reference.
+func mergeReferences(inputs []*AlignmentMap) ([]Reference, []string, []*mergeInput, error) {
+	var refs []Reference
+	var sq []string
+	byName := make(map[string]int32)
+	ins := make([]*mergeInput, len(inputs))
+	for i, b := range inputs {
+		sqLines := make(map[string]string)
+		for _, line := range strings.Split(b.Header, "\n") {
+			if strings.HasPrefix(line, "@SQ\t") {
+				if name, ok := headerField(line, "SN"); ok {
+					sqLines[name] = line
+				}
+			}
+		}
+
+		in := &mergeInput{refIDs: make([]int32, len(b.References))}
+		for j, r := range b.References {
+			id, ok := byName[r.Name]
+			if !ok && b.Aliases != nil {
+				for _, alt := range b.Aliases.Names(r.Name) {
+					if id, ok = byName[alt]; ok {
+						break
+					}
+				}
+			}
+			if !ok {
+				id = int32(len(refs))
+				refs = append(refs, r)
+				line, found := sqLines[r.Name]
+				if !found {
+					line = fmt.Sprintf("@SQ\tSN:%s\tLN:%d", r.Name, r.Length)
+				}
+				sq = append(sq, line)
+			} else if refs[id].Length != r.Length {
+				return nil, nil, nil, fmt.Errorf("bam: reference %s is %d bp in input %d but %s is %d bp in an earlier input",
+					r.Name, r.Length, i+1, refs[id].Name, refs[id].Length)
+			}
+			byName[r.Name] = id
+			in.refIDs[j] = id
+		}
+		ins[i] = in
+	}
+	return refs, sq, ins, nil
+}
+
+// mergeHeaders builds the merged SAM header text, recording the renamed
+// @RG and @PG IDs of each input.
+func mergeHeaders(inputs []*AlignmentMap, ins []*mergeInput, sq []string, o *MergeOptions) string {
+	var hd string
+	var rgs, pgs, other []string
+	seen := make(map[string]bool)      // lines already added
+	named := make(map[string]string)   // output ID of each @RG and @PG line
+	ids := map[string]map[string]bool{ // IDs in use, by record type
+		"@RG": make(map[string]bool),
+		"@PG": make(map[string]bool),
+	}
+	unique := func(typ, id string) string {
+		n := id
+		for k := 1; ids[typ][n]; k++ {
+			n = fmt.Sprintf("%s-%d", id, k)
+		}
+		ids[typ][n] = true
+		return n
+	}
+
+	for i, b := range inputs {
+		in := ins[i]
+		in.rg = make(map[string]string)
+		in.pg = make(map[string]string)
+		lines := strings.Split(strings.TrimSuffix(b.Header, "\n"), "\n")
+
+		// rename clashing IDs first, so that PP: links can follow them
+		for _, line := range lines {
+			if !strings.HasPrefix(line, "@RG\t") && !strings.HasPrefix(line, "@PG\t") {
+				continue
+			}
+			typ := line[:3]
+			renames := in.rg
+			if typ == "@PG" {
+				renames = in.pg
+			}
+			id, _ := headerField(line, "ID")
+			newID, ok := named[line]
+			if !ok {
+				// an exact copy of an earlier line keeps its new ID
+				newID = unique(typ, id)
+				named[line] = newID
+			}
+			if newID != id {
+				renames[id] = newID
+			}
+		}
+
+		for _, line := range lines {
+			switch {
+			case line == "" || strings.HasPrefix(line, "@SQ\t"):
+			case strings.HasPrefix(line, "@HD\t"):
+				if hd == "" {
+					hd = line
+				}
+			case strings.HasPrefix(line, "@RG\t"), strings.HasPrefix(line, "@PG\t"):
+				if seen[line] {
+					continue
+				}
+				seen[line] = true
+				out := line
+				renames := in.rg
+				if strings.HasPrefix(line, "@PG\t") {
+					renames = in.pg
+					if pp, ok := headerField(line, "PP"); ok && renames[pp] != "" {
+						out = setHeaderField(out, "PP", renames[pp])
+					}
+				}
+				if id, _ := headerField(line, "ID"); renames[id] != "" {
+					out = setHeaderField(out, "ID", renames[id])
+				}
+				if strings.HasPrefix(line, "@RG\t") {
+					rgs = append(rgs, out)
+				} else {
+					pgs = append(pgs, out)
+				}
+			default:
+				if !seen[line] {
+					seen[line] = true
+					other = append(other, line)
+				}
+			}
+		}
+
+		if o.TagFromFile {
+			name := b.filename
+			if name == "" {
+				name = fmt.Sprintf("input%d", i+1)
+			}
+			// inputs with the same name, or an existing @RG with
+			// it, get a numbered ID such as "sample-1"
+			name = strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+			in.tagRG = unique("@RG", name)
+			rgs = append(rgs, "@RG\tID:"+in.tagRG)
+		}
+	}
+
+	var sb strings.Builder
+	if hd == "" {
+		hd = "@HD\tVN:1.6"
+	}
+	for _, part := range [][]string{{hd}, sq, rgs, pgs, other} {
+		for _, line := range part {
+			sb.WriteString(line)
+			sb.WriteByte('\n')
+		}
+	}
+	return sb.String()
+}
+
+// ordered returns true if the input's references keep their order in
+// the output, so that its coordinate order is unchanged.
+func (in *mergeInput) ordered() bool {
+	for i := 1; i < len(in.refIDs); i++ {
+		if in.refIDs[i] < in.refIDs[i-1] {
+			return false
+		}
+	}
+	return true
+}
+
+// byOutputRef returns iterators over each of the input's references in
+// the order of the output references, followed by the unplaced reads.
+func (in *mergeInput) byOutputRef(b *AlignmentMap) []*Iterator {
+	order := make([]int32, len(in.refIDs))
+	for i := range order {
+		order[i] = int32(i)
+	}
+	sort.Slice(order, func(i, j int) bool { return in.refIDs[order[i]] < in.refIDs[order[j]] })
+	var its []*Iterator
+	for _, refID := range order {
+		its = append(its, b.Fetch(refID, 0, uint64(b.References[refID].Length)))
+	}
+	return append(its, b.FetchUnplaced())
+}
+
+// fix returns a copy of a record from the input, rewritten for the
+// merged output.
+func (in *mergeInput) fix(a *Alignment) *Alignment {
+	c := a.clone()
+	if c.refID >= 0 && int(c.refID) < len(in.refIDs) {
+		c.refID = in.refIDs[c.refID]
+	}
+	if c.nextRefID >= 0 && int(c.nextRefID) < len(in.refIDs) {
+		c.nextRefID = in.refIDs[c.nextRefID]
+	}
+	if in.tagRG != "" {
+		c.SetAux("RG", in.tagRG)
+	} else if rg, ok := c.AuxData["RG"].(string); ok && in.rg[rg] != "" {
+		c.SetAux("RG", in.rg[rg])
+	}
+	if pg, ok := c.AuxData["PG"].(string); ok && in.pg[pg] != "" {
+		c.SetAux("PG", in.pg[pg])
+	}
+	return c
+}
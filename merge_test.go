@@ -0,0 +1,140 @@
+package bam
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeMergeInput writes the alignments to dir/name with the given extra
+// header lines, and loads it.
+func writeMergeInput(t *testing.T, dir, name string, refs []Reference, recs []*Alignment, extra ...string) *AlignmentMap {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, name)
+	if err := os.WriteFile(filename, writeTestBAM(t, testHeader(refs, extra...), refs, recs), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return loadTestFile(t, filename, nil)
+}
+
+// headerLines returns the header lines of a record type.
+func headerLines(header, typ string) []string {
+	var res []string
+	for _, line := range strings.Split(header, "\n") {
+		if strings.HasPrefix(line, typ+"\t") {
+			res = append(res, line)
+		}
+	}
+	return res
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	const seq = "ACGTACGTAC"
+	tagged := func(a *Alignment, tag, value string) *Alignment {
+		a.SetAux(tag, value)
+		return a
+	}
+	in1 := writeMergeInput(t, dir, "a.bam", testRefs, []*Alignment{
+		tagged(newTestRecord("a1", 0, 100, 0, "10M", seq), "RG", "grp"),
+		tagged(newTestRecord("a2", 1, 50, 0, "10M", seq), "RG", "grp"),
+	}, "@RG\tID:grp\tSM:one", "@PG\tID:bwa\tPN:bwa")
+
+	// chr2 comes first in the second input, and its @RG and @PG IDs
+	// clash with different lines of the first
+	refs2 := []Reference{testRefs[1], testRefs[0]}
+	in2 := writeMergeInput(t, dir, "b.bam", refs2, []*Alignment{
+		tagged(newTestRecord("b1", 0, 10, 0, "10M", seq), "RG", "grp"),
+		tagged(newTestRecord("b2", 1, 200, 0, "10M", seq), "PG", "bwa"),
+	}, "@RG\tID:grp\tSM:two", "@PG\tID:bwa\tPN:bwa\tVN:2")
+
+	var buf bytes.Buffer
+	if err := Merge([]*AlignmentMap{in1, in2}, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, out := readTestBAM(t, buf.Bytes())
+	if got, want := names(out), []string{"a1", "b2", "b1", "a2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("merged %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(b.References, testRefs) {
+		t.Errorf("merged references %v", b.References)
+	}
+	if got, want := headerLines(b.Header, "@RG"), []string{"@RG\tID:grp\tSM:one", "@RG\tID:grp-1\tSM:two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("@RG lines %q, want %q", got, want)
+	}
+	rgs := map[string]interface{}{}
+	for _, a := range out {
+		rgs[a.ReadName] = a.AuxData["RG"]
+	}
+	if rgs["a1"] != "grp" || rgs["b1"] != "grp-1" || out[1].AuxData["PG"] != "bwa-1" {
+		t.Errorf("tags weren't renamed: RG %v, PG %v", rgs, out[1].AuxData["PG"])
+	}
+}
+
+func TestMergeDuplicateRename(t *testing.T) {
+	dir := t.TempDir()
+	const seq = "ACGTACGTAC"
+	read := func(name string, pos int32) *Alignment {
+		a := newTestRecord(name, 0, pos, 0, "10M", seq)
+		a.SetAux("RG", "grp")
+		return a
+	}
+	in1 := writeMergeInput(t, dir, "a.bam", testRefs, []*Alignment{read("a1", 100)}, "@RG\tID:grp\tSM:one")
+	in2 := writeMergeInput(t, dir, "b.bam", testRefs, []*Alignment{read("b1", 200)}, "@RG\tID:grp\tSM:two")
+	in3 := writeMergeInput(t, dir, "c.bam", testRefs, []*Alignment{read("c1", 300)}, "@RG\tID:grp\tSM:two")
+
+	// the third input's line is the same as the second's, so its reads
+	// follow the second input's rename
+	var buf bytes.Buffer
+	if err := Merge([]*AlignmentMap{in1, in2, in3}, &buf, nil); err != nil {
+		t.Fatal(err)
+	}
+	b, out := readTestBAM(t, buf.Bytes())
+	if got, want := headerLines(b.Header, "@RG"), []string{"@RG\tID:grp\tSM:one", "@RG\tID:grp-1\tSM:two"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("@RG lines %q, want %q", got, want)
+	}
+	want := map[string]string{"a1": "grp", "b1": "grp-1", "c1": "grp-1"}
+	for _, a := range out {
+		if rg := a.AuxData["RG"]; rg != want[a.ReadName] {
+			t.Errorf("%s has RG %v, want %s", a.ReadName, rg, want[a.ReadName])
+		}
+	}
+}
+
+func TestMergeTagFromFile(t *testing.T) {
+	dir := t.TempDir()
+	const seq = "ACGTACGTAC"
+	in1 := writeMergeInput(t, filepath.Join(dir, "run1"), "sample.bam", testRefs, []*Alignment{
+		newTestRecord("r1", 0, 100, 0, "10M", seq),
+	})
+	in2 := writeMergeInput(t, filepath.Join(dir, "run2"), "sample.bam", testRefs, []*Alignment{
+		newTestRecord("r2", 0, 200, 0, "10M", seq),
+	})
+	in3 := writeMergeInput(t, dir, "other.bam", testRefs, []*Alignment{
+		newTestRecord("r3", 0, 300, 0, "10M", seq),
+	}, "@RG\tID:sample\tSM:x")
+
+	var buf bytes.Buffer
+	err := Merge([]*AlignmentMap{in1, in2, in3}, &buf, &MergeOptions{TagFromFile: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, out := readTestBAM(t, buf.Bytes())
+	want := []string{"@RG\tID:sample", "@RG\tID:sample-1", "@RG\tID:sample-2\tSM:x", "@RG\tID:other"}
+	if got := headerLines(b.Header, "@RG"); !reflect.DeepEqual(got, want) {
+		t.Errorf("@RG lines %q, want %q", got, want)
+	}
+	var rgs []interface{}
+	for _, a := range out {
+		rgs = append(rgs, a.AuxData["RG"])
+	}
+	if want := []interface{}{"sample", "sample-1", "other"}; !reflect.DeepEqual(rgs, want) {
+		t.Errorf("RG tags %v, want %v", rgs, want)
+	}
+}
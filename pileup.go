@@ -0,0 +1,298 @@
+package bam
+
+// PileupOptions filter the reads and bases that make up a pileup.
+type PileupOptions struct {
+	// MinMapQ skips reads with a lower mapping quality.
+	MinMapQ uint8
+
+	// MinBaseQ skips bases with a lower base quality. Deletions are kept.
+	MinBaseQ uint8
+
+	// RequireFlags skips reads without all of these flags set, and
+	// ExcludeFlags skips reads with any of these flags set.
+	RequireFlags uint16
+	ExcludeFlags uint16
+
+	// MaxDepth stops new reads from being added at a position once this
+	// many reads cover it. Zero means no limit.
+	MaxDepth int
+
+	// Filter, if set, skips reads for which it isn't true.
+	Filter *Filter
+}
+
+// DefaultPileupOptions are used by Pileup when no options are given.
+// They match the defaults of samtools mpileup.
+var DefaultPileupOptions = PileupOptions{
+	MinBaseQ:     13,
+	ExcludeFlags: FlagUnmapped | FlagSecondary | FlagQCFail | FlagDuplicate,
+	MaxDepth:     8000,
+}
+
+// A PileupRead is the state of one read at a pileup position.
+type PileupRead struct {
+	Alignment *Alignment
+
+	// QPos is the position of the base in the read. For a deletion it
+	// is the position of the next aligned base.
+	QPos int
+
+	// Base and Qual are the read base and its (raw phred) quality,
+	// both 0 for a deletion or reference skip. Reads without a stored
+	// sequence (SEQ "*") have 'N' bases of quality 0, as in samtools.
+	Base byte
+	Qual byte
+
+	Reverse   bool
+	IsDel     bool // a deletion from the reference (CIGAR D)
+	IsRefSkip bool // a skipped region of the reference (CIGAR N)
+
+	// Indel is the length of an insertion (positive) or deletion
+	// (negative) immediately after this position, or 0.
+	Indel int
+
+	IsHead bool // first aligned position of the read
+	IsTail bool // last aligned position of the read
+}
+
+// InsertedSequence returns the bases inserted after this position, when
+// Indel is positive. A read without a stored sequence (SEQ "*") gives
+// 'N' for each inserted base.
+func (r *PileupRead) InsertedSequence() string {
+	if r.Indel <= 0 {
+		return ""
+	}
+	seq := r.Alignment.Sequence()
+	ins := make([]byte, r.Indel)
+	for i := range ins {
+		ins[i] = 'N'
+		if q := r.QPos + 1 + i; q < len(seq) {
+			ins[i] = seq[q]
+		}
+	}
+	return string(ins)
+}
+
+// A PileupColumn is the set of reads covering a reference position.
+type PileupColumn struct {
+	RefID int32
+	Pos   int64 // 0-based
+	Reads []PileupRead
+}
+
+// A Pileup steps through the covered positions of a region, yielding
+// the reads over each one placed according to their CIGAR.
+type Pileup struct {
+	it   *Iterator
+	reg  Region
+	opts PileupOptions
+
+	pos     int64
+	pending *Alignment // next read from it, not yet started
+	active  []*pileupState
+	col     PileupColumn
+	err     error
+}
+
+// pileupState holds the reference placement of one read.
+type pileupState struct {
+	a     *Alignment
+	seq   string
+	end   int64
+	cols  []pileupPos // one per reference position from a.pos
+	first int         // index of the first aligned base in cols
+	last  int         // index of the last aligned base in cols
+}
+
+type pileupPos struct {
+	qpos  int32
+	kind  uint8 // pileupBase, pileupDel or pileupSkip
+	indel int32
+}
+
+const (
+	pileupBase = iota
+	pileupDel
+	pileupSkip
+)
+
+// Pileup returns a Pileup over the region. A nil opts uses the
+// DefaultPileupOptions.
+func (b *AlignmentMap) Pileup(r Region, opts *PileupOptions) *Pileup {
+	p := &Pileup{
+		it:   b.Fetch(r.RefID, r.Begin, r.End),
+		reg:  r,
+		opts: DefaultPileupOptions,
+		pos:  int64(r.Begin),
+	}
+	if opts != nil {
+		p.opts = *opts
+	}
+	p.col.RefID = r.RefID
+	return p
+}
+
+// Next advances to the next covered position, which will then be
+// available through Column. It returns false at the end of the region
+// or when an error occurred.
+func (p *Pileup) Next() bool {
+	for p.err == nil && p.pos < int64(p.reg.End) {
+		p.fill()
+		if p.err != nil {
+			return false
+		}
+		if len(p.active) == 0 {
+			if p.pending == nil {
+				return false
+			}
+			// skip ahead to the next read
+			p.pos = int64(p.pending.pos)
+			continue
+		}
+
+		p.col.Pos = p.pos
+		p.col.Reads = p.col.Reads[:0]
+		for _, s := range p.active {
+			if r, ok := s.at(p.pos, p.opts.MinBaseQ); ok {
+				p.col.Reads = append(p.col.Reads, r)
+			}
+		}
+
+		p.pos++
+		keep := p.active[:0]
+		for _, s := range p.active {
+			if s.end > p.pos {
+				keep = append(keep, s)
+			}
+		}
+		p.active = keep
+
+		if len(p.col.Reads) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Column returns the current position.
+func (p *Pileup) Column() *PileupColumn {
+	return &p.col
+}
+
+// Err returns the first error encountered.
+func (p *Pileup) Err() error {
+	return p.err
+}
+
+// fill starts every read that begins at or before the current position.
+func (p *Pileup) fill() {
+	for {
+		if p.pending == nil {
+			if !p.it.Next() {
+				p.err = p.it.Err()
+				return
+			}
+			a := p.it.Record()
+			if !p.opts.Accepts(a) {
+				continue
+			}
+			p.pending = a
+		}
+		if int64(p.pending.pos) > p.pos {
+			return
+		}
+
+		a := p.pending
+		p.pending = nil
+		if int64(a.End()) <= p.pos {
+			continue
+		}
+		if p.opts.MaxDepth > 0 && len(p.active) >= p.opts.MaxDepth {
+			continue
+		}
+		p.active = append(p.active, newPileupState(a))
+	}
+}
+
+// Accepts returns true if the read passes the read filters: the mapping
+// quality, flags and Filter expression. Reads without a CIGAR are never
+// accepted.
+func (o *PileupOptions) Accepts(a *Alignment) bool {
+	if a.mapq < o.MinMapQ || len(a.cigarPacked) == 0 {
+		return false
+	}
+	return a.flag&o.RequireFlags == o.RequireFlags && a.flag&o.ExcludeFlags == 0 &&
+		(o.Filter == nil || o.Filter.Match(a))
+}
+
+func newPileupState(a *Alignment) *pileupState {
+	s := &pileupState{a: a, seq: a.Sequence(), end: int64(a.End()), first: -1}
+	s.cols = make([]pileupPos, 0, s.end-int64(a.pos))
+
+	qpos := int32(0)
+	for _, op := range a.Cigar() {
+		n := int32(op.Len())
+		switch op.Type() {
+		case CigarMatch, CigarEqual, CigarMismatch:
+			for i := int32(0); i < n; i++ {
+				if s.first < 0 {
+					s.first = len(s.cols)
+				}
+				s.last = len(s.cols)
+				s.cols = append(s.cols, pileupPos{qpos: qpos + i})
+			}
+			qpos += n
+		case CigarInsertion:
+			if len(s.cols) > 0 {
+				s.cols[len(s.cols)-1].indel = n
+			}
+			qpos += n
+		case CigarDeletion, CigarSkipped:
+			kind := uint8(pileupDel)
+			if op.Type() == CigarSkipped {
+				kind = pileupSkip
+			} else if len(s.cols) > 0 {
+				s.cols[len(s.cols)-1].indel = -n
+			}
+			for i := int32(0); i < n; i++ {
+				s.cols = append(s.cols, pileupPos{qpos: qpos, kind: kind})
+			}
+		case CigarSoftClipped:
+			qpos += n
+		}
+	}
+	return s
+}
+
+// at returns the read's state at reference position pos, and false if
+// the base there is filtered out.
+func (s *pileupState) at(pos int64, minBaseQ uint8) (PileupRead, bool) {
+	i := int(pos - int64(s.a.pos))
+	if i < 0 || i >= len(s.cols) {
+		return PileupRead{}, false
+	}
+	c := s.cols[i]
+	r := PileupRead{
+		Alignment: s.a,
+		QPos:      int(c.qpos),
+		Reverse:   s.a.flag&FlagReverse != 0,
+		IsDel:     c.kind == pileupDel,
+		IsRefSkip: c.kind == pileupSkip,
+		Indel:     int(c.indel),
+		IsHead:    i == s.first,
+		IsTail:    i == s.last,
+	}
+	if c.kind == pileupBase {
+		r.Base = 'N'
+		if int(c.qpos) < len(s.seq) {
+			r.Base = s.seq[c.qpos]
+		}
+		if int(c.qpos) < len(s.a.qual) {
+			r.Qual = s.a.qual[c.qpos]
+		}
+		if r.Qual < minBaseQ {
+			return PileupRead{}, false
+		}
+	}
+	return r, true
+}
@@ -0,0 +1,77 @@
+package bam
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// pileupText renders each column as "pos:bases" with '*' for deletions,
+// '+' and the inserted bases after a base followed by an insertion.
+func pileupText(t *testing.T, p *Pileup) string {
+	var cols []string
+	for p.Next() {
+		col := p.Column()
+		var sb strings.Builder
+		for _, r := range col.Reads {
+			switch {
+			case r.IsDel:
+				sb.WriteByte('*')
+			case r.IsRefSkip:
+				sb.WriteByte('>')
+			default:
+				sb.WriteByte(r.Base)
+			}
+			if r.Indel > 0 {
+				sb.WriteString("+" + r.InsertedSequence())
+			}
+		}
+		cols = append(cols, fmt.Sprintf("%d:%s", col.Pos, sb.String()))
+	}
+	if err := p.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(cols, " ")
+}
+
+func TestPileup(t *testing.T) {
+	recs := []*Alignment{
+		newTestRecord("a", 0, 10, 0, "2S3M2I2M1D2M", "TTACGGGTAGC"),
+		newTestRecord("b", 0, 12, FlagReverse, "3M2N2M", "GTTTA"),
+		newTestRecord("dup", 0, 12, FlagDuplicate, "4M", "AAAA"),
+	}
+	filename := writeTestFiles(t, "pileup", recs, true)
+	b := loadTestFile(t, filename, nil)
+
+	got := pileupText(t, b.Pileup(Region{RefID: 0, Begin: 0, End: 100}, nil))
+	want := "10:A 11:C 12:G+GGG 13:TT 14:AT 15:*> 16:G> 17:CT 18:A"
+	if got != want {
+		t.Errorf("pileup is\n%s\nwant\n%s", got, want)
+	}
+
+	// a region in the middle of the reads, keeping duplicates
+	opts := DefaultPileupOptions
+	opts.ExcludeFlags = 0
+	got = pileupText(t, b.Pileup(Region{RefID: 0, Begin: 13, End: 15}, &opts))
+	if want = "13:TTA 14:ATA"; got != want {
+		t.Errorf("pileup of 13-15 is %q, want %q", got, want)
+	}
+}
+
+func TestPileupMissingSequence(t *testing.T) {
+	a := newTestRecord("noseq", 0, 5, 0, "2M1I2M", "*")
+	filename := writeTestFiles(t, "noseq", []*Alignment{a}, true)
+	b := loadTestFile(t, filename, nil)
+
+	opts := DefaultPileupOptions
+	opts.MinBaseQ = 0
+	got := pileupText(t, b.Pileup(Region{RefID: 0, Begin: 0, End: 20}, &opts))
+	if want := "5:N 6:N+N 7:N 8:N"; got != want {
+		t.Errorf("pileup without SEQ is %q, want %q", got, want)
+	}
+
+	// without qualities every base is filtered by the default MinBaseQ
+	if got = pileupText(t, b.Pileup(Region{RefID: 0, Begin: 0, End: 20}, nil)); got != "" {
+		t.Errorf("default pileup without SEQ is %q, want nothing", got)
+	}
+}
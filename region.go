@@ -0,0 +1,334 @@
+package bam
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Region is a 0-based, half-open range [Begin, End) on a reference sequence.
+type Region struct {
+	RefID int32
+	Begin uint64
+	End   uint64
+
+	// Name is an optional label, such as the name column of a BED file.
+	Name string
+}
+
+// A RegionIterator steps through the alignments overlapping any of a set
+// of regions. Each alignment is returned once, no matter how many of the
+// regions it overlaps.
+type RegionIterator struct {
+	b       *AlignmentMap
+	regions []Region
+
+	// indexes into regions, grouped by reference in file order and
+	// sorted by Begin within each group
+	groups [][]int
+	gi     int
+	maxEnd []uint64 // running maximum End within the current group
+
+	it   *Iterator
+	hits []int
+	err  error
+}
+
+// FetchRegions returns a RegionIterator over the alignments overlapping
+// any of the regions. The index chunks of all regions on a reference are
+// merged first, so each block of the file is decompressed at most once.
+func (b *AlignmentMap) FetchRegions(regions []Region) *RegionIterator {
+	ri := &RegionIterator{b: b, regions: regions}
+
+	byRef := make(map[int32][]int)
+	var refs []int32
+	for i, r := range regions {
+		if r.RefID < 0 || int(r.RefID) >= len(b.References) {
+			ri.err = fmt.Errorf("bam: invalid reference id %d", r.RefID)
+			return ri
+		}
+		if r.End <= r.Begin {
+			continue
+		}
+		if _, ok := byRef[r.RefID]; !ok {
+			refs = append(refs, r.RefID)
+		}
+		byRef[r.RefID] = append(byRef[r.RefID], i)
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i] < refs[j] })
+	for _, refID := range refs {
+		g := byRef[refID]
+		sort.SliceStable(g, func(i, j int) bool {
+			return regions[g[i]].Begin < regions[g[j]].Begin
+		})
+		ri.groups = append(ri.groups, g)
+	}
+	ri.gi = -1
+	return ri
+}
+
+// Next advances to the next alignment, which will then be available
+// through Record and Regions. It returns false when there are no more
+// alignments or an error occurred.
+func (ri *RegionIterator) Next() bool {
+	ri.hits = ri.hits[:0]
+	if ri.err != nil {
+		return false
+	}
+	for {
+		if ri.it == nil || !ri.it.Next() {
+			if ri.it != nil {
+				if ri.err = ri.it.Err(); ri.err != nil {
+					return false
+				}
+			}
+			if !ri.nextGroup() {
+				return false
+			}
+			continue
+		}
+
+		ba := ri.it.Record()
+		g := ri.groups[ri.gi]
+		end := uint64(ba.End())
+		// regions starting before the alignment ends...
+		n := sort.Search(len(g), func(i int) bool { return ri.regions[g[i]].Begin >= end })
+		// ...that haven't all ended before it starts
+		for j := n - 1; j >= 0 && ri.maxEnd[j] > uint64(ba.pos); j-- {
+			if ri.regions[g[j]].End > uint64(ba.pos) {
+				ri.hits = append(ri.hits, g[j])
+			}
+		}
+		if len(ri.hits) > 0 {
+			sort.Ints(ri.hits)
+			return true
+		}
+	}
+}
+
+// nextGroup starts the Iterator for the regions on the next reference.
+func (ri *RegionIterator) nextGroup() bool {
+	ri.gi++
+	if ri.gi >= len(ri.groups) {
+		ri.it = nil
+		return false
+	}
+	g := ri.groups[ri.gi]
+
+	ri.maxEnd = ri.maxEnd[:0]
+	var end uint64
+	for _, i := range g {
+		if ri.regions[i].End > end {
+			end = ri.regions[i].End
+		}
+		ri.maxEnd = append(ri.maxEnd, end)
+	}
+
+	refID := ri.regions[g[0]].RefID
+	it := ri.b.Fetch(refID, ri.regions[g[0]].Begin, end)
+	if it.indexed {
+		iref := &ri.b.Index.Refs[refID]
+		var chunks []Chunk
+		for _, i := range g {
+			chunks = append(chunks, iref.chunks(ri.regions[i].Begin, ri.regions[i].End)...)
+		}
+		it.chunks = mergeChunks(chunks)
+	}
+	if ri.it != nil {
+		// carry the last block over in case the next reference starts in it
+		it.blk, it.bsize, it.data, it.off = ri.it.blk, ri.it.bsize, ri.it.data, ri.it.off
+	}
+	ri.it = it
+	return true
+}
+
+// Record returns the current alignment.
+func (ri *RegionIterator) Record() *Alignment {
+	if ri.it == nil || len(ri.hits) == 0 {
+		return nil
+	}
+	return ri.it.Record()
+}
+
+// Regions returns the indexes of the regions that the current alignment
+// overlaps, in the order they were given to FetchRegions.
+func (ri *RegionIterator) Regions() []int {
+	return ri.hits
+}
+
+// Err returns the first error encountered while iterating.
+func (ri *RegionIterator) Err() error {
+	return ri.err
+}
+
+// LoadBED reads regions from the named BED file, see ReadBED.
+func (b *AlignmentMap) LoadBED(filename string) ([]Region, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return b.ReadBED(f)
+}
+
+// ReadBED reads regions from BED formatted text, using the reference
+// names of the alignment map. Only the chrom, start, end and (optional)
+// name columns are used. Header, track and browser lines are skipped.
+func (b *AlignmentMap) ReadBED(r io.Reader) ([]Region, error) {
+	var res []Region
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1024*1024)
+	for lineno := 1; s.Scan(); lineno++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || line[0] == '#' ||
+			strings.HasPrefix(line, "track") || strings.HasPrefix(line, "browser") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("bam: BED line %d: expected at least 3 columns", lineno)
+		}
+		refID, ok := b.RefID(fields[0])
+		if !ok {
+			return nil, fmt.Errorf("bam: BED line %d: unknown reference '%s'", lineno, fields[0])
+		}
+		begin, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bam: BED line %d: invalid start: %v", lineno, err)
+		}
+		end, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bam: BED line %d: invalid end: %v", lineno, err)
+		}
+		reg := Region{RefID: refID, Begin: begin, End: end}
+		if len(fields) > 3 {
+			reg.Name = fields[3]
+		}
+		res = append(res, reg)
+	}
+	return res, s.Err()
+}
+
+// ParseRegion parses a region in samtools notation, such as "chr1",
+// "chr1:1,000" or "chr1:1,112,421-1,112,478". Positions are 1-based and
+// inclusive, and may contain commas. The result is converted to a 0-based,
+// half-open range. An end of 0 means the end of the reference sequence.
+//
+// Reference names containing colons can be written in braces, as in
+// "{HLA-A*01:01}:100-200". Otherwise the text after the last colon is
+// only treated as a range if it parses as one.
+func ParseRegion(s string) (name string, begin, end uint64, err error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "{") {
+		i := strings.Index(s, "}")
+		if i < 0 {
+			return "", 0, 0, fmt.Errorf("bam: unterminated '{' in region '%s'", s)
+		}
+		name, rest := s[1:i], s[i+1:]
+		if rest == "" {
+			return name, 0, 0, nil
+		}
+		if rest[0] != ':' {
+			return "", 0, 0, fmt.Errorf("bam: invalid region '%s'", s)
+		}
+		begin, end, err = parseRange(rest[1:])
+		if err != nil {
+			return "", 0, 0, fmt.Errorf("bam: invalid region '%s': %v", s, err)
+		}
+		return name, begin, end, nil
+	}
+
+	i := strings.LastIndexByte(s, ':')
+	if i < 0 {
+		return s, 0, 0, nil
+	}
+	begin, end, err = parseRange(s[i+1:])
+	if err != nil {
+		// not a range, so the colon is part of the name
+		return s, 0, 0, nil
+	}
+	return s[:i], begin, end, nil
+}
+
+// parseRange parses "begin", "begin-" or "begin-end" (1-based, inclusive).
+func parseRange(s string) (begin, end uint64, err error) {
+	s = strings.Replace(s, ",", "", -1)
+	bs, es := s, ""
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		bs, es = s[:i], s[i+1:]
+	}
+	b, err := strconv.ParseUint(bs, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if b == 0 {
+		return 0, 0, fmt.Errorf("positions start at 1")
+	}
+	if es == "" {
+		return b - 1, 0, nil
+	}
+	e, err := strconv.ParseUint(es, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	if e < b {
+		return 0, 0, fmt.Errorf("end is before start")
+	}
+	return b - 1, e, nil
+}
+
+// ParseRegion parses a region in samtools notation (see ParseRegion)
+// against the reference sequences of the alignment map. A reference name
+// that contains a colon matches as a whole before any range is split off.
+// The end of the region is clipped to the length of the reference.
+func (b *AlignmentMap) ParseRegion(s string) (Region, error) {
+	name, begin, end := strings.TrimSpace(s), uint64(0), uint64(0)
+	if _, ok := b.RefID(name); !ok {
+		var err error
+		name, begin, end, err = ParseRegion(name)
+		if err != nil {
+			return Region{}, err
+		}
+	}
+	refID, ok := b.RefID(name)
+	if !ok {
+		return Region{}, fmt.Errorf("bam: unknown reference '%s'", name)
+	}
+
+	length := uint64(b.References[refID].Length)
+	if end == 0 || end > length {
+		end = length
+	}
+	if begin >= end {
+		return Region{}, fmt.Errorf("bam: region '%s' is outside of %s (%d bp)", s, name, length)
+	}
+	return Region{RefID: refID, Begin: begin, End: end}, nil
+}
+
+// RefID returns the index of the named reference sequence. If there is no
+// exact match, the aliases of the name are tried (see Aliases).
+func (b *AlignmentMap) RefID(name string) (int32, bool) {
+	b.refMu.Lock()
+	defer b.refMu.Unlock()
+	if len(b.refIDs) != len(b.References) {
+		b.refIDs = make(map[string]int32, len(b.References))
+		for i, r := range b.References {
+			b.refIDs[r.Name] = int32(i)
+		}
+	}
+	if i, ok := b.refIDs[name]; ok {
+		return i, true
+	}
+	if b.Aliases != nil {
+		for _, alias := range b.Aliases.Names(name) {
+			if i, ok := b.refIDs[alias]; ok {
+				return i, true
+			}
+		}
+	}
+	return -1, false
+}
@@ -0,0 +1,128 @@
+package bam
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFetchRegions(t *testing.T) {
+	recs := manyTestRecords(4000)
+	filename := writeTestFiles(t, "regions", recs, true)
+	regions := []Region{
+		{RefID: 1, Begin: 1000, End: 3000},
+		{RefID: 0, Begin: 5000, End: 9000},
+		{RefID: 0, Begin: 8000, End: 8500}, // inside the one before
+		{RefID: 0, Begin: 60000, End: 61000},
+		{RefID: 1, Begin: 2500, End: 2600},
+	}
+
+	// scan for the expected reads, in file order, with their regions
+	var want []string
+	wantHits := make(map[string][]int)
+	for _, a := range recs {
+		for i, r := range regions {
+			if a.refID == r.RefID && uint64(a.pos) < r.End && uint64(a.End()) > r.Begin {
+				if wantHits[a.ReadName] == nil {
+					want = append(want, a.ReadName)
+				}
+				wantHits[a.ReadName] = append(wantHits[a.ReadName], i)
+			}
+		}
+	}
+
+	for _, mode := range []string{"loaded", "indexed"} {
+		b := loadTestFile(t, filename, &Options{IndexOnly: mode == "indexed"})
+		var got []string
+		ri := b.FetchRegions(regions)
+		for ri.Next() {
+			a := ri.Record()
+			got = append(got, a.ReadName)
+			if hits := ri.Regions(); !reflect.DeepEqual(hits, wantHits[a.ReadName]) {
+				t.Errorf("%s: %s overlaps regions %v, want %v", mode, a.ReadName, hits, wantHits[a.ReadName])
+			}
+		}
+		if err := ri.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: FetchRegions gave %d reads, want %d", mode, len(got), len(want))
+		}
+	}
+}
+
+func TestReadBED(t *testing.T) {
+	b := &AlignmentMap{References: testRefs}
+	bed := "track name=test\n# comment\n\nchr1\t100\t200\tpeak1\nchr2 5 10\n"
+	regions, err := b.ReadBED(strings.NewReader(bed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Region{{RefID: 0, Begin: 100, End: 200, Name: "peak1"}, {RefID: 1, Begin: 5, End: 10}}
+	if !reflect.DeepEqual(regions, want) {
+		t.Errorf("ReadBED = %v, want %v", regions, want)
+	}
+
+	for _, bad := range []string{"chr1\t100\n", "chrX\t1\t2\n", "chr1\tx\t2\n"} {
+		if _, err = b.ReadBED(strings.NewReader(bad)); err == nil {
+			t.Errorf("ReadBED(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseRegion(t *testing.T) {
+	tests := []struct {
+		in         string
+		name       string
+		begin, end uint64
+		ok         bool
+	}{
+		{"chr1", "chr1", 0, 0, true},
+		{"chr1:1,000", "chr1", 999, 0, true},
+		{"chr1:1,112,421-1,112,478", "chr1", 1112420, 1112478, true},
+		{"chr1:100-", "chr1", 99, 0, true},
+		{"{HLA-A*01:01}:100-200", "HLA-A*01:01", 99, 200, true},
+		{"HLA-A*01:01", "HLA-A*01", 0, 0, true}, // ambiguous without braces
+		{"chr1:0-10", "chr1:0-10", 0, 0, true},  // not a range, so part of the name
+		{"{chr1}:20-10", "", 0, 0, false},
+		{"{chr1:5", "", 0, 0, false},
+	}
+	for _, tc := range tests {
+		name, begin, end, err := ParseRegion(tc.in)
+		if (err == nil) != tc.ok {
+			t.Errorf("ParseRegion(%q) error = %v", tc.in, err)
+			continue
+		}
+		if tc.ok && (name != tc.name || begin != tc.begin || end != tc.end) {
+			t.Errorf("ParseRegion(%q) = %q, %d, %d, want %q, %d, %d", tc.in, name, begin, end, tc.name, tc.begin, tc.end)
+		}
+	}
+}
+
+func TestAlignmentMapParseRegion(t *testing.T) {
+	refs := append([]Reference{{Name: "HLA-A*01:01", Length: 3000}}, testRefs...)
+	b := &AlignmentMap{References: refs}
+
+	tests := []struct {
+		in   string
+		want Region
+	}{
+		{"chr1", Region{RefID: 1, Begin: 0, End: 1000000}},
+		{"chr2:400,001-600,000", Region{RefID: 2, Begin: 400000, End: 500000}},
+		{"HLA-A*01:01", Region{RefID: 0, Begin: 0, End: 3000}},
+		{"HLA-A*01:01:101-200", Region{RefID: 0, Begin: 100, End: 200}},
+	}
+	for _, tc := range tests {
+		got, err := b.ParseRegion(tc.in)
+		if err != nil {
+			t.Errorf("ParseRegion(%q): %v", tc.in, err)
+		} else if got != tc.want {
+			t.Errorf("ParseRegion(%q) = %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+	for _, bad := range []string{"chrZ", "chr2:600,000-700,000"} {
+		if _, err := b.ParseRegion(bad); err == nil {
+			t.Errorf("ParseRegion(%q) succeeded", bad)
+		}
+	}
+}
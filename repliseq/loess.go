@@ -0,0 +1,50 @@
+package repliseq
+
+import (
+	"math"
+)
+
+// Loess smooths y with a locally weighted linear regression at each x.
+// Points within span/2 of x[i] are used, weighted by the tricube of their
+// distance. The x values must be sorted. NaN values in y are ignored, and
+// the result is NaN where no points had a value.
+func Loess(x, y []float64, span float64) []float64 {
+	res := make([]float64, len(y))
+	half := span / 2
+	lo := 0
+	for i, x0 := range x {
+		for x[lo] < x0-half {
+			lo++
+		}
+		var sw, swx, swy, swxx, swxy float64
+		for j := lo; j < len(x) && x[j] <= x0+half; j++ {
+			if math.IsNaN(y[j]) {
+				continue
+			}
+			d := math.Abs(x[j]-x0) / half
+			if d >= 1 {
+				continue
+			}
+			w := 1 - d*d*d
+			w = w * w * w
+			dx := x[j] - x0
+			sw += w
+			swx += w * dx
+			swy += w * y[j]
+			swxx += w * dx * dx
+			swxy += w * dx * y[j]
+		}
+		if sw == 0 {
+			res[i] = math.NaN()
+			continue
+		}
+		// fit y = a + b*dx, and the value at x0 is a
+		det := sw*swxx - swx*swx
+		if swxx == 0 || math.Abs(det) < 1e-9*sw*swxx {
+			res[i] = swy / sw
+			continue
+		}
+		res[i] = (swy*swxx - swx*swxy) / det
+	}
+	return res
+}
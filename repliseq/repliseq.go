@@ -0,0 +1,275 @@
+// Package repliseq computes DNA replication timing from Repli-seq data.
+//
+// A Repli-seq experiment sorts cells into cell-cycle phase fractions (such
+// as the G1b, S1-S4 and G2 fractions of the UW ENCODE data) and sequences
+// the newly replicated DNA of each. Regions that replicate early are
+// enriched in the early S-phase fractions. The reads of each fraction are
+// counted in sliding windows, normalized by library size, and combined
+// into a weighted average or a log2 early/late ratio.
+package repliseq
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/joiningdata/bam"
+)
+
+// UWWeights are the weights of the G1b, S1, S2, S3, S4 and G2 fractions
+// used for the weighted average signal of the UW Repli-seq tracks.
+var UWWeights = []float64{0.917, 0.750, 0.583, 0.417, 0.250, 0}
+
+// A Fraction is the aligned reads of one cell-cycle phase fraction.
+type Fraction struct {
+	Name string
+	BAM  *bam.AlignmentMap
+
+	// Weight is the relative replication time of the fraction, from 1
+	// for the earliest to 0 for the latest. Fractions above 0.5 count
+	// as early, and below 0.5 as late, in the Log2Ratio method.
+	Weight float64
+}
+
+// Method combines the normalized fraction counts of a window.
+type Method int
+
+const (
+	// WeightedAverage is 100 times the sum of each fraction's weight
+	// times its share of the window's normalized reads, so that early
+	// replicating windows score high.
+	WeightedAverage Method = iota
+
+	// Log2Ratio is log2 of the normalized early reads over late reads.
+	Log2Ratio
+)
+
+// Options control the computation of a timing Signal.
+type Options struct {
+	// Window is the width of the sliding windows, and Step the distance
+	// between their centers.
+	Window int
+	Step   int
+
+	Method Method
+
+	// Span is the width of the loess smoothing neighbourhood, in bases.
+	// Zero disables smoothing.
+	Span int
+
+	// Filter selects the reads counted. Nil uses bam.DefaultDepthOptions.
+	// Its expression is compiled again for the references of each input,
+	// which may be in a different order.
+	Filter *bam.PileupOptions
+}
+
+// DefaultOptions are used by Compute when no options are given. They
+// follow the 50kb windows, 1kb steps and 300kb smoothing of the UW tracks.
+var DefaultOptions = Options{
+	Window: 50000,
+	Step:   1000,
+	Method: WeightedAverage,
+	Span:   300000,
+}
+
+// A Signal is a replication timing value for each step of the references.
+type Signal struct {
+	Step int
+	Refs []RefSignal
+}
+
+// RefSignal holds the values of one reference sequence. Values[i] is
+// centered on the step beginning at i*Step, and is NaN where there were
+// no reads.
+type RefSignal struct {
+	Name   string
+	Length int
+	Values []float64
+}
+
+// Compute counts the reads of each fraction and combines them into a
+// timing signal over the references of the first fraction. References
+// missing from another fraction (by name or alias) count no reads there.
+// A nil opts uses DefaultOptions.
+func Compute(fractions []Fraction, opts *Options) (*Signal, error) {
+	o := DefaultOptions
+	if opts != nil {
+		o = *opts
+	}
+	if len(fractions) == 0 {
+		return nil, fmt.Errorf("repliseq: no fractions")
+	}
+	if o.Step <= 0 || o.Window < o.Step {
+		return nil, fmt.Errorf("repliseq: invalid window %d and step %d", o.Window, o.Step)
+	}
+	filter := bam.DefaultDepthOptions
+	if o.Filter != nil {
+		filter = *o.Filter
+	}
+
+	refs := fractions[0].BAM.References
+	counts := make([][][]float64, len(fractions)) // fraction, ref, step
+	for i, f := range fractions {
+		// the filter looks up rname by refID, so it is compiled for the
+		// references of each input
+		ff := filter
+		if filter.Filter != nil {
+			var err error
+			if ff.Filter, err = bam.CompileFilter(filter.Filter.String(), f.BAM.References); err != nil {
+				return nil, fmt.Errorf("repliseq: %s: %v", f.Name, err)
+			}
+		}
+		c, total, err := countSteps(f.BAM, refs, o.Step, &ff)
+		if err != nil {
+			return nil, fmt.Errorf("repliseq: %s: %v", f.Name, err)
+		}
+		if total == 0 {
+			return nil, fmt.Errorf("repliseq: %s: no reads", f.Name)
+		}
+		// reads per million
+		scale := 1e6 / float64(total)
+		for _, steps := range c {
+			windowSums(steps, o.Window/o.Step)
+			for j := range steps {
+				steps[j] *= scale
+			}
+		}
+		counts[i] = c
+	}
+
+	s := &Signal{Step: o.Step, Refs: make([]RefSignal, len(refs))}
+	x := make([]float64, len(fractions))
+	for r, ref := range refs {
+		n := len(counts[0][r])
+		rs := RefSignal{Name: ref.Name, Length: ref.Length, Values: make([]float64, n)}
+		for j := 0; j < n; j++ {
+			for i := range fractions {
+				x[i] = counts[i][r][j]
+			}
+			rs.Values[j] = combine(o.Method, fractions, x)
+		}
+		if o.Span > 0 {
+			pos := make([]float64, n)
+			for j := range pos {
+				pos[j] = float64(j*o.Step + o.Step/2)
+			}
+			rs.Values = Loess(pos, rs.Values, float64(o.Span))
+		}
+		s.Refs[r] = rs
+	}
+	return s, nil
+}
+
+// countSteps counts the reads starting in each step of the references,
+// returning the counts and the total number of reads.
+func countSteps(b *bam.AlignmentMap, refs []bam.Reference, step int, filter *bam.PileupOptions) ([][]float64, int, error) {
+	res := make([][]float64, len(refs))
+	total := 0
+	for r, ref := range refs {
+		res[r] = make([]float64, (ref.Length+step-1)/step)
+		refID, ok := b.RefID(ref.Name)
+		if !ok {
+			continue
+		}
+		it := b.Fetch(refID, 0, uint64(ref.Length))
+		for it.Next() {
+			a := it.Record()
+			if !filter.Accepts(a) || a.Pos() < 0 || int(a.Pos()) >= ref.Length {
+				continue
+			}
+			res[r][int(a.Pos())/step]++
+			total++
+		}
+		if err := it.Err(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return res, total, nil
+}
+
+// windowSums replaces each step count with the sum over the window of
+// width steps centered on it.
+func windowSums(steps []float64, width int) {
+	if width <= 1 {
+		return
+	}
+	before := (width - 1) / 2
+	after := width - 1 - before
+	prefix := make([]float64, len(steps)+1)
+	for i, c := range steps {
+		prefix[i+1] = prefix[i] + c
+	}
+	for i := range steps {
+		lo, hi := i-before, i+after+1
+		if lo < 0 {
+			lo = 0
+		}
+		if hi > len(steps) {
+			hi = len(steps)
+		}
+		steps[i] = prefix[hi] - prefix[lo]
+	}
+}
+
+// combine computes the timing value of a window from the normalized
+// counts x of each fraction.
+func combine(m Method, fractions []Fraction, x []float64) float64 {
+	switch m {
+	case Log2Ratio:
+		early, late := 0.0, 0.0
+		for i, f := range fractions {
+			if f.Weight > 0.5 {
+				early += x[i]
+			} else if f.Weight < 0.5 {
+				late += x[i]
+			}
+		}
+		if early == 0 || late == 0 {
+			return math.NaN()
+		}
+		return math.Log2(early / late)
+	default:
+		sum, wsum := 0.0, 0.0
+		for i, f := range fractions {
+			sum += x[i]
+			wsum += f.Weight * x[i]
+		}
+		if sum == 0 {
+			return math.NaN()
+		}
+		return 100 * wsum / sum
+	}
+}
+
+// WriteBedGraph writes the signal as a bedGraph track, with one line per
+// step. Steps without a value are left out.
+func (s *Signal) WriteBedGraph(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	var line []byte
+	for _, r := range s.Refs {
+		for i, v := range r.Values {
+			if math.IsNaN(v) {
+				continue
+			}
+			begin := i * s.Step
+			end := begin + s.Step
+			if end > r.Length {
+				end = r.Length
+			}
+			line = append(line[:0], r.Name...)
+			line = append(line, '\t')
+			line = strconv.AppendInt(line, int64(begin), 10)
+			line = append(line, '\t')
+			line = strconv.AppendInt(line, int64(end), 10)
+			line = append(line, '\t')
+			line = strconv.AppendFloat(line, v, 'g', 6, 64)
+			line = append(line, '\n')
+			if _, err := bw.Write(line); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
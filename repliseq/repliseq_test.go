@@ -0,0 +1,228 @@
+package repliseq
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/joiningdata/bam"
+)
+
+// testRead is a 50M read without bases.
+type testRead struct {
+	ref  int32
+	pos  int32
+	flag uint16
+	mapq uint8
+}
+
+// encodeBAM builds an uncompressed BAM stream and BGZF compresses it.
+func encodeBAM(t *testing.T, refs []bam.Reference, reads []testRead) []byte {
+	le := binary.LittleEndian
+	var text strings.Builder
+	text.WriteString("@HD\tVN:1.6\tSO:coordinate\n")
+	for _, r := range refs {
+		text.WriteString("@SQ\tSN:" + r.Name + "\tLN:" + strconv.Itoa(r.Length) + "\n")
+	}
+	data := []byte("BAM\x01")
+	data = le.AppendUint32(data, uint32(text.Len()))
+	data = append(data, text.String()...)
+	data = le.AppendUint32(data, uint32(len(refs)))
+	for _, r := range refs {
+		data = le.AppendUint32(data, uint32(len(r.Name)+1))
+		data = append(data, r.Name...)
+		data = append(data, 0)
+		data = le.AppendUint32(data, uint32(r.Length))
+	}
+	for i, r := range reads {
+		name := "read" + strconv.Itoa(i)
+		rec := le.AppendUint32(nil, uint32(r.ref))
+		rec = le.AppendUint32(rec, uint32(r.pos))
+		rec = append(rec, byte(len(name)+1), r.mapq)
+		rec = le.AppendUint16(rec, uint16(4681+r.pos>>14))
+		rec = le.AppendUint16(rec, 1)
+		rec = le.AppendUint16(rec, r.flag)
+		rec = le.AppendUint32(rec, 0)
+		rec = le.AppendUint32(rec, math.MaxUint32) // next refID -1
+		rec = le.AppendUint32(rec, math.MaxUint32) // next pos -1
+		rec = le.AppendUint32(rec, 0)
+		rec = append(rec, name...)
+		rec = append(rec, 0)
+		rec = le.AppendUint32(rec, 50<<4) // 50M
+		data = le.AppendUint32(data, uint32(len(rec)))
+		data = append(data, rec...)
+	}
+
+	var out bytes.Buffer
+	for off := 0; off < len(data); off += 60000 {
+		end := off + 60000
+		if end > len(data) {
+			end = len(data)
+		}
+		var z bytes.Buffer
+		fw, _ := flate.NewWriter(&z, flate.DefaultCompression)
+		fw.Write(data[off:end])
+		if err := fw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		block := []byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0}
+		block = le.AppendUint16(block, uint16(18+z.Len()+8-1))
+		block = append(block, z.Bytes()...)
+		block = le.AppendUint32(block, crc32.ChecksumIEEE(data[off:end]))
+		block = le.AppendUint32(block, uint32(end-off))
+		out.Write(block)
+	}
+	out.Write([]byte{0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0, 0x1b, 0, 3, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	return out.Bytes()
+}
+
+func openBAM(t *testing.T, refs []bam.Reference, reads []testRead) *bam.AlignmentMap {
+	data := encodeBAM(t, refs, reads)
+	b, err := bam.OpenReaderAt(bytes.NewReader(data), int64(len(data)), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+// spread returns one read every 10 bases of [begin, end) on ref.
+func spread(ref int32, begin, end int32, flag uint16) []testRead {
+	var res []testRead
+	for pos := begin; pos < end; pos += 10 {
+		res = append(res, testRead{ref: ref, pos: pos, flag: flag, mapq: 60})
+	}
+	return res
+}
+
+func TestCompute(t *testing.T) {
+	refs := []bam.Reference{{Name: "chr1", Length: 4000}, {Name: "chr2", Length: 2000}}
+
+	// the early fraction covers the first half of chr1, the late one the
+	// second half. Duplicates of the late fraction in the first half are
+	// filtered out, and its references are in another order.
+	early := openBAM(t, refs, append(spread(0, 0, 2000, 0), spread(1, 0, 1000, 0)...))
+	lateReads := append(spread(0, 0, 1000, 0), spread(1, 0, 2000, bam.FlagDuplicate)...)
+	lateReads = append(lateReads, spread(1, 2000, 4000, 0)...)
+	late := openBAM(t, []bam.Reference{refs[1], refs[0]}, lateReads)
+
+	fractions := []Fraction{
+		{Name: "early", BAM: early, Weight: 1},
+		{Name: "late", BAM: late, Weight: 0},
+	}
+	s, err := Compute(fractions, &Options{Window: 1000, Step: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nan := math.NaN()
+	want := map[string][]float64{
+		"chr1": {100, 100, 0, 0},
+		"chr2": {50, nan},
+	}
+	for _, r := range s.Refs {
+		if !sameValues(r.Values, want[r.Name]) {
+			t.Errorf("%s: got %v, want %v", r.Name, r.Values, want[r.Name])
+		}
+	}
+
+	s, err = Compute(fractions, &Options{Window: 1000, Step: 1000, Method: Log2Ratio})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string][]float64{
+		"chr1": {nan, nan, nan, nan},
+		"chr2": {0, nan},
+	}
+	for _, r := range s.Refs {
+		if !sameValues(r.Values, want[r.Name]) {
+			t.Errorf("log2 %s: got %v, want %v", r.Name, r.Values, want[r.Name])
+		}
+	}
+
+	var buf bytes.Buffer
+	if err = s.WriteBedGraph(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); got != "chr2\t0\t1000\t0\n" {
+		t.Errorf("bedGraph = %q", got)
+	}
+}
+
+func TestComputeFilter(t *testing.T) {
+	refs := []bam.Reference{{Name: "chr1", Length: 2000}}
+	reads := spread(0, 0, 1000, 0)
+	for pos := int32(1000); pos < 2000; pos += 10 {
+		reads = append(reads, testRead{ref: 0, pos: pos, mapq: 5})
+	}
+	early := openBAM(t, refs, reads)
+	late := openBAM(t, refs, spread(0, 0, 2000, 0))
+	fractions := []Fraction{
+		{Name: "early", BAM: early, Weight: 1},
+		{Name: "late", BAM: late, Weight: 0},
+	}
+
+	// the low quality reads are dropped, leaving the early fraction
+	// half as many reads to normalize by
+	filter := bam.DefaultDepthOptions
+	filter.MinMapQ = 20
+	s, err := Compute(fractions, &Options{Window: 1000, Step: 1000, Filter: &filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := s.Refs[0].Values, []float64{100 * 2.0 / 3, 0}; !sameValues(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWindowSums(t *testing.T) {
+	steps := []float64{1, 2, 3, 4, 5}
+	windowSums(steps, 3)
+	if want := []float64{3, 6, 9, 12, 9}; !sameValues(steps, want) {
+		t.Errorf("got %v, want %v", steps, want)
+	}
+}
+
+func sameValues(got, want []float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if math.IsNaN(want[i]) != math.IsNaN(got[i]) || !math.IsNaN(want[i]) && math.Abs(got[i]-want[i]) > 1e-9 {
+			return false
+		}
+	}
+	return true
+}
+
+func TestComputeFilterByName(t *testing.T) {
+	refs := []bam.Reference{{Name: "chr1", Length: 2000}, {Name: "chr2", Length: 2000}}
+	early := openBAM(t, refs, append(spread(0, 0, 1000, 0), spread(1, 0, 1000, 0)...))
+	late := openBAM(t, []bam.Reference{refs[1], refs[0]}, append(spread(0, 0, 1000, 0), spread(1, 1000, 2000, 0)...))
+	fractions := []Fraction{
+		{Name: "early", BAM: early, Weight: 1},
+		{Name: "late", BAM: late, Weight: 0},
+	}
+
+	// rname is looked up in each fraction's own references
+	expr, err := bam.CompileFilter(`rname == "chr1"`, early.References)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter := bam.DefaultDepthOptions
+	filter.Filter = expr
+	s, err := Compute(fractions, &Options{Window: 1000, Step: 1000, Filter: &filter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nan := math.NaN()
+	want := [][]float64{{100, 0}, {nan, nan}}
+	for i, r := range s.Refs {
+		if !sameValues(r.Values, want[i]) {
+			t.Errorf("%s: got %v, want %v", r.Name, r.Values, want[i])
+		}
+	}
+}
@@ -0,0 +1,229 @@
+package bam
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+)
+
+// SampleOptions control Sample. A read's template (all records with its
+// read name) is always kept or dropped as a whole, so mates stay together.
+type SampleOptions struct {
+	// Seed changes which templates are chosen. The same seed always
+	// chooses the same templates.
+	Seed int64
+
+	// Fraction keeps this fraction of the templates, chosen by a hash of
+	// the read name. Zero (or one) keeps them all.
+	Fraction float64
+
+	// Count, when non-zero, keeps exactly this many templates (or all of
+	// them if there are fewer), again chosen by hash. Rather than a
+	// reservoir, it makes a first pass over the reads to find the Count
+	// names with the smallest hashes, and takes the place of Fraction.
+	Count int
+
+	// MaxDepth, when non-zero, drops reads that would take the coverage
+	// above this depth. Reads are kept in order of position, and the
+	// mate of a kept read is always kept.
+	MaxDepth int
+}
+
+// A Sampler is an Iterator over a subsample of the alignments.
+type Sampler struct {
+	b    *AlignmentMap
+	r    *Region
+	o    SampleOptions
+	it   *Iterator
+	keep func(name string) bool
+
+	// reads chosen in Count mode, found on the first call to Next
+	chosen map[string]bool
+
+	// MaxDepth state
+	ends    endHeap
+	decided map[string]bool // decisions for templates with a read still to come
+
+	rec *Alignment
+	err error
+}
+
+// Sample returns a Sampler over the alignments of the region, or of the
+// whole file (in file order, including unmapped reads) if r is nil.
+func (b *AlignmentMap) Sample(r *Region, opts *SampleOptions) *Sampler {
+	s := &Sampler{b: b, r: r}
+	if opts != nil {
+		s.o = *opts
+	}
+	seed := s.o.Seed
+	switch {
+	case s.o.Count > 0:
+		s.keep = func(name string) bool { return s.chosen[name] }
+	case s.o.Fraction > 0 && s.o.Fraction < 1:
+		limit := uint64(s.o.Fraction * math.MaxUint64)
+		s.keep = func(name string) bool { return sampleHash(seed, name) < limit }
+	default:
+		s.keep = func(string) bool { return true }
+	}
+	if s.o.MaxDepth > 0 {
+		s.decided = make(map[string]bool)
+	}
+	return s
+}
+
+func (s *Sampler) source() *Iterator {
+	if s.r == nil {
+		return s.b.All()
+	}
+	return s.b.Fetch(s.r.RefID, s.r.Begin, s.r.End)
+}
+
+// Next advances to the next kept alignment, which will then be available
+// through Record. It returns false at the end or when an error occurred.
+func (s *Sampler) Next() bool {
+	s.rec = nil
+	if s.err != nil {
+		return false
+	}
+	if s.it == nil {
+		if s.o.Count > 0 {
+			if s.err = s.choose(); s.err != nil {
+				return false
+			}
+		}
+		s.it = s.source()
+	}
+	for s.it.Next() {
+		a := s.it.Record()
+		if s.keep(a.ReadName) && (s.o.MaxDepth == 0 || s.underDepth(a)) {
+			s.rec = a
+			return true
+		}
+	}
+	s.err = s.it.Err()
+	return false
+}
+
+// Record returns the current alignment.
+func (s *Sampler) Record() *Alignment {
+	return s.rec
+}
+
+// Err returns the first error encountered.
+func (s *Sampler) Err() error {
+	return s.err
+}
+
+// choose finds the Count templates with the smallest hashes.
+func (s *Sampler) choose() error {
+	h := &nameHeap{}
+	in := make(map[string]bool)
+	it := s.source()
+	for it.Next() {
+		name := it.Record().ReadName
+		if in[name] {
+			continue
+		}
+		v := sampleHash(s.o.Seed, name)
+		if h.Len() < s.o.Count {
+			heap.Push(h, hashedName{v, name})
+			in[name] = true
+		} else if v < (*h)[0].hash {
+			delete(in, (*h)[0].name)
+			(*h)[0] = hashedName{v, name}
+			heap.Fix(h, 0)
+			in[name] = true
+		}
+	}
+	s.chosen = in
+	return it.Err()
+}
+
+// underDepth decides whether a read fits under MaxDepth.
+func (s *Sampler) underDepth(a *Alignment) bool {
+	// secondary and supplementary records follow a decision made for
+	// their template, but leave it for the mate
+	extra := a.flag&(FlagSecondary|FlagSupplementary) != 0
+	if keep, ok := s.decided[a.ReadName]; ok {
+		if !extra {
+			delete(s.decided, a.ReadName)
+		}
+		if keep {
+			s.cover(a)
+		}
+		return keep
+	}
+	if a.flag&FlagUnmapped != 0 || a.refID < 0 {
+		return true
+	}
+
+	// forget the kept reads that ended before this one starts
+	for len(s.ends) > 0 && (s.ends[0].refID != a.refID || s.ends[0].end <= a.pos) {
+		heap.Pop(&s.ends)
+	}
+	keep := len(s.ends) < s.o.MaxDepth
+	if keep {
+		s.cover(a)
+	}
+	if !extra && a.flag&FlagPaired != 0 && a.flag&FlagMateUnmapped == 0 &&
+		(a.nextRefID != a.refID || a.nextPos >= a.pos) {
+		// the mate is still to come
+		s.decided[a.ReadName] = keep
+	}
+	return keep
+}
+
+func (s *Sampler) cover(a *Alignment) {
+	if a.flag&FlagUnmapped == 0 && a.refID >= 0 {
+		heap.Push(&s.ends, readEnd{a.refID, a.End()})
+	}
+}
+
+// sampleHash hashes a read name with the seed, mixing the bits so that
+// similar names are spread evenly.
+func sampleHash(seed int64, name string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	x := h.Sum64() ^ uint64(seed)
+	// splitmix64 finalizer
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+type hashedName struct {
+	hash uint64
+	name string
+}
+
+// nameHeap is a max-heap on hash.
+type nameHeap []hashedName
+
+func (h nameHeap) Len() int            { return len(h) }
+func (h nameHeap) Less(i, j int) bool  { return h[i].hash > h[j].hash }
+func (h nameHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *nameHeap) Push(x interface{}) { *h = append(*h, x.(hashedName)) }
+func (h *nameHeap) Pop() interface{} {
+	x := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return x
+}
+
+type readEnd struct {
+	refID int32
+	end   int32
+}
+
+// endHeap is a min-heap on the end of the kept reads.
+type endHeap []readEnd
+
+func (h endHeap) Len() int            { return len(h) }
+func (h endHeap) Less(i, j int) bool  { return h[i].end < h[j].end }
+func (h endHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *endHeap) Push(x interface{}) { *h = append(*h, x.(readEnd)) }
+func (h *endHeap) Pop() interface{} {
+	x := (*h)[len(*h)-1]
+	*h = (*h)[:len(*h)-1]
+	return x
+}
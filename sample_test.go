@@ -0,0 +1,148 @@
+package bam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// sampleTestRecords returns n sorted pairs, with the first reads starting
+// at every position of [0, n) and their mates 5000 bases later.
+func sampleTestRecords(n int) []*Alignment {
+	seq := "ACGTACGTAC"
+	seq += seq + seq + seq + seq
+	var first, second []*Alignment
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("t%d", i)
+		pos := int32(i)
+		first = append(first, newTestRecord(name, 0, pos, FlagPaired|FlagRead1|FlagMateReverse, "50M", seq).setMate(0, pos+5000, 5050))
+		second = append(second, newTestRecord(name, 0, pos+5000, FlagPaired|FlagRead2|FlagReverse, "50M", seq).setMate(0, pos, -5050))
+	}
+	return append(first, second...)
+}
+
+// sampled reads every kept alignment, checking that each template was
+// kept whole.
+func sampled(t *testing.T, s *Sampler) map[string]int {
+	t.Helper()
+	kept := make(map[string]int)
+	for s.Next() {
+		kept[s.Record().ReadName]++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	for name, n := range kept {
+		if n != 2 {
+			t.Errorf("template %s has %d of its 2 reads", name, n)
+		}
+	}
+	return kept
+}
+
+func TestSampleFraction(t *testing.T) {
+	recs := sampleTestRecords(1000)
+	b := loadTestFile(t, writeTestFiles(t, "sample", recs, true), nil)
+
+	kept := sampled(t, b.Sample(nil, &SampleOptions{Fraction: 0.3, Seed: 1}))
+	if n := len(kept); n < 240 || n > 360 {
+		t.Errorf("kept %d of 1000 templates, want about 300", n)
+	}
+	if again := sampled(t, b.Sample(nil, &SampleOptions{Fraction: 0.3, Seed: 1})); !reflect.DeepEqual(again, kept) {
+		t.Error("the same seed chose other templates")
+	}
+	if other := sampled(t, b.Sample(nil, &SampleOptions{Fraction: 0.3, Seed: 2})); reflect.DeepEqual(other, kept) {
+		t.Error("another seed chose the same templates")
+	}
+
+	// a region keeps the same templates among its reads
+	it := b.Sample(&Region{RefID: 0, Begin: 0, End: 100}, &SampleOptions{Fraction: 0.3, Seed: 1})
+	for it.Next() {
+		if a := it.Record(); kept[a.ReadName] == 0 || a.Pos() >= 100 {
+			t.Errorf("region sample has %s at %d", a.ReadName, a.Pos())
+		}
+	}
+
+	if all := sampled(t, b.Sample(nil, nil)); len(all) != 1000 {
+		t.Errorf("sampling without options kept %d templates", len(all))
+	}
+}
+
+func TestSampleCount(t *testing.T) {
+	recs := sampleTestRecords(1000)
+	b := loadTestFile(t, writeTestFiles(t, "count", recs, true), nil)
+	kept := sampled(t, b.Sample(nil, &SampleOptions{Count: 100, Seed: 7}))
+	if len(kept) != 100 {
+		t.Errorf("kept %d templates, want 100", len(kept))
+	}
+	if all := sampled(t, b.Sample(nil, &SampleOptions{Count: 5000})); len(all) != 1000 {
+		t.Errorf("kept %d templates, want all 1000", len(all))
+	}
+}
+
+func TestSampleMaxDepth(t *testing.T) {
+	recs := sampleTestRecords(1000)
+	b := loadTestFile(t, writeTestFiles(t, "depth", recs, true), nil)
+
+	const maxDepth = 5
+	depth := make([]int, 7000)
+	s := b.Sample(nil, &SampleOptions{MaxDepth: maxDepth})
+	kept := 0
+	for s.Next() {
+		a := s.Record()
+		for p := a.Pos(); p < a.End(); p++ {
+			depth[p]++
+		}
+		kept++
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	max := 0
+	for p, d := range depth {
+		if d > max {
+			max = d
+		}
+		// a read starts at each of these positions, and is kept when
+		// there is no coverage
+		starts := p < 1000 || p >= 5000 && p < 6000
+		if starts && d == 0 {
+			t.Errorf("position %d lost all of its coverage", p)
+			break
+		}
+	}
+	if max != maxDepth {
+		t.Errorf("maximum depth %d, want %d", max, maxDepth)
+	}
+
+	// the mates of the kept first reads are kept too
+	if n := len(sampled(t, b.Sample(nil, &SampleOptions{MaxDepth: maxDepth}))); 2*n != kept {
+		t.Errorf("kept %d templates in %d reads", n, kept)
+	}
+}
+
+func TestSampleMaxDepthSecondary(t *testing.T) {
+	const seq = "ACGTACGTACACGTACGTACACGTACGTACACGTACGTACACGTACGTAC"
+	paired := FlagPaired | FlagRead1 | FlagMateReverse
+	recs := []*Alignment{
+		newTestRecord("x", 0, 100, paired, "50M", seq).setMate(0, 5000, 4950),
+		newTestRecord("x", 0, 200, paired|FlagSecondary, "50M", seq).setMate(0, 5000, 0),
+		newTestRecord("z", 0, 4990, 0, "50M", seq),
+		newTestRecord("x", 0, 5000, FlagPaired|FlagRead2|FlagReverse, "50M", seq).setMate(0, 100, -4950),
+	}
+	b := loadTestFile(t, writeTestFiles(t, "secondary", recs, true), nil)
+
+	// the mate is kept for the first read even though z covers it, and
+	// the secondary record doesn't take the first read's place
+	s := b.Sample(nil, &SampleOptions{MaxDepth: 1})
+	var got []string
+	for s.Next() {
+		got = append(got, s.Record().ReadName)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"x", "x", "z", "x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+}
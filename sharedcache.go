@@ -0,0 +1,221 @@
+package bam
+
+import (
+	"container/list"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// SharedBlockCache, if not nil, is used by Load for every file that isn't
+// given its own Options.Cache. This keeps the total memory used for blocks
+// within one budget no matter how many files are open.
+var SharedBlockCache *SharedCache
+
+// fairScan is how many of the least recently used items are considered
+// when looking for an item of a file using more than its fair share.
+const fairScan = 16
+
+// A SharedCache is an S4-LRU block cache with a single byte budget that
+// is shared by many files. Blocks are keyed by file identity and offset.
+//
+// When the cache is full, blocks from files holding more than an equal
+// share of the budget are evicted first, so that one busy file can't push
+// out everything else.
+type SharedCache struct {
+	mu  sync.Mutex
+	lru s4lru
+
+	ids      map[string]int
+	files    map[int]*sharedFile // indexed by blockKey.file
+	nextFile int
+	active   int // number of files holding any blocks
+	stats    CacheStats
+}
+
+// sharedFile tracks the users, blocks and usage of one file in a
+// SharedCache.
+type sharedFile struct {
+	id     string
+	refs   int
+	blocks map[int64]*cacheItem
+	stats  CacheStats
+}
+
+// NewSharedCache creates a SharedCache that holds at most maxBytes of
+// uncompressed block data across all files.
+func NewSharedCache(maxBytes int64) *SharedCache {
+	c := &SharedCache{
+		ids:   make(map[string]int),
+		files: make(map[int]*sharedFile),
+	}
+	c.lru.init(maxBytes, c.evicted)
+	c.lru.victim = c.victim
+	return c
+}
+
+// ForFile returns the BlockCache for the file with the given identity.
+// Every call with the same id returns a view of the same blocks, which are
+// kept until each view has been released with ReleaseFile.
+func (c *SharedCache) ForFile(id string) BlockCache {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fid, ok := c.ids[id]
+	if !ok {
+		fid = c.nextFile
+		c.nextFile++
+		c.ids[id] = fid
+		c.files[fid] = &sharedFile{id: id, blocks: make(map[int64]*cacheItem)}
+	}
+	c.files[fid].refs++
+	return &sharedFileCache{c: c, file: fid}
+}
+
+// ReleaseFile gives up a view returned by ForFile. Once every view of a
+// file is released, its blocks are dropped from the cache. AlignmentMap.Close
+// does this for the views it took from SharedBlockCache.
+func (c *SharedCache) ReleaseFile(bc BlockCache) {
+	x, ok := bc.(*sharedFileCache)
+	if !ok || x.c != c {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fs := c.files[x.file]
+	if fs == nil {
+		return
+	}
+	if fs.refs--; fs.refs > 0 {
+		return
+	}
+	for _, item := range fs.blocks {
+		c.lru.remove(item)
+		c.stats.Bytes -= int64(len(item.value))
+	}
+	if fs.stats.Bytes > 0 {
+		c.active--
+	}
+	delete(c.ids, fs.id)
+	delete(c.files, x.file)
+}
+
+// Stats returns the usage counters across all files.
+func (c *SharedCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *SharedCache) get(key blockKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fs := c.files[key.file]
+	var item *cacheItem
+	if fs != nil {
+		item = fs.blocks[key.off]
+	}
+	if item == nil {
+		c.stats.Misses++
+		if fs != nil {
+			fs.stats.Misses++
+		}
+		return nil, false
+	}
+	c.stats.Hits++
+	fs.stats.Hits++
+	c.lru.hit(item)
+	return item.value, true
+}
+
+func (c *SharedCache) set(key blockKey, value []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fs := c.files[key.file]
+	if fs == nil {
+		// the file was released, so nobody will look for the block
+		return
+	}
+	if _, ok := fs.blocks[key.off]; ok {
+		return
+	}
+	item := &cacheItem{key: key, value: value}
+	fs.blocks[key.off] = item
+	c.stats.Bytes += int64(len(value))
+	if fs.stats.Bytes == 0 {
+		c.active++
+	}
+	fs.stats.Bytes += int64(len(value))
+	c.lru.add(item)
+}
+
+func (c *SharedCache) evicted(item *cacheItem) {
+	fs := c.files[item.key.file]
+	delete(fs.blocks, item.key.off)
+	c.stats.Bytes -= int64(len(item.value))
+	c.stats.Evictions++
+	fs.stats.Bytes -= int64(len(item.value))
+	fs.stats.Evictions++
+	if fs.stats.Bytes == 0 {
+		c.active--
+	}
+}
+
+// victim chooses the item to move out of queue q. It prefers the least
+// recently used item of a file holding more than its fair share.
+func (c *SharedCache) victim(q *list.List) *list.Element {
+	back := q.Back()
+	if c.active < 2 {
+		return back
+	}
+	share := 4 * c.lru.cap / int64(c.active)
+	e := back
+	for i := 0; i < fairScan && e != nil; i++ {
+		if c.files[e.Value.(*cacheItem).key.file].stats.Bytes > share {
+			return e
+		}
+		e = e.Prev()
+	}
+	return back
+}
+
+// sharedFileCache is the BlockCache view of one file in a SharedCache.
+type sharedFileCache struct {
+	c    *SharedCache
+	file int
+}
+
+func (x *sharedFileCache) Get(key int64) ([]byte, bool) {
+	return x.c.get(blockKey{x.file, key})
+}
+
+func (x *sharedFileCache) Set(key int64, value []byte) {
+	x.c.set(blockKey{x.file, key}, value)
+}
+
+func (x *sharedFileCache) Stats() CacheStats {
+	x.c.mu.Lock()
+	defer x.c.mu.Unlock()
+	if fs := x.c.files[x.file]; fs != nil {
+		return fs.stats
+	}
+	return CacheStats{}
+}
+
+// fileIdentity names a file by its absolute path, size and modification
+// time, so a file that is rewritten in place doesn't reuse stale blocks.
+func fileIdentity(f *os.File) (string, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	name, err := filepath.Abs(f.Name())
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%d:%d", name, fi.Size(), fi.ModTime().UnixNano()), nil
+}
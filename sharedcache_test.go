@@ -0,0 +1,95 @@
+package bam
+
+import (
+	"testing"
+)
+
+// withSharedCache sets SharedBlockCache for the duration of a test.
+func withSharedCache(t *testing.T, maxBytes int64) *SharedCache {
+	c := NewSharedCache(maxBytes)
+	old := SharedBlockCache
+	SharedBlockCache = c
+	t.Cleanup(func() { SharedBlockCache = old })
+	return c
+}
+
+func TestSharedCacheRelease(t *testing.T) {
+	c := withSharedCache(t, 1<<20)
+	recs := manyTestRecords(2000)
+	f1 := writeTestFiles(t, "one", recs, true)
+	f2 := writeTestFiles(t, "two", recs, true)
+
+	a, err := LoadWithOptions(f1, &Options{IndexOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := LoadWithOptions(f1, &Options{IndexOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := LoadWithOptions(f2, &Options{IndexOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(t, a.Fetch(0, 0, 5000))
+	collect(t, b.Fetch(0, 0, 5000))
+	if len(c.files) != 2 {
+		t.Fatalf("cache tracks %d files, want 2", len(c.files))
+	}
+
+	// the second view of the same file shares its blocks
+	misses := c.Stats().Misses
+	collect(t, again.Fetch(0, 0, 5000))
+	if c.Stats().Misses != misses {
+		t.Error("reopened file didn't reuse the cached blocks")
+	}
+
+	a.Close()
+	if got := again.CacheStats().Bytes; got == 0 {
+		t.Error("closing one view dropped the blocks still used by another")
+	}
+	again.Close()
+	b.Close()
+	queued := 0
+	for i := range c.lru.queues {
+		queued += c.lru.queues[i].Len()
+	}
+	if st := c.Stats(); st.Bytes != 0 || len(c.files) != 0 || len(c.ids) != 0 || queued != 0 {
+		t.Errorf("closed files left %d bytes, %d files, %d ids and %d blocks", st.Bytes, len(c.files), len(c.ids), queued)
+	}
+}
+
+func TestSharedCacheFairShare(t *testing.T) {
+	c := NewSharedCache(8 << 10)
+	busy, quiet := c.ForFile("busy"), c.ForFile("quiet")
+	block := make([]byte, 1<<10)
+
+	// the busy file fills every queue
+	for off := int64(0); off < 8; off++ {
+		busy.Set(off, block)
+		for i := 0; i < 3; i++ {
+			busy.Get(off)
+		}
+	}
+	quiet.Set(0, block)
+
+	// new blocks of the busy file push out its own older blocks, even
+	// once the quiet file's block is the least recently used
+	for off := int64(100); off < 110; off++ {
+		busy.Set(off, block)
+	}
+	if _, ok := quiet.Get(0); !ok {
+		t.Error("the quiet file's block was evicted")
+	}
+	if got := busy.Stats().Bytes + quiet.Stats().Bytes; got != c.Stats().Bytes || got > 8<<10 {
+		t.Errorf("files hold %d bytes, the cache %d", got, c.Stats().Bytes)
+	}
+
+	c.ReleaseFile(busy)
+	if st := c.Stats(); st.Bytes != 1<<10 {
+		t.Errorf("releasing the busy file left %d bytes", st.Bytes)
+	}
+	if _, ok := quiet.Get(0); !ok {
+		t.Error("releasing the busy file dropped the quiet file's block")
+	}
+}
@@ -0,0 +1,405 @@
+package bam
+
+import (
+	"compress/flate"
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// SortOrder is the order of the alignments written by Sort.
+type SortOrder int
+
+const (
+	// SortCoordinate orders by reference, position and strand, with the
+	// unplaced reads last.
+	SortCoordinate SortOrder = iota
+
+	// SortQueryName orders by read name, comparing runs of digits by
+	// their numeric value as samtools does, then read1 before read2.
+	SortQueryName
+
+	// SortTag orders by the value of an aux tag, then by coordinate.
+	// Reads without the tag come first.
+	SortTag
+)
+
+// sortRecordOverhead approximates the memory used by an Alignment beyond
+// its encoded size.
+const sortRecordOverhead = 256
+
+// SortOptions control Sort.
+type SortOptions struct {
+	Order SortOrder
+
+	// Tag is the aux tag to sort by, such as "CB", for SortTag.
+	Tag string
+
+	// MaxMemory is the approximate memory used to hold alignments before
+	// they are spilled to a temporary file. Zero uses MaxBAMMemory. It
+	// only applies to streamed files (opened with IndexOnly, or too large
+	// to load); the alignments of a fully loaded file are already in
+	// memory and are sorted there.
+	MaxMemory int64
+
+	// TempDir holds the temporary files, os.TempDir() if empty.
+	TempDir string
+}
+
+// Sort writes all of the alignments to w as a BAM file in the chosen
+// order, updating the SO: field of the header. When the alignments of a
+// streamed file don't fit in the memory budget, sorted runs are written
+// to temporary files and merged. A nil opts sorts by coordinate.
+func (b *AlignmentMap) Sort(w io.Writer, opts *SortOptions) error {
+	o := SortOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.MaxMemory <= 0 {
+		o.MaxMemory = MaxBAMMemory
+	}
+	var less func(x, y *Alignment) bool
+	header := b.Header
+	switch o.Order {
+	case SortCoordinate:
+		less = coordinateLess
+		header = setSortOrder(header, "coordinate")
+	case SortQueryName:
+		less = queryNameLess
+		header = setSortOrder(header, "queryname")
+	case SortTag:
+		if len(o.Tag) != 2 {
+			return fmt.Errorf("bam: invalid sort tag %q", o.Tag)
+		}
+		less = tagLess(o.Tag)
+		header = setSortOrder(header, "unknown")
+	default:
+		return fmt.Errorf("bam: unknown sort order %d", o.Order)
+	}
+
+	var runs []string
+	defer func() {
+		for _, name := range runs {
+			os.Remove(name)
+		}
+	}()
+
+	var pending []*Alignment
+	var used int64
+	it := b.All()
+	for it.Next() {
+		a := it.Record()
+		pending = append(pending, a)
+		used += int64(36+len(a.ReadName)+4*len(a.cigarPacked)+len(a.seqPacked)+len(a.qual)+len(a.aux)) + sortRecordOverhead
+		if b.partial && used >= o.MaxMemory {
+			sort.SliceStable(pending, func(i, j int) bool { return less(pending[i], pending[j]) })
+			name, err := b.spillRun(pending, &o)
+			if name != "" {
+				runs = append(runs, name)
+			}
+			if err != nil {
+				return err
+			}
+			pending, used = nil, 0
+		}
+	}
+	if err := it.Err(); err != nil {
+		return err
+	}
+	sort.SliceStable(pending, func(i, j int) bool { return less(pending[i], pending[j]) })
+
+	bw, err := NewWriter(w, header, b.References)
+	if err != nil {
+		return err
+	}
+	if len(runs) == 0 {
+		for _, a := range pending {
+			if err = bw.Write(a); err != nil {
+				return err
+			}
+		}
+		return bw.Close()
+	}
+
+	// k-way merge of the runs, with the alignments still in memory as
+	// the last run
+	h := &mergeHeap{less: less}
+	for i, name := range runs {
+		rb, err := openRun(name)
+		if err != nil {
+			return err
+		}
+		defer rb.Close()
+		if err = h.push(&mergeSource{it: rb.All(), idx: i}); err != nil {
+			return err
+		}
+	}
+	if err = h.push(&mergeSource{list: pending, idx: len(runs)}); err != nil {
+		return err
+	}
+	for h.Len() > 0 {
+		s := h.srcs[0]
+		if err = bw.Write(s.cur); err != nil {
+			return err
+		}
+		if s.next() {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+		if s.err != nil {
+			return s.err
+		}
+	}
+	return bw.Close()
+}
+
+// spillRun writes sorted alignments to a temporary BAM file, returning
+// its name.
+func (b *AlignmentMap) spillRun(list []*Alignment, o *SortOptions) (string, error) {
+	f, err := os.CreateTemp(o.TempDir, "bamsort-*.bam")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	bw, err := newWriterLevel(f, b.Header, b.References, flate.BestSpeed)
+	if err != nil {
+		return f.Name(), err
+	}
+	for _, a := range list {
+		if err = bw.Write(a); err != nil {
+			return f.Name(), err
+		}
+	}
+	if err = bw.Close(); err != nil {
+		return f.Name(), err
+	}
+	return f.Name(), f.Close()
+}
+
+// openRun opens a temporary sorted run for streaming, without loading
+// its alignments or needing an index.
+func openRun(filename string) (*AlignmentMap, error) {
+	ff, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := ff.Stat()
+	if err != nil {
+		ff.Close()
+		return nil, err
+	}
+	f, err := open(ff, fi.Size(), &Options{Cache: newLRUCache(4 << 20)}, true)
+	if err != nil {
+		ff.Close()
+		return nil, err
+	}
+	f.filename = filename
+	f.closer = ff
+	return f, nil
+}
+
+// mergeSource is one sorted input of the merge.
+type mergeSource struct {
+	it   *Iterator
+	rest []*Iterator // read in turn once it is done
+	list []*Alignment
+	idx  int                         // breaks ties, keeping the merge stable
+	fix  func(*Alignment) *Alignment // rewrites each record, if set
+
+	cur *Alignment
+	err error
+}
+
+func (s *mergeSource) next() bool {
+	if s.it == nil {
+		if len(s.list) == 0 {
+			return false
+		}
+		s.cur, s.list = s.list[0], s.list[1:]
+		return true
+	}
+	for !s.it.Next() {
+		if s.err = s.it.Err(); s.err != nil || len(s.rest) == 0 {
+			return false
+		}
+		s.it, s.rest = s.rest[0], s.rest[1:]
+	}
+	s.cur = s.it.Record()
+	if s.fix != nil {
+		s.cur = s.fix(s.cur)
+	}
+	return true
+}
+
+type mergeHeap struct {
+	srcs []*mergeSource
+	less func(x, y *Alignment) bool
+}
+
+// push adds a source positioned at its first alignment, if it has one.
+func (h *mergeHeap) push(s *mergeSource) error {
+	if s.next() {
+		heap.Push(h, s)
+	}
+	return s.err
+}
+
+func (h *mergeHeap) Len() int      { return len(h.srcs) }
+func (h *mergeHeap) Swap(i, j int) { h.srcs[i], h.srcs[j] = h.srcs[j], h.srcs[i] }
+func (h *mergeHeap) Less(i, j int) bool {
+	x, y := h.srcs[i], h.srcs[j]
+	if h.less(x.cur, y.cur) {
+		return true
+	}
+	if h.less(y.cur, x.cur) {
+		return false
+	}
+	return x.idx < y.idx
+}
+func (h *mergeHeap) Push(x interface{}) { h.srcs = append(h.srcs, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	s := h.srcs[len(h.srcs)-1]
+	h.srcs = h.srcs[:len(h.srcs)-1]
+	return s
+}
+
+// coordinateKey orders as samtools does: unplaced reads (refID -1) sort
+// last, then by position and strand.
+func coordinateKey(a *Alignment) uint64 {
+	rev := uint64(0)
+	if a.flag&FlagReverse != 0 {
+		rev = 1
+	}
+	return uint64(uint32(a.refID))<<32 | uint64(uint32(a.pos+1))<<1 | rev
+}
+
+func coordinateLess(x, y *Alignment) bool {
+	return coordinateKey(x) < coordinateKey(y)
+}
+
+func queryNameLess(x, y *Alignment) bool {
+	if c := naturalCompare(x.ReadName, y.ReadName); c != 0 {
+		return c < 0
+	}
+	if fx, fy := x.flag&(FlagRead1|FlagRead2), y.flag&(FlagRead1|FlagRead2); fx != fy {
+		return fx < fy
+	}
+	return x.flag&(FlagSecondary|FlagSupplementary) < y.flag&(FlagSecondary|FlagSupplementary)
+}
+
+func tagLess(tag string) func(x, y *Alignment) bool {
+	return func(x, y *Alignment) bool {
+		if c := compareAux(x.AuxData[tag], y.AuxData[tag]); c != 0 {
+			return c < 0
+		}
+		return coordinateLess(x, y)
+	}
+}
+
+// compareAux compares two aux values. Missing values come first, then
+// numbers, then strings.
+func compareAux(x, y interface{}) int {
+	kx, nx, sx := auxKey(x)
+	ky, ny, sy := auxKey(y)
+	switch {
+	case kx != ky:
+		return kx - ky
+	case nx < ny, sx < sy:
+		return -1
+	case nx > ny, sx > sy:
+		return 1
+	}
+	return 0
+}
+
+// auxKey returns the kind (0 missing, 1 number, 2 string) and comparable
+// value of an aux value.
+func auxKey(v interface{}) (int, float64, string) {
+	switch x := v.(type) {
+	case nil:
+		return 0, 0, ""
+	case int8:
+		return 1, float64(x), ""
+	case uint8:
+		return 1, float64(x), ""
+	case int16:
+		return 1, float64(x), ""
+	case uint16:
+		return 1, float64(x), ""
+	case int32:
+		return 1, float64(x), ""
+	case uint32:
+		return 1, float64(x), ""
+	case float32:
+		return 1, float64(x), ""
+	case string:
+		return 2, 0, x
+	}
+	return 2, 0, fmt.Sprint(v)
+}
+
+// naturalCompare compares strings like samtools' strnum_cmp: runs of
+// digits compare by numeric value, so "r2" sorts before "r10".
+func naturalCompare(a, b string) int {
+	isDigit := func(s string, i int) bool { return i < len(s) && s[i] >= '0' && s[i] <= '9' }
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		if !isDigit(a, i) || !isDigit(b, j) {
+			if a[i] != b[j] {
+				return int(a[i]) - int(b[j])
+			}
+			i++
+			j++
+			continue
+		}
+
+		// skip leading zeros, remembering how many for a final tie break
+		zi, zj := i, j
+		for i < len(a) && a[i] == '0' {
+			i++
+		}
+		for j < len(b) && b[j] == '0' {
+			j++
+		}
+		zi, zj = i-zi, j-zj
+		for isDigit(a, i) && isDigit(b, j) && a[i] == b[j] {
+			i++
+			j++
+		}
+		if isDigit(a, i) && isDigit(b, j) {
+			// the first differing digit decides, unless one number is longer
+			k := 0
+			for isDigit(a, i+k) && isDigit(b, j+k) {
+				k++
+			}
+			switch {
+			case isDigit(a, i+k):
+				return 1
+			case isDigit(b, j+k):
+				return -1
+			}
+			return int(a[i]) - int(b[j])
+		}
+		switch {
+		case isDigit(a, i):
+			return 1
+		case isDigit(b, j):
+			return -1
+		case zi != zj:
+			if zi < zj {
+				return 1
+			}
+			return -1
+		}
+	}
+	switch {
+	case i < len(a):
+		return 1
+	case j < len(b):
+		return -1
+	}
+	return 0
+}
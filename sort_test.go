@@ -0,0 +1,131 @@
+package bam
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// shuffledTestRecords returns the records of manyTestRecords and a few
+// unplaced reads in random order, with a CB tag on every other read.
+func shuffledTestRecords(n int) []*Alignment {
+	recs := manyTestRecords(n)
+	for _, name := range []string{"u10", "u9"} {
+		recs = append(recs, newTestRecord(name, -1, -1, FlagUnmapped, "*", "ACGT"))
+	}
+	for i, a := range recs {
+		if i%2 == 0 {
+			a.SetAux("CB", string(rune('A'+i%5)))
+		}
+	}
+	rand.New(rand.NewSource(1)).Shuffle(len(recs), func(i, j int) { recs[i], recs[j] = recs[j], recs[i] })
+	return recs
+}
+
+// checkSorted decodes the output of Sort and checks it holds the input
+// reads in order.
+func checkSorted(t *testing.T, data []byte, in []*Alignment, less func(x, y *Alignment) bool, so string) {
+	t.Helper()
+	b, out := readTestBAM(t, data)
+	if !strings.Contains(b.Header, "\tSO:"+so) {
+		t.Errorf("header doesn't have SO:%s: %q", so, b.Header)
+	}
+	if len(out) != len(in) {
+		t.Fatalf("sorted %d reads, want %d", len(out), len(in))
+	}
+	for i := 1; i < len(out); i++ {
+		if less(out[i], out[i-1]) {
+			t.Fatalf("%s before %s", out[i-1].ReadName, out[i].ReadName)
+		}
+	}
+	got, want := names(out), names(in)
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Error("sorted reads differ from the input")
+	}
+}
+
+func TestSort(t *testing.T) {
+	recs := shuffledTestRecords(2000)
+	filename := writeTestFiles(t, "unsorted", recs, false)
+	b := loadTestFile(t, filename, nil)
+
+	tests := []struct {
+		opts SortOptions
+		less func(x, y *Alignment) bool
+		so   string
+	}{
+		{SortOptions{Order: SortCoordinate}, coordinateLess, "coordinate"},
+		{SortOptions{Order: SortQueryName}, queryNameLess, "queryname"},
+		{SortOptions{Order: SortTag, Tag: "CB"}, tagLess("CB"), "unknown"},
+	}
+	for _, tc := range tests {
+		var buf bytes.Buffer
+		if err := b.Sort(&buf, &tc.opts); err != nil {
+			t.Fatal(err)
+		}
+		checkSorted(t, buf.Bytes(), recs, tc.less, tc.so)
+	}
+
+	if err := b.Sort(&bytes.Buffer{}, &SortOptions{Order: SortTag, Tag: "C"}); err == nil {
+		t.Error("sorting by an invalid tag succeeded")
+	}
+}
+
+func TestSortSpill(t *testing.T) {
+	recs := shuffledTestRecords(2000)
+	filename := writeTestFiles(t, "spill", recs, false)
+	b, err := openRun(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	// a budget of about 100 reads spills 20 runs
+	tmp := t.TempDir()
+	opts := &SortOptions{MaxMemory: 50 << 10, TempDir: tmp}
+	var buf bytes.Buffer
+	if err = b.Sort(&buf, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkSorted(t, buf.Bytes(), recs, coordinateLess, "coordinate")
+	if left, _ := os.ReadDir(tmp); len(left) != 0 {
+		t.Errorf("%d temporary files were left behind", len(left))
+	}
+
+	// the runs go to TempDir, so a missing one shows that the file was
+	// spilled, while a fully loaded file is sorted in memory
+	opts.TempDir = filepath.Join(tmp, "missing")
+	if err = b.Sort(&bytes.Buffer{}, opts); err == nil {
+		t.Error("streamed file was sorted without spilling")
+	}
+	if err = loadTestFile(t, filename, nil).Sort(&bytes.Buffer{}, opts); err != nil {
+		t.Errorf("loaded file was spilled: %v", err)
+	}
+}
+
+func TestNaturalCompare(t *testing.T) {
+	tests := []struct {
+		a, b string
+		sign int
+	}{
+		{"r2", "r10", -1},
+		{"r10", "r10", 0},
+		{"r010", "r10", -1}, // more leading zeros first
+		{"a1b2", "a1b10", -1},
+		{"abc", "abd", -1},
+		{"r1", "r1x", -1},
+	}
+	for _, tc := range tests {
+		c := naturalCompare(tc.a, tc.b)
+		if c < 0 && tc.sign >= 0 || c > 0 && tc.sign <= 0 || c == 0 && tc.sign != 0 {
+			t.Errorf("naturalCompare(%q, %q) = %d", tc.a, tc.b, c)
+		}
+	}
+}
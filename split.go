@@ -0,0 +1,265 @@
+package bam
+
+import (
+	"compress/flate"
+	"container/list"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SplitBy chooses how Split groups the alignments.
+type SplitBy int
+
+const (
+	// SplitReadGroup groups by the RG tag. Each file's header keeps only
+	// the @RG line of its read group.
+	SplitReadGroup SplitBy = iota
+
+	// SplitTag groups by the value of SplitOptions.Tag, such as a CB
+	// cell barcode.
+	SplitTag
+
+	// SplitReference groups by reference name. The reference dictionary
+	// is kept whole, since mates may be placed on other references.
+	SplitReference
+)
+
+// SplitOptions control Split.
+type SplitOptions struct {
+	By SplitBy
+
+	// Tag is the aux tag to group by for SplitTag.
+	Tag string
+
+	// Path is the template of the output file names, with "%s" replaced
+	// by the group name. Group names containing a path separator, or
+	// that are "." or "..", are an error.
+	Path string
+
+	// Unmatched is the group name used for alignments without a read
+	// group, tag value or reference. If empty they are left out.
+	Unmatched string
+
+	// MaxOpen is the most output files held open at once, 64 if zero.
+	// Other files are closed and reopened when they are next written to.
+	MaxOpen int
+}
+
+// A SplitFile describes one of the files written by Split.
+type SplitFile struct {
+	Group string
+	Path  string
+	Count int
+}
+
+// Split writes the alignments of each group to its own BAM file, in the
+// order they appear in the file. It returns the files written in the
+// order their groups were first seen.
+func (b *AlignmentMap) Split(opts *SplitOptions) ([]SplitFile, error) {
+	o := *opts
+	if !strings.Contains(o.Path, "%s") {
+		return nil, fmt.Errorf("bam: split path %q has no %%s for the group name", o.Path)
+	}
+	if o.By == SplitTag && len(o.Tag) != 2 {
+		return nil, fmt.Errorf("bam: invalid split tag %q", o.Tag)
+	}
+	if o.MaxOpen <= 0 {
+		o.MaxOpen = 64
+	}
+
+	s := &splitter{b: b, o: &o, outs: make(map[string]*splitOutput), paths: make(map[string]string), lru: list.New()}
+	err := s.run()
+	if cerr := s.close(); err == nil {
+		err = cerr
+	}
+
+	res := make([]SplitFile, len(s.order))
+	for i, out := range s.order {
+		res[i] = SplitFile{Group: out.group, Path: out.path, Count: out.count}
+	}
+	return res, err
+}
+
+type splitter struct {
+	b     *AlignmentMap
+	o     *SplitOptions
+	outs  map[string]*splitOutput
+	paths map[string]string // group of each output path
+	order []*splitOutput
+	lru   *list.List // open outputs, most recently used first
+}
+
+type splitOutput struct {
+	group string
+	path  string
+	count int
+
+	// set while the file is open
+	f    *os.File
+	w    *Writer
+	elem *list.Element
+}
+
+func (s *splitter) run() error {
+	it := s.b.All()
+	for it.Next() {
+		a := it.Record()
+		group, ok := s.group(a)
+		if !ok {
+			if s.o.Unmatched == "" {
+				continue
+			}
+			group = s.o.Unmatched
+		}
+		out, err := s.open(group)
+		if err != nil {
+			return err
+		}
+		if err = out.w.Write(a); err != nil {
+			return err
+		}
+		out.count++
+	}
+	return it.Err()
+}
+
+// group returns the group name of an alignment. Tag values are formatted
+// as the VALUE of their SAM text, so a B array gives "c,1,2".
+func (s *splitter) group(a *Alignment) (string, bool) {
+	switch s.o.By {
+	case SplitReadGroup:
+		rg, ok := a.AuxData["RG"].(string)
+		return rg, ok && rg != ""
+	case SplitTag:
+		v, ok := a.samAux(s.o.Tag)
+		if !ok {
+			return "", false
+		}
+		return v[5:], true
+	default:
+		if a.refID < 0 || int(a.refID) >= len(s.b.References) {
+			return "", false
+		}
+		return s.b.References[a.refID].Name, true
+	}
+}
+
+// open returns the output of a group with its file open, creating the
+// file the first time and closing the least recently used one if too
+// many are open.
+func (s *splitter) open(group string) (*splitOutput, error) {
+	out, ok := s.outs[group]
+	if ok && out.w != nil {
+		s.lru.MoveToFront(out.elem)
+		return out, nil
+	}
+	if s.lru.Len() >= s.o.MaxOpen {
+		if err := s.lru.Back().Value.(*splitOutput).suspend(); err != nil {
+			return nil, err
+		}
+		s.lru.Remove(s.lru.Back())
+	}
+
+	var err error
+	if !ok {
+		var path string
+		if path, err = splitPath(s.o.Path, group); err != nil {
+			return nil, err
+		}
+		if other, dup := s.paths[path]; dup {
+			return nil, fmt.Errorf("bam: split groups %q and %q both write to %s", other, group, path)
+		}
+		s.paths[path] = group
+		out = &splitOutput{group: group, path: path}
+		s.outs[group] = out
+		s.order = append(s.order, out)
+		if out.f, err = os.Create(out.path); err != nil {
+			return nil, err
+		}
+		out.w, err = NewWriter(out.f, s.header(group), s.b.References)
+	} else {
+		if out.f, err = os.OpenFile(out.path, os.O_WRONLY|os.O_APPEND, 0); err != nil {
+			return nil, err
+		}
+		out.w, err = newBlockWriter(out.f, flate.DefaultCompression)
+	}
+	if err != nil {
+		out.f.Close()
+		out.f, out.w = nil, nil
+		return nil, err
+	}
+	out.elem = s.lru.PushFront(out)
+	return out, nil
+}
+
+// suspend writes the pending block and closes the file, leaving it
+// without the end-of-file marker until it is reopened.
+func (out *splitOutput) suspend() error {
+	out.w.flush()
+	err := out.w.err
+	if cerr := out.f.Close(); err == nil {
+		err = cerr
+	}
+	out.f, out.w, out.elem = nil, nil, nil
+	return err
+}
+
+// close finishes every output file.
+func (s *splitter) close() error {
+	var err error
+	for _, out := range s.order {
+		if cerr := out.finish(); err == nil {
+			err = cerr
+		}
+	}
+	s.lru.Init()
+	return err
+}
+
+// finish writes the end-of-file marker, reopening the file if needed.
+func (out *splitOutput) finish() error {
+	if out.w == nil {
+		f, err := os.OpenFile(out.path, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		out.f = f
+		if out.w, err = newBlockWriter(f, flate.DefaultCompression); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	err := out.w.Close()
+	if cerr := out.f.Close(); err == nil {
+		err = cerr
+	}
+	out.f, out.w, out.elem = nil, nil, nil
+	return err
+}
+
+// header returns the SAM header for a group's file.
+func (s *splitter) header(group string) string {
+	if s.o.By != SplitReadGroup {
+		return s.b.Header
+	}
+	var sb strings.Builder
+	for _, line := range strings.SplitAfter(s.b.Header, "\n") {
+		if strings.HasPrefix(line, "@RG\t") {
+			if id, _ := headerField(line, "ID"); id != group {
+				continue
+			}
+		}
+		sb.WriteString(line)
+	}
+	return sb.String()
+}
+
+// splitPath fills the group name into a path template, rejecting names
+// that would write outside of the template's directory.
+func splitPath(template, group string) (string, error) {
+	if group == "" || group == "." || group == ".." || strings.ContainsAny(group, `/\`) || strings.ContainsRune(group, os.PathSeparator) {
+		return "", fmt.Errorf("bam: invalid split group name %q", group)
+	}
+	return strings.ReplaceAll(template, "%s", group), nil
+}
@@ -0,0 +1,148 @@
+package bam
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// splitTestRecords returns reads in interleaved read groups g0 to g4,
+// with every seventh read without one.
+func splitTestRecords() ([]*Alignment, []string) {
+	recs := manyTestRecords(500)
+	for i, a := range recs {
+		if i%7 != 0 {
+			a.SetAux("RG", "g"+string(rune('0'+i%5)))
+		}
+	}
+	var extra []string
+	for g := 0; g < 5; g++ {
+		extra = append(extra, "@RG\tID:g"+string(rune('0'+g))+"\tSM:s")
+	}
+	return recs, extra
+}
+
+// readSplitFile reads back one of the files written by Split.
+func readSplitFile(t *testing.T, f SplitFile) *AlignmentMap {
+	t.Helper()
+	data, err := os.ReadFile(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, recs := readTestBAM(t, data)
+	if len(recs) != f.Count {
+		t.Errorf("%s has %d reads, want %d", f.Path, len(recs), f.Count)
+	}
+	return b
+}
+
+func TestSplit(t *testing.T) {
+	recs, extra := splitTestRecords()
+	data := writeTestBAM(t, testHeader(testRefs, extra...), testRefs, recs)
+	b, _ := readTestBAM(t, data)
+
+	for _, maxOpen := range []int{1, 2, 0} {
+		dir := t.TempDir()
+		files, err := b.Split(&SplitOptions{
+			Path:      filepath.Join(dir, "out_%s.bam"),
+			Unmatched: "none",
+			MaxOpen:   maxOpen,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var groups []string
+		total := 0
+		for _, f := range files {
+			groups = append(groups, f.Group)
+			out := readSplitFile(t, f)
+			total += f.Count
+
+			// the reads are in file order, with only their own @RG line
+			var want []string
+			for i, a := range recs {
+				rg, _ := a.AuxData["RG"].(string)
+				if rg == f.Group || rg == "" && f.Group == "none" && i%7 == 0 {
+					want = append(want, a.ReadName)
+				}
+			}
+			if got := names(out.Alignments); !reflect.DeepEqual(got, want) {
+				t.Errorf("MaxOpen %d: %s has %d reads, want %d", maxOpen, f.Group, len(got), len(want))
+			}
+			if rgs := headerLines(out.Header, "@RG"); f.Group != "none" && (len(rgs) != 1 || !strings.Contains(rgs[0], "ID:"+f.Group)) {
+				t.Errorf("MaxOpen %d: %s has @RG lines %q", maxOpen, f.Group, rgs)
+			}
+		}
+		if want := []string{"none", "g1", "g2", "g3", "g4", "g0"}; !reflect.DeepEqual(groups, want) {
+			t.Errorf("MaxOpen %d: groups %v, want %v", maxOpen, groups, want)
+		}
+		if total != len(recs) {
+			t.Errorf("MaxOpen %d: split %d of %d reads", maxOpen, total, len(recs))
+		}
+	}
+}
+
+func TestSplitTagValues(t *testing.T) {
+	const seq = "ACGT"
+	recs := []*Alignment{
+		newTestRecord("r1", 0, 100, 0, "4M", seq),
+		newTestRecord("r2", 0, 200, 0, "4M", seq),
+		newTestRecord("r3", 0, 300, 0, "4M", seq),
+		newTestRecord("r4", 0, 400, 0, "4M", seq),
+	}
+	recs[0].SetAux("XB", []int8{1, -2})
+	recs[1].SetAux("XB", int32(7))
+	recs[2].SetAux("XB", []int8{1, -2})
+	b, _ := readTestBAM(t, writeTestBAM(t, testHeader(testRefs), testRefs, recs))
+
+	dir := t.TempDir()
+	files, err := b.Split(&SplitOptions{By: SplitTag, Tag: "XB", Path: filepath.Join(dir, "%s.bam"), MaxOpen: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []SplitFile{
+		{Group: "c,1,-2", Path: filepath.Join(dir, "c,1,-2.bam"), Count: 2},
+		{Group: "7", Path: filepath.Join(dir, "7.bam"), Count: 1},
+	}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got %+v, want %+v", files, want)
+	}
+	for _, f := range files {
+		readSplitFile(t, f)
+	}
+}
+
+func TestSplitInvalidGroups(t *testing.T) {
+	for _, group := range []string{"a/b", "..", `a\b`} {
+		a := newTestRecord("r1", 0, 100, 0, "4M", "ACGT")
+		a.SetAux("RG", group)
+		b, _ := readTestBAM(t, writeTestBAM(t, testHeader(testRefs), testRefs, []*Alignment{a}))
+
+		dir := t.TempDir()
+		if _, err := b.Split(&SplitOptions{Path: filepath.Join(dir, "x_%s.bam")}); err == nil {
+			t.Errorf("split into group %q succeeded", group)
+		}
+		if left, _ := os.ReadDir(dir); len(left) != 0 {
+			t.Errorf("group %q wrote %d files", group, len(left))
+		}
+	}
+}
+
+func TestSplitWriteError(t *testing.T) {
+	if _, err := os.Stat("/dev/full"); err != nil {
+		t.Skip("no /dev/full to fail the writes")
+	}
+	recs, extra := splitTestRecords()
+	b, _ := readTestBAM(t, writeTestBAM(t, testHeader(testRefs, extra...), testRefs, recs))
+
+	// the header of g2's file can't be written
+	dir := t.TempDir()
+	if err := os.Symlink("/dev/full", filepath.Join(dir, "g2.bam")); err != nil {
+		t.Skip(err)
+	}
+	if _, err := b.Split(&SplitOptions{Path: filepath.Join(dir, "%s.bam")}); err == nil {
+		t.Error("split into a full disk succeeded")
+	}
+}
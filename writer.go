@@ -0,0 +1,165 @@
+package bam
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// maxBlockData is the most uncompressed data put in one BGZF block, leaving
+// room for incompressible data to still fit in the 64KB block limit.
+const maxBlockData = 0xff00
+
+// A Writer writes alignments to a BAM file.
+type Writer struct {
+	w   io.Writer
+	buf []byte // uncompressed data of the pending block
+	zb  bytes.Buffer
+	zw  *flate.Writer
+	err error
+}
+
+// NewWriter writes the BAM header to w and returns a Writer for the
+// alignments. Close must be called to write the final blocks.
+func NewWriter(w io.Writer, header string, refs []Reference) (*Writer, error) {
+	return newWriterLevel(w, header, refs, flate.DefaultCompression)
+}
+
+// newWriterLevel is NewWriter with a choice of flate compression level.
+func newWriterLevel(w io.Writer, header string, refs []Reference, level int) (*Writer, error) {
+	bw, err := newBlockWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+
+	le := binary.LittleEndian
+	h := []byte{'B', 'A', 'M', 1}
+	h = le.AppendUint32(h, uint32(len(header)))
+	h = append(h, header...)
+	h = le.AppendUint32(h, uint32(len(refs)))
+	for _, r := range refs {
+		h = le.AppendUint32(h, uint32(len(r.Name)+1))
+		h = append(h, r.Name...)
+		h = append(h, 0)
+		h = le.AppendUint32(h, uint32(r.Length))
+	}
+	bw.write(h)
+	// alignments start in a fresh block, which keeps the header easy
+	// to replace without touching the rest of the file
+	bw.flush()
+	return bw, bw.err
+}
+
+// newBlockWriter returns a Writer that doesn't write a header, for adding
+// alignments to the end of an unfinished BAM file.
+func newBlockWriter(w io.Writer, level int) (*Writer, error) {
+	bw := &Writer{w: w, buf: make([]byte, 0, maxBlockData)}
+	bw.zw, bw.err = flate.NewWriter(&bw.zb, level)
+	if bw.err != nil {
+		return nil, bw.err
+	}
+	return bw, nil
+}
+
+// Write adds an alignment to the file.
+func (w *Writer) Write(a *Alignment) error {
+	w.write(a.marshal(nil))
+	return w.err
+}
+
+// Close flushes any pending data and writes the end-of-file marker.
+// It does not close the underlying io.Writer.
+func (w *Writer) Close() error {
+	w.flush()
+	if w.err == nil {
+		_, w.err = w.w.Write(bgzfEOF)
+	}
+	return w.err
+}
+
+func (w *Writer) write(p []byte) {
+	for len(p) > 0 && w.err == nil {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		if len(w.buf) == cap(w.buf) {
+			w.flush()
+		}
+	}
+}
+
+// flush compresses the pending data into a BGZF block.
+func (w *Writer) flush() {
+	if len(w.buf) == 0 || w.err != nil {
+		return
+	}
+	w.zb.Reset()
+	w.zw.Reset(&w.zb)
+	if _, w.err = w.zw.Write(w.buf); w.err != nil {
+		return
+	}
+	if w.err = w.zw.Close(); w.err != nil {
+		return
+	}
+
+	le := binary.LittleEndian
+	block := make([]byte, 0, bgzfHeaderSize+w.zb.Len()+8)
+	block = append(block, 0x1f, 0x8b, 8, 4, 0, 0, 0, 0, 0, 0xff, 6, 0, 'B', 'C', 2, 0)
+	block = le.AppendUint16(block, uint16(bgzfHeaderSize+w.zb.Len()+8-1))
+	block = append(block, w.zb.Bytes()...)
+	block = le.AppendUint32(block, crc32.ChecksumIEEE(w.buf))
+	block = le.AppendUint32(block, uint32(len(w.buf)))
+	_, w.err = w.w.Write(block)
+	w.buf = w.buf[:0]
+}
+
+// marshal appends the BAM encoding of the alignment (including the
+// leading block_size) to dst.
+func (a *Alignment) marshal(dst []byte) []byte {
+	le := binary.LittleEndian
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0) // block_size, filled in below
+	dst = le.AppendUint32(dst, uint32(a.refID))
+	dst = le.AppendUint32(dst, uint32(a.pos))
+	dst = append(dst, uint8(len(a.ReadName)+1), a.mapq)
+	dst = le.AppendUint16(dst, a.computeBin())
+	dst = le.AppendUint16(dst, uint16(len(a.cigarPacked)))
+	dst = le.AppendUint16(dst, a.flag)
+	dst = le.AppendUint32(dst, uint32(a.seqLen))
+	dst = le.AppendUint32(dst, uint32(a.nextRefID))
+	dst = le.AppendUint32(dst, uint32(a.nextPos))
+	dst = le.AppendUint32(dst, uint32(a.tlen))
+	dst = append(dst, a.ReadName...)
+	dst = append(dst, 0)
+	for _, op := range a.cigarPacked {
+		dst = le.AppendUint32(dst, op)
+	}
+	dst = append(dst, a.seqPacked...)
+	dst = append(dst, a.qual...)
+	dst = append(dst, a.aux...)
+	le.PutUint32(dst[start:], uint32(len(dst)-start-4))
+	return dst
+}
+
+// computeBin returns the BAI bin of the alignment, as used in the record.
+func (a *Alignment) computeBin() uint16 {
+	if a.refID < 0 || a.pos < 0 {
+		return 4680 // reg2bin(-1, 0)
+	}
+	beg, end := int64(a.pos), int64(a.End())-1
+	switch {
+	case beg>>14 == end>>14:
+		return uint16(((1<<15)-1)/7 + beg>>14)
+	case beg>>17 == end>>17:
+		return uint16(((1<<12)-1)/7 + beg>>17)
+	case beg>>20 == end>>20:
+		return uint16(((1<<9)-1)/7 + beg>>20)
+	case beg>>23 == end>>23:
+		return uint16(((1<<6)-1)/7 + beg>>23)
+	case beg>>26 == end>>26:
+		return uint16(((1<<3)-1)/7 + beg>>26)
+	}
+	return 0
+}